@@ -0,0 +1,87 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+type applyLayerCmd struct {
+	mediaType string
+	digest    digest.Digest
+	quiet     bool
+}
+
+func applyLayerAction(context *cli.Context) error {
+	if len(context.Args()) != 2 {
+		return fmt.Errorf("both layer and rootfs must be provided")
+	}
+
+	v := applyLayerCmd{
+		mediaType: context.String("media-type"),
+		digest:    digest.Digest(context.String("digest")),
+		quiet:     context.Bool("quiet"),
+	}
+
+	layer, rootfs := context.Args()[0], context.Args()[1]
+
+	var r io.Reader = os.Stdin
+	if layer != "-" {
+		f, err := os.Open(layer)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	changes, err := image.ApplyLayerContext(appContext, rootfs, r, v.mediaType, &image.ApplyLayerOptions{
+		Digest: v.digest,
+	})
+	if !v.quiet {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+	}
+
+	return err
+}
+
+var applyLayerCommand = cli.Command{
+	Name:      "apply-layer",
+	Usage:     "Apply a layer on top of an existing root filesystem",
+	ArgsUsage: "LAYER ROOTFS",
+	Action:    applyLayerAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "media-type",
+			Usage: "Media type of the layer. If unset, the compression is detected from the content.",
+		},
+		cli.StringFlag{
+			Name:  "digest",
+			Usage: "Digest the layer must match, e.g. sha256:<hex>.",
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "Do not print the changes made to the root filesystem.",
+		},
+	},
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// supported convert types
+var convertTypes = []string{
+	image.TypeImageLayout,
+	image.TypeImage,
+	image.TypeImageZip,
+}
+
+type convertCmd struct {
+	typ      string // the type of the source, can be empty string
+	destType string // the type of the destination, can be empty string
+}
+
+func convertAction(context *cli.Context) error {
+	if len(context.Args()) != 2 {
+		return fmt.Errorf("both src and dest must be provided")
+	}
+
+	v := convertCmd{
+		typ:      context.String("type"),
+		destType: context.String("dest-type"),
+	}
+
+	src, dest := context.Args()[0], context.Args()[1]
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(src)
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", src, err)
+		}
+		v.typ = typ
+	}
+
+	if v.destType == "" {
+		v.destType = destinationType(dest)
+	}
+
+	var err error
+	switch v.typ {
+	case image.TypeImageLayout:
+		err = image.ConvertLayoutContext(appContext, src, dest, v.destType)
+
+	case image.TypeImageZip:
+		err = image.ConvertZipContext(appContext, src, dest, v.destType)
+
+	case image.TypeImage:
+		err = image.ConvertFileContext(appContext, src, dest, v.destType)
+
+	default:
+		err = fmt.Errorf("cannot convert %q", v.typ)
+	}
+
+	return err
+}
+
+var convertCommand = cli.Command{
+	Name:   "convert",
+	Usage:  "Convert an image layout between directory, tar and zip",
+	Action: convertAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "type",
+			Usage: fmt.Sprintf(
+				`Type of the source. If unset, oci-image-tool will try to auto-detect the type. One of "%s".`,
+				strings.Join(convertTypes, ","),
+			),
+		},
+		cli.StringFlag{
+			Name: "dest-type",
+			Usage: fmt.Sprintf(
+				`Type of the destination. If unset, it is auto-detected for existing destinations and derived from the ".tar" or ".zip" extension otherwise. One of "%s".`,
+				strings.Join(convertTypes, ","),
+			),
+		},
+	},
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// supported copy types
+var copyTypes = []string{
+	image.TypeImageLayout,
+	image.TypeImage,
+	image.TypeImageZip,
+}
+
+type copyCmd struct {
+	typ      string // the type of the source, can be empty string
+	destType string // the type of the destination, can be empty string
+}
+
+func copyAction(context *cli.Context) error {
+	if len(context.Args()) != 2 {
+		return fmt.Errorf("both src and dest must be provided")
+	}
+
+	v := copyCmd{
+		typ:      context.String("type"),
+		destType: context.String("dest-type"),
+	}
+
+	src, ref := splitRef(context.Args()[0])
+	dest, newRef := splitRef(context.Args()[1])
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(src)
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", src, err)
+		}
+		v.typ = typ
+	}
+
+	if v.destType == "" {
+		v.destType = destinationType(dest)
+	}
+
+	var err error
+	switch v.typ {
+	case image.TypeImageLayout:
+		err = image.CopyLayoutContext(appContext, src, dest, v.destType, ref, newRef)
+
+	case image.TypeImageZip:
+		err = image.CopyZipContext(appContext, src, dest, v.destType, ref, newRef)
+
+	case image.TypeImage:
+		err = image.CopyFileContext(appContext, src, dest, v.destType, ref, newRef)
+
+	default:
+		err = fmt.Errorf("cannot copy %q", v.typ)
+	}
+
+	return err
+}
+
+// splitRef splits arg of the form PATH[:REF] into its path and ref name.
+// An existing path is never split, otherwise the ref starts at the first
+// colon of the last path element.
+func splitRef(arg string) (string, string) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, ""
+	}
+
+	base := strings.LastIndex(arg, string(os.PathSeparator)) + 1
+	if i := strings.Index(arg[base:], ":"); i > 0 {
+		return arg[:base+i], arg[base+i+1:]
+	}
+
+	return arg, ""
+}
+
+// destinationType returns the type of the image layout at dest. Existing
+// destinations are autodetected, new ones are guessed from their extension.
+func destinationType(dest string) string {
+	if typ, err := image.Autodetect(dest); err == nil {
+		return typ
+	}
+
+	switch strings.ToLower(filepath.Ext(dest)) {
+	case ".tar":
+		return image.TypeImage
+	case ".zip":
+		return image.TypeImageZip
+	}
+
+	return image.TypeImageLayout
+}
+
+var copyCommand = cli.Command{
+	Name:      "copy",
+	Usage:     "Copy images between image layouts",
+	ArgsUsage: "SRC[:ref] DEST[:newref]",
+	Action:    copyAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "type",
+			Usage: fmt.Sprintf(
+				`Type of the source. If unset, oci-image-tool will try to auto-detect the type. One of "%s".`,
+				strings.Join(copyTypes, ","),
+			),
+		},
+		cli.StringFlag{
+			Name: "dest-type",
+			Usage: fmt.Sprintf(
+				`Type of the destination. If unset, it is auto-detected for existing destinations and derived from the ".tar" or ".zip" extension otherwise. One of "%s".`,
+				strings.Join(copyTypes, ","),
+			),
+		},
+	},
+}
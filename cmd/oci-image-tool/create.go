@@ -15,10 +15,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 
 	"github.com/opencontainers/image-tools/image"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/urfave/cli"
 )
 
@@ -29,11 +33,19 @@ var bundleTypes = []string{
 	image.TypeImageZip,
 }
 
+// supported volume strategies
+var volumeStrategies = []string{
+	image.VolumeBundle,
+	image.VolumeTmpfs,
+	image.VolumeHost,
+}
+
 type bundleCmd struct {
 	typ      string // the type to bundle, can be empty string
 	refs     []string
 	root     string
 	platform string
+	opts     image.BundleOptions
 }
 
 func createAction(context *cli.Context) error {
@@ -46,12 +58,63 @@ func createAction(context *cli.Context) error {
 		refs:     context.StringSlice("ref"),
 		root:     context.String("rootfs"),
 		platform: context.String("platform"),
+		opts: image.BundleOptions{
+			VolumeStrategy: context.String("volume-strategy"),
+			Volumes:        map[string]string{},
+			Env:            context.StringSlice("env"),
+			Args:           context.StringSlice("args"),
+			Cwd:            context.String("cwd"),
+			Hostname:       context.String("hostname"),
+			Annotations:    map[string]string{},
+		},
 	}
 
 	if len(v.refs) == 0 {
 		return fmt.Errorf("ref must be provided")
 	}
 
+	if err := requireSignature(context); err != nil {
+		return err
+	}
+
+	for _, vol := range context.StringSlice("volume") {
+		parts := strings.SplitN(vol, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("volume %q must be of the form dest=hostpath", vol)
+		}
+
+		hostPath, err := filepath.Abs(parts[1])
+		if err != nil {
+			return err
+		}
+		v.opts.Volumes[parts[0]] = hostPath
+	}
+
+	for _, annotation := range context.StringSlice("annotation") {
+		parts := strings.SplitN(annotation, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("annotation %q must be of the form key=value", annotation)
+		}
+		v.opts.Annotations[parts[0]] = parts[1]
+	}
+
+	if context.IsSet("readonly-rootfs") {
+		readonly := context.Bool("readonly-rootfs")
+		v.opts.ReadonlyRootfs = &readonly
+	}
+
+	if template := context.String("spec-template"); template != "" {
+		buf, err := ioutil.ReadFile(template)
+		if err != nil {
+			return err
+		}
+
+		v.opts.Template = &specs.Spec{}
+		if err := json.Unmarshal(buf, v.opts.Template); err != nil {
+			return fmt.Errorf("%s: invalid runtime configuration: %v", template, err)
+		}
+	}
+
 	for index, ref := range v.refs {
 		for i := index + 1; i < len(v.refs); i++ {
 			if ref == v.refs[i] {
@@ -71,13 +134,13 @@ func createAction(context *cli.Context) error {
 	var err error
 	switch v.typ {
 	case image.TypeImageLayout:
-		err = image.CreateRuntimeBundleLayout(context.Args()[0], context.Args()[1], v.root, v.platform, v.refs)
+		err = image.CreateRuntimeBundleLayoutContext(appContext, context.Args()[0], context.Args()[1], v.root, v.platform, v.refs, &v.opts)
 
 	case image.TypeImageZip:
-		err = image.CreateRuntimeBundleZip(context.Args()[0], context.Args()[1], v.root, v.platform, v.refs)
+		err = image.CreateRuntimeBundleZipContext(appContext, context.Args()[0], context.Args()[1], v.root, v.platform, v.refs, &v.opts)
 
 	case image.TypeImage:
-		err = image.CreateRuntimeBundleFile(context.Args()[0], context.Args()[1], v.root, v.platform, v.refs)
+		err = image.CreateRuntimeBundleFileContext(appContext, context.Args()[0], context.Args()[1], v.root, v.platform, v.refs, &v.opts)
 
 	default:
 		err = fmt.Errorf("cannot create %q", v.typ)
@@ -101,7 +164,7 @@ var createCommand = cli.Command{
 		},
 		cli.StringSliceFlag{
 			Name:  "ref",
-			Usage: "A set of ref specify the search criteria for the validated reference, format is A=B. Only support 'name', 'platform.os' and 'digest' three cases.",
+			Usage: "A set of ref specify the search criteria for the validated reference, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
 		},
 		cli.StringFlag{
 			Name:  "rootfs",
@@ -112,5 +175,46 @@ var createCommand = cli.Command{
 			Name:  "platform",
 			Usage: "Specify the os and architecture of the manifest, format is OS:Architecture. Only applicable if reftype is index.",
 		},
+		cli.StringFlag{
+			Name:  "volume-strategy",
+			Value: image.VolumeBundle,
+			Usage: fmt.Sprintf(
+				`How the volumes of the image are provided to the container. One of "%s".`,
+				strings.Join(volumeStrategies, ","),
+			),
+		},
+		cli.StringSliceFlag{
+			Name:  "volume",
+			Usage: "Bind mount a host path on a volume, format is dest=hostpath. Required for every volume of the image with the host strategy.",
+		},
+		cli.StringFlag{
+			Name:  "spec-template",
+			Usage: "A runtime configuration (config.json) the image config is merged into, instead of the defaults.",
+		},
+		cli.StringSliceFlag{
+			Name:  "env",
+			Usage: "Set an environment variable of the process, format is NAME=value. Overrides the template and the image.",
+		},
+		cli.StringSliceFlag{
+			Name:  "args",
+			Usage: "An argument of the process, repeat for each argument. Overrides the template and the image.",
+		},
+		cli.StringFlag{
+			Name:  "cwd",
+			Usage: "The working directory of the process. Overrides the template and the image.",
+		},
+		cli.StringFlag{
+			Name:  "hostname",
+			Usage: "The hostname of the container. Overrides the template.",
+		},
+		cli.BoolFlag{
+			Name:  "readonly-rootfs",
+			Usage: "Whether the root filesystem is read-only, use --readonly-rootfs=false for a writable one. Overrides the template.",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "Set an annotation of the runtime configuration, format is key=value. Overrides the template and the image.",
+		},
+		verifyKeyFlag,
 	},
 }
@@ -0,0 +1,127 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// supported export types
+var exportTypes = []string{
+	image.TypeImageLayout,
+	image.TypeImage,
+	image.TypeImageZip,
+}
+
+// supported export formats
+var exportFormats = []string{
+	formatDockerArchive,
+}
+
+type exportCmd struct {
+	typ      string // the type to export, can be empty string
+	to       string
+	refs     []string
+	platform string
+}
+
+func exportAction(context *cli.Context) error {
+	if len(context.Args()) != 2 {
+		return fmt.Errorf("both src and dest must be provided")
+	}
+
+	v := exportCmd{
+		typ:      context.String("type"),
+		to:       context.String("to"),
+		refs:     context.StringSlice("ref"),
+		platform: context.String("platform"),
+	}
+
+	if len(v.refs) == 0 {
+		return fmt.Errorf("ref must be provided")
+	}
+
+	if v.to != formatDockerArchive {
+		return fmt.Errorf("cannot export to %q", v.to)
+	}
+
+	for index, ref := range v.refs {
+		for i := index + 1; i < len(v.refs); i++ {
+			if ref == v.refs[i] {
+				fmt.Printf("WARNING: refs contains duplicate reference %q.\n", v.refs[i])
+			}
+		}
+	}
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(context.Args()[0])
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", context.Args()[0], err)
+		}
+		v.typ = typ
+	}
+
+	var err error
+	switch v.typ {
+	case image.TypeImageLayout:
+		err = image.ExportDockerArchiveLayoutContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs)
+
+	case image.TypeImageZip:
+		err = image.ExportDockerArchiveZipContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs)
+
+	case image.TypeImage:
+		err = image.ExportDockerArchiveFileContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs)
+
+	default:
+		err = fmt.Errorf("cannot export %q", v.typ)
+	}
+
+	return err
+}
+
+var exportCommand = cli.Command{
+	Name:   "export",
+	Usage:  "Export an image as an archive for other container tools",
+	Action: exportAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "type",
+			Usage: fmt.Sprintf(
+				`Type of the file to export. If unset, oci-image-tool will try to auto-detect the type. One of "%s".`,
+				strings.Join(exportTypes, ","),
+			),
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Value: formatDockerArchive,
+			Usage: fmt.Sprintf(
+				`Format of the archive to write. One of "%s".`,
+				strings.Join(exportFormats, ","),
+			),
+		},
+		cli.StringSliceFlag{
+			Name:  "ref",
+			Usage: "A set of ref specify the search criteria for the exported reference, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Specify the os and architecture of the manifest, format is OS:Architecture. Only applicable if reftype is index.",
+		},
+	},
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// supported fsck types
+var fsckTypes = []string{
+	image.TypeImageLayout,
+	image.TypeImage,
+	image.TypeImageZip,
+}
+
+type fsckCmd struct {
+	typ          string // the type of the layouts, can be empty string
+	unreferenced bool
+}
+
+func fsckAction(context *cli.Context) error {
+	if len(context.Args()) < 1 {
+		return fmt.Errorf("no files specified")
+	}
+
+	v := fsckCmd{
+		typ:          context.String("type"),
+		unreferenced: !context.Bool("no-unreferenced"),
+	}
+
+	var errs []string
+	for _, arg := range context.Args() {
+		res, err := v.fsck(arg)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", arg, err))
+			continue
+		}
+
+		for _, problem := range res.Problems {
+			fmt.Printf("%s: %s\n", arg, problem)
+		}
+		if v.unreferenced {
+			for _, d := range res.Unreferenced {
+				fmt.Printf("%s: unreferenced blob %s\n", arg, d)
+			}
+		}
+
+		if !res.OK() {
+			errs = append(errs, fmt.Sprintf("%s: %d problems found", arg, len(res.Problems)))
+			continue
+		}
+		fmt.Printf("%s: OK\n", arg)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d errors detected: \n%s", len(errs), strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+func (v fsckCmd) fsck(name string) (*image.FsckResult, error) {
+	typ := v.typ
+	if typ == "" {
+		var err error
+		if typ, err = image.Autodetect(name); err != nil {
+			return nil, fmt.Errorf("autodetection failed: %v", err)
+		}
+	}
+
+	switch typ {
+	case image.TypeImageLayout:
+		return image.FsckLayoutContext(appContext, name)
+	case image.TypeImageZip:
+		return image.FsckZipContext(appContext, name)
+	case image.TypeImage:
+		return image.FsckFileContext(appContext, name)
+	}
+
+	return nil, fmt.Errorf("cannot check %q", typ)
+}
+
+var fsckCommand = cli.Command{
+	Name:      "fsck",
+	Usage:     "Check every blob and file of image layouts",
+	ArgsUsage: "FILE...",
+	Action:    fsckAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "type",
+			Usage: fmt.Sprintf(
+				`Type of the image layouts. If unset, oci-image-tool will try to auto-detect the type. One of "%s".`,
+				strings.Join(fsckTypes, ","),
+			),
+		},
+		cli.BoolFlag{
+			Name:  "no-unreferenced",
+			Usage: "Do not list the blobs unreachable from index.json.",
+		},
+	},
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// formatDockerArchive is the format of archives produced by `docker save`.
+const formatDockerArchive = "docker-archive"
+
+// supported import formats
+var importFormats = []string{
+	formatDockerArchive,
+}
+
+func importAction(context *cli.Context) error {
+	if len(context.Args()) != 2 {
+		return fmt.Errorf("both src and dest must be provided")
+	}
+
+	switch from := context.String("from"); from {
+	case formatDockerArchive:
+		return image.ImportDockerArchiveFileContext(appContext, context.Args()[0], context.Args()[1])
+	default:
+		return fmt.Errorf("cannot import from %q", from)
+	}
+}
+
+var importCommand = cli.Command{
+	Name:   "import",
+	Usage:  "Import an image archive into an OCI image layout",
+	Action: importAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Value: formatDockerArchive,
+			Usage: fmt.Sprintf(
+				`Format of the archive to import. One of "%s".`,
+				strings.Join(importFormats, ","),
+			),
+		},
+	},
+}
@@ -15,9 +15,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-tools/image"
 	"github.com/opencontainers/image-tools/version"
 	"github.com/sirupsen/logrus"
@@ -28,6 +32,10 @@ import (
 // and will be populated by the Makefile
 var gitCommit = ""
 
+// appContext is cancelled when the process is interrupted, so that the
+// running command stops and cleans up its partial output.
+var appContext, cancelApp = context.WithCancel(context.Background())
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "oci-image-tool"
@@ -42,17 +50,42 @@ func main() {
 			Name:  "debug",
 			Usage: "enable debug output",
 		},
+		cli.StringFlag{
+			Name:  "digest-algorithm",
+			Value: string(digest.Canonical),
+			Usage: "digest algorithm of the new blobs and diff_ids, one of sha256, sha512",
+		},
 	}
 	app.Before = func(c *cli.Context) error {
 		if c.GlobalBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		image.SetEventSink(newEventSink())
+
+		algorithm := digest.Algorithm(c.GlobalString("digest-algorithm"))
+		if err := image.CheckAlgorithm(algorithm); err != nil {
+			return err
+		}
+		appContext = image.WithDigestAlgorithm(appContext, algorithm)
+
 		return nil
 	}
 	app.Commands = []cli.Command{
 		validateCommand,
+		fsckCommand,
 		unpackCommand,
 		createCommand,
+		importCommand,
+		exportCommand,
+		copyCommand,
+		convertCommand,
+		applyLayerCommand,
+		squashCommand,
+		mutateCommand,
+		referrersCommand,
+		signCommand,
+		verifyCommand,
+		sbomCommand,
 	}
 
 	cli.AppHelpTemplate = fmt.Sprintf(`%sMore information:
@@ -60,6 +93,16 @@ func main() {
 		bug report	%s
 	`, cli.AppHelpTemplate, image.SpecURL, image.IssuesURL)
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancelApp()
+		// a second signal kills the process instead of waiting for the
+		// cleanup to finish
+		signal.Stop(signals)
+	}()
+
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
 	}
@@ -0,0 +1,230 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+type mutateCmd struct {
+	typ      string // the type of the source, can be empty string
+	refs     []string
+	platform string
+	opts     image.MutateOptions
+}
+
+// parseArgs parses the value of --entrypoint or --cmd: a JSON array, or a
+// single argument. An empty value clears the arguments.
+func parseArgs(name, value string) ([]string, error) {
+	if value == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(value, "[") {
+		return []string{value}, nil
+	}
+
+	var args []string
+	if err := json.Unmarshal([]byte(value), &args); err != nil {
+		return nil, fmt.Errorf("%s %q must be a JSON array of strings: %v", name, value, err)
+	}
+	return append([]string{}, args...), nil
+}
+
+// parseKeyValues parses the key=value pairs of the flag name.
+func parseKeyValues(context *cli.Context, name string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, kv := range context.StringSlice(name) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s %q must be of the form key=value", name, kv)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+func mutateAction(context *cli.Context) error {
+	if len(context.Args()) != 1 {
+		return fmt.Errorf("src must be provided")
+	}
+
+	v := mutateCmd{
+		typ:      context.String("type"),
+		refs:     context.StringSlice("ref"),
+		platform: context.String("platform"),
+		opts: image.MutateOptions{
+			AppendLayers:      context.StringSlice("append-layer"),
+			Env:               context.StringSlice("env"),
+			UnsetEnv:          context.StringSlice("unset-env"),
+			RemoveLabels:      context.StringSlice("remove-label"),
+			RemoveAnnotations: context.StringSlice("remove-annotation"),
+			NewRef:            context.String("new-ref"),
+		},
+	}
+
+	if len(v.refs) == 0 {
+		return fmt.Errorf("ref must be provided")
+	}
+
+	for _, layer := range context.StringSlice("remove-layer") {
+		i, err := strconv.Atoi(layer)
+		if err != nil {
+			return fmt.Errorf("remove-layer %q must be a layer index", layer)
+		}
+		v.opts.RemoveLayers = append(v.opts.RemoveLayers, i)
+	}
+
+	var err error
+	if context.IsSet("entrypoint") {
+		if v.opts.Entrypoint, err = parseArgs("entrypoint", context.String("entrypoint")); err != nil {
+			return err
+		}
+	}
+	if context.IsSet("cmd") {
+		if v.opts.Cmd, err = parseArgs("cmd", context.String("cmd")); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range v.opts.Env {
+		if !strings.Contains(e, "=") || strings.HasPrefix(e, "=") {
+			return fmt.Errorf("env %q must be of the form NAME=VALUE", e)
+		}
+	}
+
+	if context.IsSet("user") {
+		user := context.String("user")
+		v.opts.User = &user
+	}
+	if context.IsSet("workdir") {
+		workdir := context.String("workdir")
+		v.opts.WorkingDir = &workdir
+	}
+	if context.IsSet("stop-signal") {
+		signal := context.String("stop-signal")
+		v.opts.StopSignal = &signal
+	}
+
+	if v.opts.Labels, err = parseKeyValues(context, "label"); err != nil {
+		return err
+	}
+	if v.opts.Annotations, err = parseKeyValues(context, "annotation"); err != nil {
+		return err
+	}
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(context.Args()[0])
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", context.Args()[0], err)
+		}
+		v.typ = typ
+	}
+
+	if v.typ != image.TypeImageLayout {
+		return fmt.Errorf("cannot mutate %q: only image layout directories can be mutated, see oci-image-tool convert", v.typ)
+	}
+
+	desc, err := image.MutateLayoutContext(appContext, context.Args()[0], v.platform, v.refs, &v.opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(desc.Digest)
+	return nil
+}
+
+var mutateCommand = cli.Command{
+	Name:      "mutate",
+	Usage:     "Change the config, layers and annotations of an image",
+	ArgsUsage: "SRC",
+	Action:    mutateAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: fmt.Sprintf(`Type of the source. If unset, oci-image-tool will try to auto-detect the type. Must be "%s".`, image.TypeImageLayout),
+		},
+		cli.StringSliceFlag{
+			Name:  "ref",
+			Usage: "A set of ref specify the search criteria for the image to mutate, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Specify the os and architecture of the manifest to mutate, format is OS:Architecture. Only applicable if reftype is index.",
+		},
+		cli.StringFlag{
+			Name:  "new-ref",
+			Usage: "Ref name of the mutated image. If unset, the mutated image replaces the original one.",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-layer",
+			Usage: "Remove the layer of the given index, from 0 for the base layer, or from -1 for the topmost layer. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "append-layer",
+			Usage: "Append the plain or gzip tar file, or the directory as a reproducible layer, on top of the layers. May be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "entrypoint",
+			Usage: `Set the entrypoint, as a JSON array or a single argument. An empty value clears it.`,
+		},
+		cli.StringFlag{
+			Name:  "cmd",
+			Usage: `Set the command, as a JSON array or a single argument. An empty value clears it.`,
+		},
+		cli.StringSliceFlag{
+			Name:  "env",
+			Usage: "Set an environment variable, format is NAME=VALUE. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "unset-env",
+			Usage: "Remove an environment variable. May be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "user",
+			Usage: "Set the user. An empty value clears it.",
+		},
+		cli.StringFlag{
+			Name:  "workdir",
+			Usage: "Set the working directory. An empty value clears it.",
+		},
+		cli.StringFlag{
+			Name:  "stop-signal",
+			Usage: "Set the stop signal. An empty value clears it.",
+		},
+		cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "Set a label of the config, format is key=value. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-label",
+			Usage: "Remove a label of the config. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "Set an annotation of the manifest, format is key=value. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-annotation",
+			Usage: "Remove an annotation of the manifest. May be repeated.",
+		},
+	},
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// barWidth is the number of cells of the progress bar.
+	barWidth = 30
+
+	// barInterval is the minimum time between two redraws of the bar.
+	barInterval = 100 * time.Millisecond
+
+	// logInterval is the minimum time between two progress log lines.
+	logInterval = 5 * time.Second
+)
+
+// newEventSink returns the sink rendering the events of the image package
+// to stderr: a progress bar on terminals and log lines otherwise.
+func newEventSink() image.EventSink {
+	if terminal.IsTerminal(int(os.Stderr.Fd())) {
+		return &progressBar{out: os.Stderr}
+	}
+
+	return &progressLog{}
+}
+
+// shortDigest returns the algorithm and the first hex characters of d.
+func shortDigest(e image.Event) string {
+	hex := e.Digest.Hex()
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return fmt.Sprintf("%s:%s", e.Digest.Algorithm(), hex)
+}
+
+// humanSize formats n bytes with a binary unit.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressBar draws the progress of the current layer on a single line.
+type progressBar struct {
+	out   io.Writer
+	last  time.Time
+	drawn bool
+}
+
+func (p *progressBar) Event(e image.Event) {
+	switch e.Type {
+	case image.EventLayerStarted:
+		p.draw(e)
+	case image.EventLayerProgress:
+		if time.Since(p.last) >= barInterval {
+			p.draw(e)
+		}
+	case image.EventLayerFinished:
+		p.draw(e)
+		fmt.Fprintln(p.out)
+		p.drawn = false
+	case image.EventWarning:
+		p.clear()
+		fmt.Fprintf(p.out, "WARNING: %s\n", e.Message)
+	case image.EventDebug:
+		logrus.Debug(e.Message)
+	case image.EventBlobVerified:
+		logrus.Debugf("%s: verified %s", e.Digest, humanSize(e.Size))
+	}
+}
+
+func (p *progressBar) draw(e image.Event) {
+	p.last = time.Now()
+
+	filled := barWidth
+	if e.Size > 0 && e.Bytes < e.Size {
+		filled = int(e.Bytes * barWidth / e.Size)
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+
+	fmt.Fprintf(p.out, "\r%s [%s] %s/%s %d entries", shortDigest(e), bar, humanSize(e.Bytes), humanSize(e.Size), e.Entries)
+	p.drawn = true
+}
+
+// clear erases the bar being drawn, if any.
+func (p *progressBar) clear() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// progressLog logs the progress of the layers periodically.
+type progressLog struct {
+	last time.Time
+}
+
+func (p *progressLog) Event(e image.Event) {
+	switch e.Type {
+	case image.EventLayerStarted:
+		p.last = time.Now()
+		logrus.Infof("%s: extracting %s", e.Digest, humanSize(e.Size))
+	case image.EventLayerProgress:
+		if time.Since(p.last) >= logInterval {
+			p.last = time.Now()
+			logrus.Infof("%s: %s/%s read, %d entries extracted", e.Digest, humanSize(e.Bytes), humanSize(e.Size), e.Entries)
+		}
+	case image.EventLayerFinished:
+		logrus.Infof("%s: extracted %d entries", e.Digest, e.Entries)
+	case image.EventWarning:
+		logrus.Warn(e.Message)
+	case image.EventDebug:
+		logrus.Debug(e.Message)
+	case image.EventBlobVerified:
+		logrus.Debugf("%s: verified %s", e.Digest, humanSize(e.Size))
+	}
+}
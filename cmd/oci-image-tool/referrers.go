@@ -0,0 +1,121 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// supported referrers types
+var referrersTypes = []string{
+	image.TypeImageLayout,
+	image.TypeImage,
+	image.TypeImageZip,
+}
+
+type referrersCmd struct {
+	typ          string // the type of the source, can be empty string
+	artifactType string
+	updateIndex  bool
+}
+
+func referrersAction(context *cli.Context) error {
+	if len(context.Args()) != 2 {
+		return fmt.Errorf("both src and digest must be provided")
+	}
+
+	v := referrersCmd{
+		typ:          context.String("type"),
+		artifactType: context.String("artifact-type"),
+		updateIndex:  context.Bool("update-index"),
+	}
+
+	src := context.Args()[0]
+	dgst, err := digest.Parse(context.Args()[1])
+	if err != nil {
+		return fmt.Errorf("%q: %v", context.Args()[1], err)
+	}
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(src)
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", src, err)
+		}
+		v.typ = typ
+	}
+
+	if v.updateIndex {
+		if v.typ != image.TypeImageLayout {
+			return fmt.Errorf("cannot update the referrers index of %q: only image layout directories can be updated, see oci-image-tool convert", v.typ)
+		}
+		if _, err := image.IndexReferrersLayoutContext(appContext, src, dgst); err != nil {
+			return err
+		}
+	}
+
+	var descs []v1.Descriptor
+	switch v.typ {
+	case image.TypeImageLayout:
+		descs, err = image.ReferrersLayoutContext(appContext, src, dgst, v.artifactType)
+
+	case image.TypeImageZip:
+		descs, err = image.ReferrersZipContext(appContext, src, dgst, v.artifactType)
+
+	case image.TypeImage:
+		descs, err = image.ReferrersFileContext(appContext, src, dgst, v.artifactType)
+
+	default:
+		err = fmt.Errorf("cannot list the referrers of %q", v.typ)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range descs {
+		fmt.Printf("%s\t%s\n", desc.Digest, desc.ArtifactType)
+	}
+
+	return nil
+}
+
+var referrersCommand = cli.Command{
+	Name:      "referrers",
+	Usage:     "List the artifacts whose subject is a manifest or index",
+	ArgsUsage: "SRC DIGEST",
+	Action:    referrersAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "type",
+			Usage: fmt.Sprintf(
+				`Type of the source. If unset, oci-image-tool will try to auto-detect the type. One of "%s".`,
+				strings.Join(referrersTypes, ","),
+			),
+		},
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "Only list the referrers of this artifact type.",
+		},
+		cli.BoolFlag{
+			Name:  "update-index",
+			Usage: "Scan the image layout directory and store the referrers in the referrers index of DIGEST before listing them.",
+		},
+	},
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// supported sbom types
+var sbomTypes = []string{
+	image.TypeImageLayout,
+	image.TypeImage,
+	image.TypeImageZip,
+}
+
+// supported sbom formats
+var sbomFormats = []string{
+	image.SBOMFormatSPDX,
+	image.SBOMFormatCycloneDX,
+}
+
+type sbomCmd struct {
+	typ      string // the type of the source, can be empty string
+	refs     []string
+	platform string
+	format   string
+	output   string
+	attach   bool
+}
+
+func sbomAction(context *cli.Context) error {
+	if len(context.Args()) != 1 {
+		return fmt.Errorf("src must be provided")
+	}
+
+	v := sbomCmd{
+		typ:      context.String("type"),
+		refs:     context.StringSlice("ref"),
+		platform: context.String("platform"),
+		format:   context.String("format"),
+		output:   context.String("output"),
+		attach:   context.Bool("attach"),
+	}
+
+	if len(v.refs) == 0 {
+		return fmt.Errorf("ref must be provided")
+	}
+
+	src := context.Args()[0]
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(src)
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", src, err)
+		}
+		v.typ = typ
+	}
+
+	if v.attach && v.typ != image.TypeImageLayout {
+		return fmt.Errorf("cannot attach an SBOM to %q: only image layout directories can be updated, see oci-image-tool convert", v.typ)
+	}
+
+	var (
+		bom *image.BillOfMaterials
+		err error
+	)
+	switch v.typ {
+	case image.TypeImageLayout:
+		bom, err = image.SBOMLayoutContext(appContext, src, v.platform, v.refs)
+
+	case image.TypeImageZip:
+		bom, err = image.SBOMZipContext(appContext, src, v.platform, v.refs)
+
+	case image.TypeImage:
+		bom, err = image.SBOMFileContext(appContext, src, v.platform, v.refs)
+
+	default:
+		err = fmt.Errorf("cannot list the packages of %q", v.typ)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, buf, err := bom.Encode(v.format)
+	if err != nil {
+		return err
+	}
+
+	if v.output != "" {
+		if err := ioutil.WriteFile(v.output, buf, 0644); err != nil {
+			return err
+		}
+	} else if !v.attach {
+		if _, err := os.Stdout.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if v.attach {
+		desc, err := image.AttachSBOMLayoutContext(appContext, src, bom, v.format)
+		if err != nil {
+			return err
+		}
+		fmt.Println(desc.Digest)
+	}
+
+	return nil
+}
+
+var sbomCommand = cli.Command{
+	Name:      "sbom",
+	Usage:     "Generate a software bill of materials of the packages installed in an image",
+	ArgsUsage: "SRC",
+	Action:    sbomAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "type",
+			Usage: fmt.Sprintf(
+				`Type of the source. If unset, oci-image-tool will try to auto-detect the type. One of "%s".`,
+				strings.Join(sbomTypes, ","),
+			),
+		},
+		cli.StringSliceFlag{
+			Name:  "ref",
+			Usage: "A set of ref specify the search criteria for the image, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Specify the os and architecture of the manifest, format is OS:Architecture. Only applicable if reftype is index.",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: image.SBOMFormatSPDX,
+			Usage: fmt.Sprintf(`Format of the SBOM. One of "%s".`, strings.Join(sbomFormats, ",")),
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Write the SBOM to this file instead of the standard output.",
+		},
+		cli.BoolFlag{
+			Name:  "attach",
+			Usage: "Attach the SBOM to the image as a referrer artifact and print its digest. Only applicable to image layout directories.",
+		},
+	},
+}
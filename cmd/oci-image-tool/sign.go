@@ -0,0 +1,95 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+type signCmd struct {
+	typ  string // the type of the source, can be empty string
+	refs []string
+	key  string
+}
+
+func signAction(context *cli.Context) error {
+	if len(context.Args()) != 1 {
+		return fmt.Errorf("src must be provided")
+	}
+
+	v := signCmd{
+		typ:  context.String("type"),
+		refs: context.StringSlice("ref"),
+		key:  context.String("key"),
+	}
+
+	if len(v.refs) == 0 {
+		return fmt.Errorf("ref must be provided")
+	}
+	if v.key == "" {
+		return fmt.Errorf("key must be provided")
+	}
+
+	src := context.Args()[0]
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(src)
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", src, err)
+		}
+		v.typ = typ
+	}
+
+	if v.typ != image.TypeImageLayout {
+		return fmt.Errorf("cannot sign %q: only image layout directories can be signed, see oci-image-tool convert", v.typ)
+	}
+
+	key, err := image.LoadPrivateKey(v.key)
+	if err != nil {
+		return err
+	}
+
+	desc, err := image.SignLayoutContext(appContext, src, v.refs, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(desc.Digest)
+	return nil
+}
+
+var signCommand = cli.Command{
+	Name:      "sign",
+	Usage:     "Sign an image with a local key",
+	ArgsUsage: "SRC",
+	Action:    signAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: fmt.Sprintf(`Type of the source. If unset, oci-image-tool will try to auto-detect the type. Must be "%s".`, image.TypeImageLayout),
+		},
+		cli.StringSliceFlag{
+			Name:  "ref",
+			Usage: "A set of ref specify the search criteria for the manifest or index to sign, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
+		},
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "PEM file of the ed25519 or ECDSA private key, in PKCS #8 or SEC 1 form.",
+		},
+	},
+}
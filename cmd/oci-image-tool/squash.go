@@ -0,0 +1,87 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+type squashCmd struct {
+	typ      string // the type of the source, can be empty string
+	refs     []string
+	platform string
+}
+
+func squashAction(context *cli.Context) error {
+	if len(context.Args()) != 2 {
+		return fmt.Errorf("both src and newref must be provided")
+	}
+
+	v := squashCmd{
+		typ:      context.String("type"),
+		refs:     context.StringSlice("ref"),
+		platform: context.String("platform"),
+	}
+
+	if len(v.refs) == 0 {
+		return fmt.Errorf("ref must be provided")
+	}
+
+	src, newRef := context.Args()[0], context.Args()[1]
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(src)
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", src, err)
+		}
+		v.typ = typ
+	}
+
+	if v.typ != image.TypeImageLayout {
+		return fmt.Errorf("cannot squash %q: only image layout directories can be squashed, see oci-image-tool convert", v.typ)
+	}
+
+	desc, err := image.SquashLayoutContext(appContext, src, v.platform, v.refs, newRef)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(desc.Digest)
+	return nil
+}
+
+var squashCommand = cli.Command{
+	Name:      "squash",
+	Usage:     "Squash the layers of an image into a single layer",
+	ArgsUsage: "SRC NEWREF",
+	Action:    squashAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: fmt.Sprintf(`Type of the source. If unset, oci-image-tool will try to auto-detect the type. Must be "%s".`, image.TypeImageLayout),
+		},
+		cli.StringSliceFlag{
+			Name:  "ref",
+			Usage: "A set of ref specify the search criteria for the image to squash, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Specify the os and architecture of the manifest, format is OS:Architecture. Only applicable if reftype is index.",
+		},
+	},
+}
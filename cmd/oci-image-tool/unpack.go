@@ -29,10 +29,18 @@ var unpackTypes = []string{
 	image.TypeImageZip,
 }
 
+// supported unpack layouts
+const (
+	layoutRootfs  = "rootfs"
+	layoutOverlay = "overlay"
+)
+
 type unpackCmd struct {
 	typ      string // the type to unpack, can be empty string
 	refs     []string
 	platform string
+	layout   string
+	rootless bool
 }
 
 func unpackAction(context *cli.Context) error {
@@ -44,12 +52,18 @@ func unpackAction(context *cli.Context) error {
 		typ:      context.String("type"),
 		refs:     context.StringSlice("ref"),
 		platform: context.String("platform"),
+		layout:   context.String("layout"),
+		rootless: context.Bool("rootless"),
 	}
 
 	if len(v.refs) == 0 {
 		return fmt.Errorf("ref must be provided")
 	}
 
+	if err := requireSignature(context); err != nil {
+		return err
+	}
+
 	for index, ref := range v.refs {
 		for i := index + 1; i < len(v.refs); i++ {
 			if ref == v.refs[i] {
@@ -66,16 +80,25 @@ func unpackAction(context *cli.Context) error {
 		v.typ = typ
 	}
 
+	switch v.layout {
+	case layoutRootfs:
+		// unpacked below
+	case layoutOverlay:
+		return unpackOverlay(context, v)
+	default:
+		return fmt.Errorf("unknown layout %q", v.layout)
+	}
+
 	var err error
 	switch v.typ {
 	case image.TypeImageLayout:
-		err = image.UnpackLayout(context.Args()[0], context.Args()[1], v.platform, v.refs)
+		err = image.UnpackLayoutContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs)
 
 	case image.TypeImageZip:
-		err = image.UnpackZip(context.Args()[0], context.Args()[1], v.platform, v.refs)
+		err = image.UnpackZipContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs)
 
 	case image.TypeImage:
-		err = image.UnpackFile(context.Args()[0], context.Args()[1], v.platform, v.refs)
+		err = image.UnpackFileContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs)
 
 	default:
 		err = fmt.Errorf("cannot unpack %q", v.typ)
@@ -84,6 +107,36 @@ func unpackAction(context *cli.Context) error {
 	return err
 }
 
+// unpackOverlay unpacks every layer to its own directory and prints the
+// lowerdir= mount option stacking them.
+func unpackOverlay(context *cli.Context, v unpackCmd) error {
+	opts := &image.OverlayOptions{Rootless: v.rootless}
+
+	var (
+		lowerdir string
+		err      error
+	)
+	switch v.typ {
+	case image.TypeImageLayout:
+		lowerdir, err = image.UnpackOverlayLayoutContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs, opts)
+
+	case image.TypeImageZip:
+		lowerdir, err = image.UnpackOverlayZipContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs, opts)
+
+	case image.TypeImage:
+		lowerdir, err = image.UnpackOverlayFileContext(appContext, context.Args()[0], context.Args()[1], v.platform, v.refs, opts)
+
+	default:
+		err = fmt.Errorf("cannot unpack %q", v.typ)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(lowerdir)
+	return nil
+}
+
 var unpackCommand = cli.Command{
 	Name:   "unpack",
 	Usage:  "Unpack an image or image source layout",
@@ -98,11 +151,21 @@ var unpackCommand = cli.Command{
 		},
 		cli.StringSliceFlag{
 			Name:  "ref",
-			Usage: "A set of ref specify the search criteria for the validated reference, format is A=B. Only support 'name', 'platform.os' and 'digest' three cases.",
+			Usage: "A set of ref specify the search criteria for the validated reference, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
 		},
 		cli.StringFlag{
 			Name:  "platform",
 			Usage: "Specify the os and architecture of the manifest, format is OS:Architecture. Only applicable if reftype is index.",
 		},
+		cli.StringFlag{
+			Name:  "layout",
+			Value: layoutRootfs,
+			Usage: fmt.Sprintf(`Layout of dest: "%s" merges the layers into one tree, "%s" extracts every layer to its own overlayfs lower directory layers/<diff_id> and prints the lowerdir= mount option.`, layoutRootfs, layoutOverlay),
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "Mark opaque directories with the user.overlay.opaque xattr, for overlayfs mounted with userxattr. Only applicable to the overlay layout.",
+		},
+		verifyKeyFlag,
 	},
 }
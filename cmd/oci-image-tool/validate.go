@@ -106,11 +106,11 @@ func validatePath(name string) error {
 		fmt.Println("autodetected image file type is:", imageType)
 		switch imageType {
 		case image.TypeImageLayout:
-			return image.ValidateLayout(name, v.refs, v.stdout)
+			return image.ValidateLayoutContext(appContext, name, v.refs, v.stdout)
 		case image.TypeImageZip:
-			return image.ValidateZip(name, v.refs, v.stdout)
+			return image.ValidateZipContext(appContext, name, v.refs, v.stdout)
 		case image.TypeImage:
-			return image.ValidateFile(name, v.refs, v.stdout)
+			return image.ValidateFileContext(appContext, name, v.refs, v.stdout)
 		}
 	}
 
@@ -149,7 +149,7 @@ var validateCommand = cli.Command{
 		},
 		cli.StringSliceFlag{
 			Name:  "ref",
-			Usage: "A set of ref specify the search criteria for the validated reference. Format is A=B. Only support 'name', 'platform.os' and 'digest' three cases. Only applicable if type is image",
+			Usage: "A set of ref specify the search criteria for the validated reference. Format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'. Only applicable if type is image",
 		},
 	},
 }
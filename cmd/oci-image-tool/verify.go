@@ -0,0 +1,147 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/image-tools/image"
+	"github.com/urfave/cli"
+)
+
+// supported verify types
+var verifyTypes = []string{
+	image.TypeImageLayout,
+	image.TypeImage,
+	image.TypeImageZip,
+}
+
+type verifyCmd struct {
+	typ  string // the type of the source, can be empty string
+	refs []string
+	keys []crypto.PublicKey
+}
+
+func verifyAction(context *cli.Context) error {
+	if len(context.Args()) != 1 {
+		return fmt.Errorf("src must be provided")
+	}
+
+	v := verifyCmd{
+		typ:  context.String("type"),
+		refs: context.StringSlice("ref"),
+	}
+
+	if len(v.refs) == 0 {
+		return fmt.Errorf("ref must be provided")
+	}
+
+	var err error
+	if v.keys, err = loadPublicKeys(context.StringSlice("key")); err != nil {
+		return err
+	}
+	if len(v.keys) == 0 {
+		return fmt.Errorf("key must be provided")
+	}
+
+	src := context.Args()[0]
+
+	if v.typ == "" {
+		typ, err := image.Autodetect(src)
+		if err != nil {
+			return fmt.Errorf("%q: autodetection failed: %v", src, err)
+		}
+		v.typ = typ
+	}
+
+	var verified *image.VerifiedSignature
+	switch v.typ {
+	case image.TypeImageLayout:
+		verified, err = image.VerifyLayoutContext(appContext, src, v.refs, v.keys)
+
+	case image.TypeImageZip:
+		verified, err = image.VerifyZipContext(appContext, src, v.refs, v.keys)
+
+	case image.TypeImage:
+		verified, err = image.VerifyFileContext(appContext, src, v.refs, v.keys)
+
+	default:
+		err = fmt.Errorf("cannot verify %q", v.typ)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: signed by %s in %s\n", verified.Subject.Digest, verified.KeyID, verified.Signature.Digest)
+	return nil
+}
+
+// loadPublicKeys reads the public keys of the PEM files paths.
+func loadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, path := range paths {
+		key, err := image.LoadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// requireSignature makes the commands reading images only accept those
+// signed by one of the keys of the --verify-key flags, if any.
+func requireSignature(context *cli.Context) error {
+	keys, err := loadPublicKeys(context.StringSlice("verify-key"))
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	appContext = image.WithVerifyKeys(appContext, keys...)
+	return nil
+}
+
+// verifyKeyFlag is the --verify-key flag of the commands reading images.
+var verifyKeyFlag = cli.StringSliceFlag{
+	Name:  "verify-key",
+	Usage: "PEM file of an ed25519 or ECDSA public key. If set, the image selected by the refs must have a valid signature by one of the keys, see oci-image-tool sign.",
+}
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "Verify the signature of an image with local keys",
+	ArgsUsage: "SRC",
+	Action:    verifyAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name: "type",
+			Usage: fmt.Sprintf(
+				`Type of the source. If unset, oci-image-tool will try to auto-detect the type. One of "%s".`,
+				strings.Join(verifyTypes, ","),
+			),
+		},
+		cli.StringSliceFlag{
+			Name:  "ref",
+			Usage: "A set of ref specify the search criteria for the manifest or index to verify, format is A=B. Supported criteria are 'name' (glob pattern), 'digest' (digest or prefix), 'mediaType', 'platform.os', 'platform.architecture', 'platform.variant' and 'annotation.<key>'.",
+		},
+		cli.StringSliceFlag{
+			Name:  "key",
+			Usage: "PEM file of an ed25519 or ECDSA public key, in PKIX form. May be repeated, a valid signature by any of the keys is enough.",
+		},
+	},
+}
@@ -0,0 +1,316 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// Volume strategies of BundleOptions, selecting how the volumes of the
+// image config are provided to the container.
+const (
+	// VolumeBundle bind mounts a directory of the bundle, holding a copy of
+	// the image content at the volume path, on every volume.
+	VolumeBundle = "bundle"
+
+	// VolumeTmpfs mounts an empty tmpfs on every volume.
+	VolumeTmpfs = "tmpfs"
+
+	// VolumeHost bind mounts the host paths of BundleOptions.Volumes on the
+	// volumes. Every volume of the image config must be mapped.
+	VolumeHost = "host"
+)
+
+// bundleVolumesDir is the directory of the bundle holding the volumes
+// created by VolumeBundle.
+const bundleVolumesDir = "volumes"
+
+// BundleOptions holds the optional settings of
+// CreateRuntimeBundleWithOptions and its variants. A nil *BundleOptions
+// selects the defaults.
+//
+// The runtime configuration of the bundle starts from Template, or from the
+// defaults of `runc spec` if nil. The image config is applied on top of it,
+// then the volumes, and finally the overrides of Env, Args, Cwd, Hostname,
+// ReadonlyRootfs and Annotations.
+type BundleOptions struct {
+	// Template is the runtime configuration the image config is merged
+	// into. Its root path is replaced by the rootfs directory.
+	Template *specs.Spec
+
+	// Env holds environment variables of the form NAME=value, replacing
+	// the variables of the same name.
+	Env []string
+
+	// Args replaces the process arguments if not empty.
+	Args []string
+
+	// Cwd replaces the working directory if not empty.
+	Cwd string
+
+	// Hostname replaces the hostname if not empty.
+	Hostname string
+
+	// ReadonlyRootfs sets whether the root filesystem is read-only if not
+	// nil.
+	ReadonlyRootfs *bool
+
+	// Annotations are added to the annotations of the runtime
+	// configuration, replacing the existing values.
+	Annotations map[string]string
+
+	// VolumeStrategy is one of VolumeBundle, VolumeTmpfs or VolumeHost.
+	// It defaults to VolumeBundle.
+	VolumeStrategy string
+
+	// Volumes maps volume destinations to absolute host paths. Mapped
+	// volumes are bind mounted from the host whatever the strategy, and
+	// may also add volumes not declared by the image config.
+	Volumes map[string]string
+}
+
+// applyOverrides applies the overrides of opts to s.
+func applyOverrides(s *specs.Spec, opts *BundleOptions) error {
+	if opts == nil {
+		return nil
+	}
+
+	for _, e := range opts.Env {
+		if strings.SplitN(e, "=", 2)[0] == "" {
+			return fmt.Errorf("env %q: empty variable name", e)
+		}
+	}
+	s.Process.Env = mergeEnv(s.Process.Env, opts.Env)
+
+	if len(opts.Args) > 0 {
+		s.Process.Args = append([]string{}, opts.Args...)
+	}
+
+	if opts.Cwd != "" {
+		// Windows paths are checked by the runtime
+		if s.Windows == nil && !path.IsAbs(opts.Cwd) {
+			return fmt.Errorf("cwd %q is not absolute", opts.Cwd)
+		}
+		s.Process.Cwd = opts.Cwd
+	}
+
+	if opts.Hostname != "" {
+		s.Hostname = opts.Hostname
+	}
+
+	if opts.ReadonlyRootfs != nil {
+		if s.Root == nil {
+			return errors.New("readonly rootfs: the runtime configuration has no root")
+		}
+		s.Root.Readonly = *opts.ReadonlyRootfs
+	}
+
+	if len(opts.Annotations) > 0 && s.Annotations == nil {
+		s.Annotations = map[string]string{}
+	}
+	for key, value := range opts.Annotations {
+		s.Annotations[key] = value
+	}
+
+	return nil
+}
+
+// volumeMounts returns the mounts providing the volumes of the image config
+// c to a container whose root filesystem is unpacked to the rootfs
+// directory of bundle. The directories of VolumeBundle are created as
+// needed.
+func volumeMounts(ctx context.Context, c *v1.Image, bundle, rootfs string, opts *BundleOptions) ([]specs.Mount, error) {
+	strategy := VolumeBundle
+	var hostPaths map[string]string
+	if opts != nil {
+		if opts.VolumeStrategy != "" {
+			strategy = opts.VolumeStrategy
+		}
+		hostPaths = opts.Volumes
+	}
+
+	switch strategy {
+	case VolumeBundle, VolumeTmpfs, VolumeHost:
+	default:
+		return nil, fmt.Errorf("volume strategy %q unimplemented", strategy)
+	}
+
+	if c.OS == "windows" {
+		return windowsVolumeMounts(c, hostPaths)
+	}
+
+	volumes := map[string]string{}
+	for vol := range c.Config.Volumes {
+		volumes[path.Clean("/"+vol)] = ""
+	}
+	for vol, hostPath := range hostPaths {
+		if !filepath.IsAbs(hostPath) {
+			return nil, fmt.Errorf("volume %s: host path %q is not absolute", vol, hostPath)
+		}
+		volumes[path.Clean("/"+vol)] = hostPath
+	}
+
+	var dests []string
+	for vol := range volumes {
+		dests = append(dests, vol)
+	}
+	// parents sort before their children and are mounted first
+	sort.Strings(dests)
+
+	var mounts []specs.Mount
+	var populated []string
+	for _, vol := range dests {
+		if vol == "/" {
+			return nil, errors.New("volume /: cannot mount over the root filesystem")
+		}
+
+		source := volumes[vol]
+		switch {
+		case source != "":
+		case strategy == VolumeHost:
+			return nil, fmt.Errorf("volume %s: no host path given", vol)
+		case strategy == VolumeTmpfs:
+			mounts = append(mounts, specs.Mount{
+				Destination: vol,
+				Type:        "tmpfs",
+				Source:      "tmpfs",
+				Options:     []string{"nosuid", "nodev", "mode=755"},
+			})
+			continue
+		default:
+			source = path.Join(bundleVolumesDir, vol)
+			dir := filepath.Join(bundle, filepath.FromSlash(source))
+
+			// the copy of a parent volume already holds the content
+			nested := false
+			for _, parent := range populated {
+				if strings.HasPrefix(vol, parent+"/") {
+					nested = true
+					break
+				}
+			}
+
+			if nested {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					return nil, errors.Wrapf(err, "volume %s", vol)
+				}
+			} else if err := populateVolume(ctx, filepath.Join(bundle, rootfs), vol, dir); err != nil {
+				return nil, errors.Wrapf(err, "volume %s", vol)
+			}
+			populated = append(populated, vol)
+		}
+
+		mounts = append(mounts, specs.Mount{
+			Destination: vol,
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"rbind"},
+		})
+	}
+
+	return mounts, nil
+}
+
+// populateVolume creates the directory dir with a copy of the content of
+// the path vol of the root filesystem at rootfs, if any. The copy keeps the
+// modes, owners and groups of the original files.
+func populateVolume(ctx context.Context, rootfs, vol, dir string) error {
+	src, err := rootfsPath(rootfs, vol)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	switch {
+	case os.IsNotExist(err):
+		return os.MkdirAll(dir, 0755)
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("%s is not a directory in the image", vol)
+	}
+
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyRegularFile(p, target, mode.Perm()); err != nil {
+				return err
+			}
+		default:
+			debugf(ctx, "%s: skipping special file", p)
+			return nil
+		}
+
+		return copyOwner(target, info)
+	})
+}
+
+// copyRegularFile copies the content of the regular file src to the new
+// file dst.
+func copyRegularFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src) // nolint: errcheck, gosec
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,224 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestVolumeMounts(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	data := filepath.Join(bundle, "rootfs", "var", "data")
+	if err := os.MkdirAll(filepath.Join(data, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(data, "sub", "file"), []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/file", filepath.Join(data, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := v1.Image{Config: v1.ImageConfig{Volumes: map[string]struct{}{
+		"/var/data":  {},
+		"/var/cache": {},
+	}}}
+
+	mounts, err := volumeMounts(context.Background(), &c, bundle, "rootfs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []specs.Mount{
+		{Destination: "/var/cache", Type: "bind", Source: "volumes/var/cache", Options: []string{"rbind"}},
+		{Destination: "/var/data", Type: "bind", Source: "volumes/var/data", Options: []string{"rbind"}},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %v, got %v", expected, mounts)
+	}
+
+	// the image content is copied to the volume directory
+	buf, err := ioutil.ReadFile(filepath.Join(bundle, "volumes", "var", "data", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "content" {
+		t.Errorf("unexpected volume content %q", buf)
+	}
+	info, err := os.Stat(filepath.Join(bundle, "volumes", "var", "data", "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expected mode 0700, got %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "volumes", "var", "cache")); err != nil {
+		t.Error(err)
+	}
+
+	mounts, err = volumeMounts(context.Background(), &c, bundle, "rootfs", &BundleOptions{
+		VolumeStrategy: VolumeTmpfs,
+		Volumes:        map[string]string{"/var/data": "/srv/data", "/extra/": "/srv/extra"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []specs.Mount{
+		{Destination: "/extra", Type: "bind", Source: "/srv/extra", Options: []string{"rbind"}},
+		{Destination: "/var/cache", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "nodev", "mode=755"}},
+		{Destination: "/var/data", Type: "bind", Source: "/srv/data", Options: []string{"rbind"}},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected %v, got %v", expected, mounts)
+	}
+
+	for _, opts := range []*BundleOptions{
+		{VolumeStrategy: VolumeHost, Volumes: map[string]string{"/var/data": "/srv/data"}},
+		{Volumes: map[string]string{"/var/data": "relative"}},
+		{VolumeStrategy: "overlay"},
+	} {
+		if _, err := volumeMounts(context.Background(), &c, bundle, "rootfs", opts); err == nil {
+			t.Errorf("%+v: expected an error", opts)
+		}
+	}
+}
+
+func TestNestedVolumeMounts(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	data := filepath.Join(bundle, "rootfs", "data")
+	if err := os.MkdirAll(filepath.Join(data, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(data, "sub", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := v1.Image{Config: v1.ImageConfig{Volumes: map[string]struct{}{
+		"/data":       {},
+		"/data/sub":   {},
+		"/data/empty": {},
+	}}}
+
+	mounts, err := volumeMounts(context.Background(), &c, bundle, "rootfs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 {
+		t.Errorf("expected 3 mounts, got %v", mounts)
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(bundle, "volumes", "data", "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "content" {
+		t.Errorf("unexpected volume content %q", buf)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "volumes", "data", "empty")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	var c v1.Image
+	if err := json.Unmarshal([]byte(configStr), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	template := &specs.Spec{
+		Root: &specs.Root{Path: "elsewhere", Readonly: true},
+		Process: &specs.Process{
+			Args: []string{"/bin/template"},
+			Env:  []string{"FOO=template", "TEMPLATE=1"},
+			Cwd:  "/template",
+		},
+		Hostname:    "template",
+		Hooks:       &specs.Hooks{Prestart: []specs.Hook{{Path: "/usr/bin/hook"}}},
+		Annotations: map[string]string{"org.opencontainers.image.os": "template", "template": "1"},
+	}
+
+	s, err := runtimeSpec(&c, bundle, "rootfs", template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readonly := false
+	if err := applyOverrides(s, &BundleOptions{
+		Env:            []string{"BAR=cli"},
+		Args:           []string{"/bin/cli", "--flag"},
+		Hostname:       "cli",
+		ReadonlyRootfs: &readonly,
+		Annotations:    map[string]string{"template": "cli"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the template is not modified
+	if template.Root.Path != "elsewhere" || len(template.Process.Env) != 2 {
+		t.Errorf("template modified: %+v", template)
+	}
+
+	for _, tc := range []struct {
+		field    string
+		got      interface{}
+		expected interface{}
+	}{
+		{"root", *s.Root, specs.Root{Path: "rootfs", Readonly: false}},
+		{"args", s.Process.Args, []string{"/bin/cli", "--flag"}},
+		{"env", s.Process.Env, []string{"FOO=oci_is_a", "TEMPLATE=1", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "BAR=cli", "HOME=/"}},
+		{"cwd", s.Process.Cwd, "/home/alice"},
+		{"hostname", s.Hostname, "cli"},
+		{"hooks", s.Hooks, template.Hooks},
+		{"os annotation", s.Annotations["org.opencontainers.image.os"], "linux"},
+		{"template annotation", s.Annotations["template"], "cli"},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.field, tc.expected, tc.got)
+		}
+	}
+
+	for _, opts := range []*BundleOptions{
+		{Cwd: "relative"},
+		{Env: []string{"=value"}},
+	} {
+		if err := applyOverrides(s, opts); err == nil {
+			t.Errorf("%+v: expected an error", opts)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestVolumeOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+
+	bundle, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	data := filepath.Join(bundle, "rootfs", "var", "data")
+	if err := os.MkdirAll(filepath.Join(data, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(data, "sub", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/file", filepath.Join(data, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"", "sub", "sub/file", "link"} {
+		if err := os.Lchown(filepath.Join(data, name), 1000+i, 2000+i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := v1.Image{Config: v1.ImageConfig{Volumes: map[string]struct{}{"/var/data": {}}}}
+	if _, err := volumeMounts(context.Background(), &c, bundle, "rootfs", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"", "sub", "sub/file", "link"} {
+		info, err := os.Lstat(filepath.Join(bundle, "volumes", "var", "data", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if int(st.Uid) != 1000+i || int(st.Gid) != 2000+i {
+			t.Errorf("%q: expected owner %d:%d, got %d:%d", name, 1000+i, 2000+i, st.Uid, st.Gid)
+		}
+	}
+}
@@ -16,13 +16,15 @@ package image
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/opencontainers/image-spec/schema"
 	"github.com/opencontainers/image-spec/specs-go/v1"
@@ -30,11 +32,11 @@ import (
 	"github.com/pkg/errors"
 )
 
-func findConfig(w walker, d *v1.Descriptor) (*v1.Image, error) {
+func findConfig(ctx context.Context, w walker, d *v1.Descriptor) (*v1.Image, error) {
 	var c v1.Image
 	cpath := filepath.Join("blobs", string(d.Digest.Algorithm()), d.Digest.Hex())
 
-	switch err := w.find(cpath, func(path string, r io.Reader) error {
+	switch err := w.find(ctx, cpath, func(path string, r io.Reader) error {
 		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			return errors.Wrapf(err, "%s: error reading config", path)
@@ -49,7 +51,7 @@ func findConfig(w walker, d *v1.Descriptor) (*v1.Image, error) {
 		}
 
 		return errEOW
-	}); err {
+	}); errors.Cause(err) {
 	case nil:
 		return nil, fmt.Errorf("%s: config not found", cpath)
 	case errEOW:
@@ -59,62 +61,314 @@ func findConfig(w walker, d *v1.Descriptor) (*v1.Image, error) {
 	}
 }
 
-func runtimeSpec(c *v1.Image, rootfs string) (*specs.Spec, error) {
-	if c.OS != "linux" {
-		return nil, fmt.Errorf("%s: unsupported OS", c.OS)
+// defaultRuntimeSpec returns the default Linux runtime configuration, the
+// same as the one generated by `runc spec`, with rootfs as its root.
+func defaultRuntimeSpec(rootfs string) *specs.Spec {
+	// every set gets its own copy, so that changing one leaves the others
+	capabilities := func() []string {
+		return []string{
+			"CAP_AUDIT_WRITE",
+			"CAP_KILL",
+			"CAP_NET_BIND_SERVICE",
+		}
+	}
+
+	return &specs.Spec{
+		Version: specs.Version,
+		Root: &specs.Root{
+			Path:     rootfs,
+			Readonly: true,
+		},
+		Process: &specs.Process{
+			Terminal: true,
+			User:     specs.User{},
+			Args: []string{
+				"sh",
+			},
+			Env: []string{
+				"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+				"TERM=xterm",
+			},
+			Cwd:             "/",
+			NoNewPrivileges: true,
+			// no inheritable or ambient capabilities, as for runc since
+			// CVE-2022-29162
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  capabilities(),
+				Effective: capabilities(),
+				Permitted: capabilities(),
+			},
+			Rlimits: []specs.POSIXRlimit{
+				{
+					Type: "RLIMIT_NOFILE",
+					Hard: uint64(1024),
+					Soft: uint64(1024),
+				},
+			},
+		},
+		Hostname: "runc",
+		Mounts: []specs.Mount{
+			{
+				Destination: "/proc",
+				Type:        "proc",
+				Source:      "proc",
+			},
+			{
+				Destination: "/dev",
+				Type:        "tmpfs",
+				Source:      "tmpfs",
+				Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
+			},
+			{
+				Destination: "/dev/pts",
+				Type:        "devpts",
+				Source:      "devpts",
+				Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"},
+			},
+			{
+				Destination: "/dev/shm",
+				Type:        "tmpfs",
+				Source:      "shm",
+				Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"},
+			},
+			{
+				Destination: "/dev/mqueue",
+				Type:        "mqueue",
+				Source:      "mqueue",
+				Options:     []string{"nosuid", "noexec", "nodev"},
+			},
+			{
+				Destination: "/sys",
+				Type:        "sysfs",
+				Source:      "sysfs",
+				Options:     []string{"nosuid", "noexec", "nodev", "ro"},
+			},
+			{
+				Destination: "/sys/fs/cgroup",
+				Type:        "cgroup",
+				Source:      "cgroup",
+				Options:     []string{"nosuid", "noexec", "nodev", "relatime", "ro"},
+			},
+		},
+		Linux: &specs.Linux{
+			MaskedPaths: []string{
+				"/proc/acpi",
+				"/proc/asound",
+				"/proc/kcore",
+				"/proc/keys",
+				"/proc/latency_stats",
+				"/proc/timer_list",
+				"/proc/timer_stats",
+				"/proc/sched_debug",
+				"/sys/firmware",
+				"/sys/devices/virtual/powercap",
+				"/proc/scsi",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus",
+				"/proc/fs",
+				"/proc/irq",
+				"/proc/sys",
+				"/proc/sysrq-trigger",
+			},
+			Resources: &specs.LinuxResources{
+				Devices: []specs.LinuxDeviceCgroup{
+					{
+						Allow:  false,
+						Access: "rwm",
+					},
+				},
+			},
+			Namespaces: []specs.LinuxNamespace{
+				{
+					Type: specs.PIDNamespace,
+				},
+				{
+					Type: specs.NetworkNamespace,
+				},
+				{
+					Type: specs.IPCNamespace,
+				},
+				{
+					Type: specs.UTSNamespace,
+				},
+				{
+					Type: specs.MountNamespace,
+				},
+			},
+		},
 	}
+}
 
-	var s specs.Spec
-	s.Version = specs.Version
-	// we should at least apply the default spec, otherwise this is totally useless
-	s.Root = &specs.Root{}
-	s.Root.Path = rootfs
+// mergeEnv returns env with the variables of overrides added, replacing
+// the variables of env with the same name.
+func mergeEnv(env, overrides []string) []string {
+	merged := append([]string{}, env...)
 
-	s.Process = &specs.Process{}
-	s.Process.Terminal = true
-	s.Process.Cwd = "/"
-	if c.Config.WorkingDir != "" {
-		s.Process.Cwd = c.Config.WorkingDir
+overrides:
+	for _, o := range overrides {
+		name := strings.SplitN(o, "=", 2)[0]
+		for i, e := range merged {
+			if strings.SplitN(e, "=", 2)[0] == name {
+				merged[i] = o
+				continue overrides
+			}
+		}
+		merged = append(merged, o)
+	}
+
+	return merged
+}
+
+// Annotations of the runtime configuration defined by the image-spec
+// conversion document, carrying image config fields without a runtime-spec
+// equivalent.
+const (
+	annotationOS           = "org.opencontainers.image.os"
+	annotationArchitecture = "org.opencontainers.image.architecture"
+	annotationVariant      = "org.opencontainers.image.variant"
+	annotationOSVersion    = "org.opencontainers.image.os.version"
+	annotationOSFeatures   = "org.opencontainers.image.os.features"
+	annotationAuthor       = "org.opencontainers.image.author"
+	annotationCreated      = "org.opencontainers.image.created"
+	annotationStopSignal   = "org.opencontainers.image.stopSignal"
+	annotationExposedPorts = "org.opencontainers.image.exposedPorts"
+)
+
+// runtimeAnnotations returns the annotations of the runtime configuration
+// for the image config c. The labels of c are included as is and are never
+// overwritten by the annotations derived from the other fields.
+func runtimeAnnotations(c *v1.Image) map[string]string {
+	annotations := map[string]string{}
+
+	set := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if _, ok := c.Config.Labels[key]; ok {
+			return
+		}
+		annotations[key] = value
 	}
-	s.Process.Env = append(s.Process.Env, c.Config.Env...)
-	s.Process.Args = append(s.Process.Args, c.Config.Entrypoint...)
-	s.Process.Args = append(s.Process.Args, c.Config.Cmd...)
 
-	if len(s.Process.Args) == 0 {
-		s.Process.Args = append(s.Process.Args, "sh")
+	set(annotationOS, c.OS)
+	set(annotationArchitecture, c.Architecture)
+	set(annotationVariant, c.Variant)
+	set(annotationOSVersion, c.OSVersion)
+	set(annotationOSFeatures, strings.Join(c.OSFeatures, ","))
+	set(annotationAuthor, c.Author)
+	if c.Created != nil {
+		set(annotationCreated, c.Created.Format(time.RFC3339Nano))
 	}
+	set(annotationStopSignal, c.Config.StopSignal)
 
-	if uid, err := strconv.Atoi(c.Config.User); err == nil {
-		s.Process.User.UID = uint32(uid)
-	} else if ug := strings.Split(c.Config.User, ":"); len(ug) == 2 {
-		uid, err := strconv.Atoi(ug[0])
-		if err != nil {
-			return nil, errors.New("config.User: unsupported uid format")
+	var ports []string
+	for port := range c.Config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	set(annotationExposedPorts, strings.Join(ports, ","))
+
+	for key, value := range c.Config.Labels {
+		annotations[key] = value
+	}
+
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
+
+// hasEnv reports whether env sets the variable name.
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if strings.SplitN(e, "=", 2)[0] == name {
+			return true
 		}
+	}
 
-		gid, err := strconv.Atoi(ug[1])
-		if err != nil {
-			return nil, errors.New("config.User: unsupported gid format")
+	return false
+}
+
+// copySpec returns a deep copy of s.
+func copySpec(s *specs.Spec) (*specs.Spec, error) {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var c specs.Spec
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// runtimeSpec returns the runtime configuration for the image config c: the
+// default configuration of defaultRuntimeSpec, or a copy of template if not
+// nil, with the execution parameters of the image applied on top. Named
+// users and groups are resolved against the root filesystem already
+// unpacked to the rootfs directory of bundle. Windows images are handled by
+// windowsRuntimeSpec.
+func runtimeSpec(c *v1.Image, bundle, rootfs string, template *specs.Spec) (*specs.Spec, error) {
+	switch c.OS {
+	case "linux":
+	case "windows":
+		return windowsRuntimeSpec(c, bundle, template)
+	default:
+		return nil, fmt.Errorf("%s: unsupported OS", c.OS)
+	}
+
+	s := defaultRuntimeSpec(rootfs)
+	if template != nil {
+		var err error
+		if s, err = copySpec(template); err != nil {
+			return nil, errors.Wrap(err, "unable to copy spec template")
 		}
 
-		s.Process.User.UID = uint32(uid)
-		s.Process.User.GID = uint32(gid)
-	} else if c.Config.User != "" {
-		return nil, errors.New("config.User: unsupported format")
+		if s.Version == "" {
+			s.Version = specs.Version
+		}
+		if s.Root == nil {
+			s.Root = &specs.Root{}
+		}
+		s.Root.Path = rootfs
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		if s.Process.Cwd == "" {
+			s.Process.Cwd = "/"
+		}
 	}
 
-	s.Linux = &specs.Linux{}
+	annotations := runtimeAnnotations(c)
+	if len(annotations) > 0 && s.Annotations == nil {
+		s.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		s.Annotations[key] = value
+	}
 
-	for vol := range c.Config.Volumes {
-		s.Mounts = append(
-			s.Mounts,
-			specs.Mount{
-				Destination: vol,
-				Type:        "bind",
-				Options:     []string{"rbind"},
-			},
-		)
+	if c.Config.WorkingDir != "" {
+		s.Process.Cwd = c.Config.WorkingDir
+	}
+	s.Process.Env = mergeEnv(s.Process.Env, c.Config.Env)
+
+	if len(c.Config.Entrypoint) > 0 || len(c.Config.Cmd) > 0 {
+		s.Process.Args = nil
+		s.Process.Args = append(s.Process.Args, c.Config.Entrypoint...)
+		s.Process.Args = append(s.Process.Args, c.Config.Cmd...)
+	}
+
+	user, home, err := resolveUser(filepath.Join(bundle, rootfs), c.Config.User)
+	if err != nil {
+		return nil, err
+	}
+	s.Process.User = user
+	if !hasEnv(s.Process.Env, "HOME") {
+		s.Process.Env = append(s.Process.Env, "HOME="+home)
 	}
 
-	return &s, nil
+	return s, nil
 }
@@ -0,0 +1,343 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// validateRuntimeSpec validates s against the runtime-spec config schema
+// kept in testdata.
+func validateRuntimeSpec(t *testing.T, s *specs.Spec) {
+	schema, err := filepath.Abs(filepath.Join("testdata", "runtime-spec", "config-schema.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := gojsonschema.Validate(
+		gojsonschema.NewReferenceLoader("file://"+filepath.ToSlash(schema)),
+		gojsonschema.NewBytesLoader(buf),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Valid() {
+		var errs []string
+		for _, e := range result.Errors() {
+			errs = append(errs, e.String())
+		}
+		t.Fatalf("runtime config does not match the schema:\n%s", strings.Join(errs, "\n"))
+	}
+}
+
+func TestRuntimeSpec(t *testing.T) {
+	var c v1.Image
+	if err := json.Unmarshal([]byte(configStr), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	s, err := runtimeSpec(&c, bundle, "rootfs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validateRuntimeSpec(t, s)
+
+	if s.Process.Cwd != "/home/alice" {
+		t.Errorf("expected cwd /home/alice, got %q", s.Process.Cwd)
+	}
+
+	if strings.Join(s.Process.Args, " ") != "/bin/my-app-binary --foreground --config /etc/my-app.d/default.cfg" {
+		t.Errorf("unexpected args %v", s.Process.Args)
+	}
+
+	// image variables are added to the defaults, replacing them by name
+	env := strings.Join(s.Process.Env, " ")
+	if env != "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin TERM=xterm FOO=oci_is_a BAR=well_written_spec HOME=/" {
+		t.Errorf("unexpected env %v", s.Process.Env)
+	}
+
+	mounts := map[string]bool{}
+	for _, m := range s.Mounts {
+		mounts[m.Destination] = true
+	}
+	for _, dest := range []string{"/proc", "/dev", "/dev/pts", "/dev/shm", "/sys"} {
+		if !mounts[dest] {
+			t.Errorf("missing default mount %s", dest)
+		}
+	}
+
+	if s.Annotations["org.opencontainers.image.exposedPorts"] != "8080/tcp" || s.Annotations["com.example.project.git.commit"] != "45a939b2999782a3f005621a8d0f29aa387e1d6b" {
+		t.Errorf("unexpected annotations %v", s.Annotations)
+	}
+
+	if len(s.Linux.Namespaces) == 0 || s.Process.Capabilities == nil || len(s.Process.Rlimits) == 0 {
+		t.Error("missing default namespaces, capabilities or rlimits")
+	}
+
+	caps := s.Process.Capabilities
+	if len(caps.Bounding) != 3 || len(caps.Effective) != 3 || len(caps.Permitted) != 3 || len(caps.Inheritable) != 0 || len(caps.Ambient) != 0 {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+	caps.Bounding[0] = "CAP_SYS_ADMIN"
+	if caps.Effective[0] == "CAP_SYS_ADMIN" || caps.Permitted[0] == "CAP_SYS_ADMIN" {
+		t.Error("expected the capability sets not to share their content")
+	}
+
+	c.OS = "plan9"
+	if _, err := runtimeSpec(&c, bundle, "rootfs", nil); err == nil {
+		t.Error("expected an unsupported OS to fail")
+	}
+}
+
+func TestRuntimeAnnotations(t *testing.T) {
+	created := time.Date(2015, 10, 31, 22, 22, 56, 15925234, time.UTC)
+
+	for _, tc := range []struct {
+		name   string
+		config v1.Image
+		want   map[string]string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "os",
+			config: v1.Image{OS: "linux"},
+			want:   map[string]string{"org.opencontainers.image.os": "linux"},
+		},
+		{
+			name:   "architecture",
+			config: v1.Image{Architecture: "amd64"},
+			want:   map[string]string{"org.opencontainers.image.architecture": "amd64"},
+		},
+		{
+			name:   "variant",
+			config: v1.Image{Platform: v1.Platform{Architecture: "arm", Variant: "v7"}},
+			want: map[string]string{
+				"org.opencontainers.image.architecture": "arm",
+				"org.opencontainers.image.variant":      "v7",
+			},
+		},
+		{
+			name:   "os version and features",
+			config: v1.Image{Platform: v1.Platform{OS: "windows", OSVersion: "10.0.17763.1879", OSFeatures: []string{"win32k", "feature"}}},
+			want: map[string]string{
+				"org.opencontainers.image.os":          "windows",
+				"org.opencontainers.image.os.version":  "10.0.17763.1879",
+				"org.opencontainers.image.os.features": "win32k,feature",
+			},
+		},
+		{
+			name:   "author",
+			config: v1.Image{Author: "Alyssa P. Hacker <alyspdev@example.com>"},
+			want:   map[string]string{"org.opencontainers.image.author": "Alyssa P. Hacker <alyspdev@example.com>"},
+		},
+		{
+			name:   "created",
+			config: v1.Image{Created: &created},
+			want:   map[string]string{"org.opencontainers.image.created": "2015-10-31T22:22:56.015925234Z"},
+		},
+		{
+			name:   "stop signal",
+			config: v1.Image{Config: v1.ImageConfig{StopSignal: "SIGKILL"}},
+			want:   map[string]string{"org.opencontainers.image.stopSignal": "SIGKILL"},
+		},
+		{
+			name: "exposed ports",
+			config: v1.Image{Config: v1.ImageConfig{ExposedPorts: map[string]struct{}{
+				"8080/tcp": {},
+				"53/udp":   {},
+				"443":      {},
+			}}},
+			want: map[string]string{"org.opencontainers.image.exposedPorts": "443,53/udp,8080/tcp"},
+		},
+		{
+			name:   "labels",
+			config: v1.Image{Config: v1.ImageConfig{Labels: map[string]string{"com.example.key": "value"}}},
+			want:   map[string]string{"com.example.key": "value"},
+		},
+		{
+			name: "labels are not overwritten",
+			config: v1.Image{
+				OS:           "linux",
+				Architecture: "amd64",
+				Config: v1.ImageConfig{
+					StopSignal: "SIGKILL",
+					Labels: map[string]string{
+						"org.opencontainers.image.os":         "custom",
+						"org.opencontainers.image.stopSignal": "",
+					},
+				},
+			},
+			want: map[string]string{
+				"org.opencontainers.image.os":           "custom",
+				"org.opencontainers.image.stopSignal":   "",
+				"org.opencontainers.image.architecture": "amd64",
+			},
+		},
+	} {
+		got := runtimeAnnotations(&tc.config)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	merged := mergeEnv([]string{"PATH=/bin", "TERM=xterm"}, []string{"HOME=/root", "PATH=/usr/bin", "EMPTY"})
+	if strings.Join(merged, " ") != "PATH=/usr/bin TERM=xterm HOME=/root EMPTY" {
+		t.Errorf("unexpected env %v", merged)
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	for _, dir := range []string{"etc", "shared"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	passwd := "root:x:0:0:root:/root:/bin/sh\nalice:x:1000:1000::/home/alice:/bin/sh\n# comment\nbroken:x:nan:0::/:/bin/sh\n"
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the absolute symlink resolves inside rootfs, not to the host file
+	group := "root:x:0:\nalice:x:1000:\nwheel:x:10:root,alice\naudio:x:29:bob, alice\n"
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "shared", "group"), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/../../shared/group", filepath.Join(rootfs, "etc", "group")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "group"), []byte("evil:x:1000:alice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user string
+		want specs.User
+		home string
+		fail bool
+	}{
+		{user: "", want: specs.User{AdditionalGids: []uint32{10}}, home: "/root"},
+		{user: "alice", want: specs.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{10, 29}}, home: "/home/alice"},
+		{user: "1000", want: specs.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{10, 29}}, home: "/home/alice"},
+		{user: "alice:wheel", want: specs.User{UID: 1000, GID: 10, AdditionalGids: []uint32{29}}, home: "/home/alice"},
+		{user: "alice:42", want: specs.User{UID: 1000, GID: 42, AdditionalGids: []uint32{10, 29}}, home: "/home/alice"},
+		{user: "1234", want: specs.User{UID: 1234}, home: "/"},
+		{user: "1234:audio", want: specs.User{UID: 1234, GID: 29}, home: "/"},
+		{user: "bob", fail: true},
+		{user: "alice:nogroup", fail: true},
+		{user: ":10", fail: true},
+	} {
+		u, home, err := resolveUser(rootfs, tc.user)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.user, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(u, tc.want) {
+			t.Errorf("%q: expected %+v, got %+v", tc.user, tc.want, u)
+		}
+		if home != tc.home {
+			t.Errorf("%q: expected home %q, got %q", tc.user, tc.home, home)
+		}
+	}
+}
+
+func TestRootfsPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing/../../../../../../../../etc/hostname", filepath.Join(rootfs, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/missing/../../../pwned", filepath.Join(rootfs, "etc", "l1")); err != nil {
+		t.Fatal(err)
+	}
+	// symlinks after a missing component and ".." are still resolved
+	host := filepath.Join(root, "host")
+	if err := os.Symlink(host, filepath.Join(rootfs, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("nonexistent/../evil", filepath.Join(rootfs, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{name: "/etc/passwd", want: filepath.Join(rootfs, "etc", "hostname")},
+		{name: "/etc/l1/file", want: filepath.Join(rootfs, "pwned", "file")},
+		{name: "/missing/../../etc", want: filepath.Join(rootfs, "etc")},
+		{name: "/etc/missing/../../../x", want: filepath.Join(rootfs, "x")},
+		{name: "/a/file", want: filepath.Join(rootfs, host, "file")},
+	} {
+		got, err := rootfsPath(rootfs, tc.name)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ConvertLayout validates the image layout in the directory src and writes
+// it to dest as an image layout of the given type.
+func ConvertLayout(src, dest, destType string) error {
+	return ConvertLayoutContext(context.Background(), src, dest, destType)
+}
+
+// ConvertLayoutContext is like ConvertLayout but stops as soon as ctx is
+// done, cleaning up any partial output.
+func ConvertLayoutContext(ctx context.Context, src, dest, destType string) error {
+	if err := layoutValidate(ctx, newPathWalker(src)); err != nil {
+		return err
+	}
+
+	return writeLayout(src, dest, destType)
+}
+
+// ConvertZip validates the image layout in the zip file src and writes it to
+// dest as an image layout of the given type.
+func ConvertZip(src, dest, destType string) error {
+	return ConvertZipContext(context.Background(), src, dest, destType)
+}
+
+// ConvertZipContext is like ConvertZip but stops as soon as ctx is done,
+// cleaning up any partial output.
+func ConvertZipContext(ctx context.Context, src, dest, destType string) error {
+	return convert(ctx, newZipWalker(src), dest, destType)
+}
+
+// ConvertFile opens the file pointed by tarFile and calls Convert on it.
+func ConvertFile(tarFile, dest, destType string) error {
+	return ConvertFileContext(context.Background(), tarFile, dest, destType)
+}
+
+// ConvertFileContext is like ConvertFile but stops as soon as ctx is done,
+// cleaning up any partial output.
+func ConvertFileContext(ctx context.Context, tarFile, dest, destType string) error {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return ConvertContext(ctx, f, dest, destType)
+}
+
+// Convert validates the image layout in the tar stream and writes it to dest
+// as an image layout of the given type. Tar and zip archives are written
+// with a fixed entry order and normalized metadata, so converting the same
+// layout always produces the same archive byte for byte.
+func Convert(r io.ReadSeeker, dest, destType string) error {
+	return ConvertContext(context.Background(), r, dest, destType)
+}
+
+// ConvertContext is like Convert but stops as soon as ctx is done, cleaning
+// up any partial output.
+func ConvertContext(ctx context.Context, r io.ReadSeeker, dest, destType string) error {
+	return convert(ctx, newTarWalker(r), dest, destType)
+}
+
+func convert(ctx context.Context, w walker, dest, destType string) error {
+	if err := layoutValidate(ctx, w); err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir(filepath.Dir(dest), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := extractLayout(ctx, w, staging); err != nil {
+		return err
+	}
+
+	return writeLayout(staging, dest, destType)
+}
+
+// writeLayout writes the image layout in the directory root to dest as an
+// image layout of the given type.
+func writeLayout(root, dest, destType string) error {
+	switch destType {
+	case TypeImageLayout:
+		return WriteLayoutDir(root, dest)
+	case TypeImage, TypeImageZip:
+		return writeArchive(root, dest, destType)
+	default:
+		return fmt.Errorf("cannot convert to %q", destType)
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// CopyLayout walks through the file tree given by src and copies the image
+// named ref, or all images if ref is empty, into the image layout dest of
+// the given type. The copied image is named newRef in dest if it is set.
+func CopyLayout(src, dest, destType, ref, newRef string) error {
+	return CopyLayoutContext(context.Background(), src, dest, destType, ref, newRef)
+}
+
+// CopyLayoutContext is like CopyLayout but stops as soon as ctx is done,
+// cleaning up any partial output.
+func CopyLayoutContext(ctx context.Context, src, dest, destType, ref, newRef string) error {
+	return copyImage(ctx, newPathWalker(src), dest, destType, ref, newRef)
+}
+
+// CopyZip opens and walks through the zip file given by src and copies the
+// image named ref, or all images if ref is empty, into the image layout dest
+// of the given type. The copied image is named newRef in dest if it is set.
+func CopyZip(src, dest, destType, ref, newRef string) error {
+	return CopyZipContext(context.Background(), src, dest, destType, ref, newRef)
+}
+
+// CopyZipContext is like CopyZip but stops as soon as ctx is done, cleaning
+// up any partial output.
+func CopyZipContext(ctx context.Context, src, dest, destType, ref, newRef string) error {
+	return copyImage(ctx, newZipWalker(src), dest, destType, ref, newRef)
+}
+
+// CopyFile opens the file pointed by tarFile and calls Copy on it.
+func CopyFile(tarFile, dest, destType, ref, newRef string) error {
+	return CopyFileContext(context.Background(), tarFile, dest, destType, ref, newRef)
+}
+
+// CopyFileContext is like CopyFile but stops as soon as ctx is done,
+// cleaning up any partial output.
+func CopyFileContext(ctx context.Context, tarFile, dest, destType, ref, newRef string) error {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return CopyContext(ctx, f, dest, destType, ref, newRef)
+}
+
+// Copy walks through the tar stream and copies the image named ref, or all
+// images if ref is empty, into the image layout dest of the given type.
+// The copied image is named newRef in dest if it is set.
+//
+// Only blobs missing at the destination are copied, and each of them is
+// verified against its digest while being copied. A directory destination
+// has its index.json replaced atomically once all blobs are in place, tar
+// and zip destinations are replaced by a new archive.
+func Copy(r io.ReadSeeker, dest, destType, ref, newRef string) error {
+	return CopyContext(context.Background(), r, dest, destType, ref, newRef)
+}
+
+// CopyContext is like Copy but stops as soon as ctx is done, cleaning up any
+// partial output.
+func CopyContext(ctx context.Context, r io.ReadSeeker, dest, destType, ref, newRef string) error {
+	return copyImage(ctx, newTarWalker(r), dest, destType, ref, newRef)
+}
+
+func copyImage(ctx context.Context, w walker, dest, destType, ref, newRef string) error {
+	if err := layoutValidate(ctx, w); err != nil {
+		return err
+	}
+
+	var descs []v1.Descriptor
+	var err error
+	if ref == "" {
+		descs, err = listReferences(ctx, w)
+	} else {
+		descs, err = findDescriptor(ctx, w, []string{"name=" + ref})
+	}
+	if err != nil {
+		return err
+	}
+
+	if newRef != "" {
+		if len(descs) != 1 {
+			return fmt.Errorf("a new ref can only be given when copying a single image")
+		}
+
+		annotations := map[string]string{}
+		for k, v := range descs[0].Annotations {
+			annotations[k] = v
+		}
+		annotations[v1.AnnotationRefName] = newRef
+		descs[0].Annotations = annotations
+	}
+
+	switch destType {
+	case TypeImageLayout:
+		return copyToLayout(ctx, w, dest, descs)
+	case TypeImage, TypeImageZip:
+		staging, err := ioutil.TempDir(filepath.Dir(dest), ".tmp-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(staging)
+
+		if err := extractArchive(ctx, dest, destType, staging); err != nil {
+			return err
+		}
+
+		if err := copyToLayout(ctx, w, staging, descs); err != nil {
+			return err
+		}
+
+		return writeArchive(staging, dest, destType)
+	default:
+		return fmt.Errorf("cannot copy to %q", destType)
+	}
+}
+
+// copyToLayout copies the blobs reachable from descs into the image layout
+// directory dest and adds descs to its index.json.
+func copyToLayout(ctx context.Context, w walker, dest string, descs []v1.Descriptor) error {
+	lw, err := newLayoutWriter(ctx, dest)
+	if err != nil {
+		return err
+	}
+
+	index, err := lw.readIndex()
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range descs {
+		if err := copyBlobs(ctx, w, lw, desc); err != nil {
+			return err
+		}
+
+		addReference(index, desc)
+	}
+
+	return lw.writeIndex(index)
+}
+
+// copyBlobs copies the blob described by desc and everything it references
+// into lw. Referenced blobs are copied first, so the destination never holds
+// a manifest or index whose children are missing.
+func copyBlobs(ctx context.Context, w walker, lw *layoutWriter, desc v1.Descriptor) error {
+	switch desc.MediaType {
+	case v1.MediaTypeImageManifest:
+		m, err := findManifest(ctx, w, &desc)
+		if err != nil {
+			return err
+		}
+
+		if err := copyBlob(ctx, w, lw, m.Config); err != nil {
+			return err
+		}
+
+		for _, layer := range m.Layers {
+			if err := copyBlob(ctx, w, lw, layer); err != nil {
+				return err
+			}
+		}
+	case v1.MediaTypeImageIndex:
+		index, err := findIndex(ctx, w, &desc)
+		if err != nil {
+			return err
+		}
+
+		for _, manifest := range index.Manifests {
+			if err := copyBlobs(ctx, w, lw, manifest); err != nil {
+				return err
+			}
+		}
+	}
+
+	return copyBlob(ctx, w, lw, desc)
+}
+
+// copyBlob copies the single blob described by desc into lw unless it is
+// already present with the right size.
+func copyBlob(ctx context.Context, w walker, lw *layoutWriter, desc v1.Descriptor) error {
+	if lw.hasBlobOfSize(desc) {
+		return nil
+	}
+
+	bpath := filepath.Join("blobs", string(desc.Digest.Algorithm()), desc.Digest.Hex())
+	switch err := w.find(ctx, bpath, func(path string, r io.Reader) error {
+		return lw.putVerifiedBlob(desc, r)
+	}); {
+	case err == nil:
+		return nil
+	case os.IsNotExist(errors.Cause(err)) && len(desc.URLs) > 0:
+		// non-distributable content is fetched from its URLs by consumers
+		return nil
+	case os.IsNotExist(errors.Cause(err)) && desc.Data != nil:
+		// the content is embedded in the descriptor
+		return lw.putVerifiedBlob(desc, bytes.NewReader(desc.Data))
+	default:
+		return errors.Wrapf(err, "%s: unable to copy blob", bpath)
+	}
+}
+
+// extractArchive extracts the existing image layout archive src of the
+// given type into the directory dest. A missing src is not an error.
+func extractArchive(ctx context.Context, src, typ, dest string) error {
+	switch typ {
+	case TypeImage:
+		f, err := os.Open(src) // nolint: errcheck, gosec
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "unable to open file")
+		}
+		defer f.Close()
+
+		return extractLayout(ctx, newTarWalker(f), dest)
+	case TypeImageZip:
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			return nil
+		}
+
+		return extractLayout(ctx, newZipWalker(src), dest)
+	default:
+		return fmt.Errorf("cannot extract archive of type %q", typ)
+	}
+}
+
+// extractLayout extracts the regular files and directories walked by w into
+// the directory dest.
+func extractLayout(ctx context.Context, w walker, dest string) error {
+	return w.walk(ctx, func(path string, info os.FileInfo, r io.Reader) error {
+		rel := filepath.Clean(path)
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("%q is outside of the image layout", path)
+		}
+
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Wrap(err, "unable to open file")
+		}
+		defer f.Close()
+
+		_, err = io.Copy(f, r)
+		return err
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "test-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	archive := filepath.Join(tmp, "busybox.tar")
+	if err := createDockerArchive(archive, []string{"busybox:latest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(tmp, "src")
+	if err := ImportDockerArchiveFile(archive, src); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		destType string
+	}{
+		{"layout", TypeImageLayout},
+		{"layout.tar", TypeImage},
+		{"layout.zip", TypeImageZip},
+	} {
+		dest := filepath.Join(tmp, tc.name)
+
+		// the second copy extends the destination written by the first
+		for _, newRef := range []string{"first", "second"} {
+			if err := CopyLayout(src, dest, tc.destType, "busybox:latest", newRef); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		}
+
+		for _, ref := range []string{"first", "second"} {
+			var err error
+			switch tc.destType {
+			case TypeImageLayout:
+				err = ValidateLayout(dest, []string{"name=" + ref}, nil)
+			case TypeImage:
+				err = ValidateFile(dest, []string{"name=" + ref}, nil)
+			case TypeImageZip:
+				err = ValidateZip(dest, []string{"name=" + ref}, nil)
+			}
+			if err != nil {
+				t.Fatalf("%s: %s: %v", tc.name, ref, err)
+			}
+		}
+	}
+
+	// a corrupt blob of the destination is replaced
+	dest := filepath.Join(tmp, "layout")
+	blobs, err := filepath.Glob(filepath.Join(dest, "blobs", "sha256", "*"))
+	if err != nil || len(blobs) == 0 {
+		t.Fatalf("expected blobs in %s: %v", dest, err)
+	}
+	for _, blob := range blobs {
+		if err := ioutil.WriteFile(blob, []byte("corrupt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CopyLayout(src, dest, TypeImageLayout, "busybox:latest", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateLayout(dest, []string{"name=first"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopyLayout(src, filepath.Join(tmp, "missing"), TypeImageLayout, "busybox:missing", ""); err == nil {
+		t.Fatal("expected copying a missing ref to fail")
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "test-convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	archive := filepath.Join(tmp, "busybox.tar")
+	if err := createDockerArchive(archive, []string{"busybox:latest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(tmp, "src")
+	if err := ImportDockerArchiveFile(archive, src); err != nil {
+		t.Fatal(err)
+	}
+
+	tarFile := filepath.Join(tmp, "layout.tar")
+	zipFile := filepath.Join(tmp, "layout.zip")
+	dir := filepath.Join(tmp, "layout")
+	again := filepath.Join(tmp, "again.tar")
+
+	for _, step := range []func() error{
+		func() error { return ConvertLayout(src, tarFile, TypeImage) },
+		func() error { return ConvertFile(tarFile, zipFile, TypeImageZip) },
+		func() error { return ConvertZip(zipFile, dir, TypeImageLayout) },
+		func() error { return ConvertLayout(dir, again, TypeImage) },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ValidateZip(zipFile, []string{"name=busybox:latest"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ioutil.ReadFile(tarFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ioutil.ReadFile(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("converting the same layout twice produced different archives")
+	}
+
+	if err := ConvertLayout(src, dir, TypeImageLayout); err == nil {
+		t.Fatal("expected converting into a non-empty directory to fail")
+	}
+}
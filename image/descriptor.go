@@ -15,6 +15,7 @@
 package image
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -28,11 +29,11 @@ import (
 
 const indexPath = "index.json"
 
-func listReferences(w walker) ([]v1.Descriptor, error) {
+func listReferences(ctx context.Context, w walker) ([]v1.Descriptor, error) {
 	var descs []v1.Descriptor
 	var index v1.Index
 
-	if err := w.walk(func(path string, info os.FileInfo, r io.Reader) error {
+	if err := w.walk(ctx, func(path string, info os.FileInfo, r io.Reader) error {
 		if info.IsDir() || filepath.Clean(path) != indexPath {
 			return nil
 		}
@@ -50,62 +51,44 @@ func listReferences(w walker) ([]v1.Descriptor, error) {
 	return descs, nil
 }
 
-func findDescriptor(w walker, names []string) ([]v1.Descriptor, error) {
+// findDescriptor returns the single descriptor of index.json matching all
+// the criteria in refs. See parseRefQuery for the supported criteria.
+func findDescriptor(ctx context.Context, w walker, refs []string) ([]v1.Descriptor, error) {
 	var descs []v1.Descriptor
 	var index v1.Index
-	dpath := "index.json"
 
-	if err := w.find(dpath, func(path string, r io.Reader) error {
+	if err := w.find(ctx, indexPath, func(path string, r io.Reader) error {
 		if err := json.NewDecoder(r).Decode(&index); err != nil {
 			return err
 		}
 
-		descs = index.Manifests
-		for _, name := range names {
-			argsParts := strings.Split(name, "=")
-			if len(argsParts) != 2 {
-				return fmt.Errorf("each ref must contain two parts")
-			}
-
-			switch argsParts[0] {
-			case "name":
-				for i := 0; i < len(descs); i++ {
-					if descs[i].Annotations[v1.AnnotationRefName] != argsParts[1] {
-						descs = append(descs[:i], descs[i+1:]...)
-					}
-				}
-			case "platform.os":
-				for i := 0; i < len(descs); i++ {
-					if descs[i].Platform != nil && index.Manifests[i].Platform.OS != argsParts[1] {
-						descs = append(descs[:i], descs[i+1:]...)
-					}
-				}
-			case "digest":
-				for i := 0; i < len(descs); i++ {
-					if string(descs[i].Digest) != argsParts[1] {
-						descs = append(descs[:i], descs[i+1:]...)
-					}
-				}
-			default:
-				return fmt.Errorf("criteria %q unimplemented", argsParts[0])
-			}
-		}
-
-		return nil
+		var err error
+		descs, err = queryDescriptors(index.Manifests, refs)
+		return err
 	}); err != nil {
 		return nil, err
 	}
 
-	if len(descs) == 0 {
-		return nil, fmt.Errorf("index.json: descriptor retrieved by refs %v is not match", names)
-	} else if len(descs) > 1 {
-		return nil, fmt.Errorf("index.json: descriptor retrieved by refs %v is not unique", names)
+	switch len(descs) {
+	case 0:
+		return nil, fmt.Errorf("index.json: no descriptor matches refs %v", refs)
+	case 1:
+		return descs, nil
 	}
 
-	return descs, nil
+	candidates := make([]string, len(descs))
+	for i := range descs {
+		candidates[i] = "  " + describeDescriptor(&descs[i])
+	}
+
+	return nil, fmt.Errorf("index.json: refs %v are ambiguous, %d descriptors match:\n%s", refs, len(descs), strings.Join(candidates, "\n"))
 }
 
-func validateDescriptor(d *v1.Descriptor, w walker, mts []string) error {
+// validateDescriptor checks that the blob described by d has one of the
+// media types mts, or any media type if mts is empty, and matches its size
+// and digest. Embedded data is checked as well, and stands in for the blob
+// if the layout does not hold it.
+func validateDescriptor(ctx context.Context, d *v1.Descriptor, w walker, mts []string) error {
 	var found bool
 	for _, mt := range mts {
 		if d.MediaType == mt {
@@ -113,23 +96,27 @@ func validateDescriptor(d *v1.Descriptor, w walker, mts []string) error {
 			break
 		}
 	}
-	if !found {
+	if !found && len(mts) > 0 {
 		return fmt.Errorf("invalid descriptor MediaType %q", d.MediaType)
 	}
 
-	if err := d.Digest.Validate(); err != nil {
+	if err := validateDigest(d.Digest); err != nil {
 		return err
 	}
 
-	// Copy the contents of the layer in to the verifier
-	verifier := d.Digest.Verifier()
-	numBytes, err := w.get(*d, verifier)
-	if err != nil {
+	if err := validateData(d); err != nil {
 		return err
 	}
 
+	// Copy the contents of the layer in to the verifier
+	verifier := d.Digest.Verifier()
+	numBytes, err := w.get(ctx, *d, verifier)
+	if os.IsNotExist(errors.Cause(err)) && d.Data != nil {
+		emit(ctx, Event{Type: EventBlobVerified, Digest: d.Digest, MediaType: d.MediaType, Size: d.Size})
+		return nil
+	}
 	if err != nil {
-		return errors.Wrap(err, "error generating hash")
+		return err
 	}
 
 	if numBytes != d.Size {
@@ -140,5 +127,35 @@ func validateDescriptor(d *v1.Descriptor, w walker, mts []string) error {
 		return errors.New("digest mismatch")
 	}
 
+	emit(ctx, Event{Type: EventBlobVerified, Digest: d.Digest, MediaType: d.MediaType, Size: d.Size})
+
 	return nil
 }
+
+// validateData checks that the data embedded in d, if any, matches its
+// size and digest.
+func validateData(d *v1.Descriptor) error {
+	if d.Data == nil {
+		return nil
+	}
+
+	if int64(len(d.Data)) != d.Size {
+		return fmt.Errorf("embedded data of %s: size %d does not match %d", d.Digest, len(d.Data), d.Size)
+	}
+
+	if actual := d.Digest.Algorithm().FromBytes(d.Data); actual != d.Digest {
+		return fmt.Errorf("embedded data of %s: digest mismatch, got %s", d.Digest, actual)
+	}
+
+	return nil
+}
+
+// validateSubject checks the subject descriptor d of a manifest or index.
+// The subject does not need to be part of the layout.
+func validateSubject(d *v1.Descriptor) error {
+	if err := validateDigest(d.Digest); err != nil {
+		return errors.Wrap(err, "subject")
+	}
+
+	return errors.Wrap(validateData(d), "subject")
+}
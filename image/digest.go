@@ -0,0 +1,80 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	// register the hash functions of the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// supportedAlgorithms are the digest algorithms registered by the
+// image-spec.
+var supportedAlgorithms = []digest.Algorithm{digest.SHA256, digest.SHA512}
+
+// CheckAlgorithm returns an error if a is not a digest algorithm
+// registered by the image-spec, that is sha256 or sha512.
+func CheckAlgorithm(a digest.Algorithm) error {
+	for _, supported := range supportedAlgorithms {
+		if a == supported && a.Available() {
+			return nil
+		}
+	}
+
+	names := make([]string, len(supportedAlgorithms))
+	for i, supported := range supportedAlgorithms {
+		names[i] = string(supported)
+	}
+	return fmt.Errorf("unsupported digest algorithm %q, expected one of %s", a, strings.Join(names, ", "))
+}
+
+// validateDigest is like d.Validate, but rejects the algorithms not
+// registered by the image-spec with a clear error.
+func validateDigest(d digest.Digest) error {
+	if i := strings.Index(string(d), ":"); i > 0 {
+		if err := CheckAlgorithm(d.Algorithm()); err != nil {
+			return errors.Wrapf(err, "%s", d)
+		}
+	}
+
+	return d.Validate()
+}
+
+// digestAlgorithmKey is the context key of the algorithm set by
+// WithDigestAlgorithm.
+type digestAlgorithmKey struct{}
+
+// WithDigestAlgorithm returns a copy of ctx whose new content, such as the
+// blobs written by import, squash and mutate and the diff_ids they compute,
+// is addressed with a instead of sha256, for use with the context-aware
+// functions. Existing content keeps its digests.
+func WithDigestAlgorithm(ctx context.Context, a digest.Algorithm) context.Context {
+	return context.WithValue(ctx, digestAlgorithmKey{}, a)
+}
+
+// digestAlgorithm returns the algorithm set by WithDigestAlgorithm, or
+// sha256.
+func digestAlgorithm(ctx context.Context) digest.Algorithm {
+	if a, ok := ctx.Value(digestAlgorithmKey{}).(digest.Algorithm); ok {
+		return a
+	}
+	return digest.Canonical
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCheckAlgorithm(t *testing.T) {
+	for _, a := range []digest.Algorithm{digest.SHA256, digest.SHA512} {
+		if err := CheckAlgorithm(a); err != nil {
+			t.Errorf("%s: %v", a, err)
+		}
+	}
+
+	for _, a := range []digest.Algorithm{digest.SHA384, "md5", ""} {
+		if err := CheckAlgorithm(a); err == nil {
+			t.Errorf("%q: expected an error", a)
+		}
+	}
+
+	ctx := WithDigestAlgorithm(context.Background(), "md5")
+	if _, err := newLayoutWriter(ctx, filepath.Join(os.TempDir(), "oci-tool-unused")); err == nil {
+		t.Error("expected an error writing md5 blobs")
+	}
+}
+
+func TestSHA512Layout(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "etc/hostname"),
+		plainLayer(t, "bin/sh"),
+	)
+
+	// the squashed image only holds new sha512 content
+	ctx := WithDigestAlgorithm(context.Background(), digest.SHA512)
+	desc, err := SquashLayoutContext(ctx, layout, "", []string{"name=latest"}, "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest.Algorithm() != digest.SHA512 {
+		t.Fatalf("expected a sha512 manifest, got %s", desc.Digest)
+	}
+
+	m, err := findManifest(context.Background(), newPathWalker(layout), &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := findConfig(context.Background(), newPathWalker(layout), &m.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []digest.Digest{m.Config.Digest, m.Layers[0].Digest, c.RootFS.DiffIDs[0]} {
+		if d.Algorithm() != digest.SHA512 {
+			t.Errorf("expected a sha512 digest, got %s", d)
+		}
+	}
+
+	refs := []string{"name=sha512"}
+	if err := ValidateLayout(layout, refs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := filepath.Join(root, "copy")
+	if err := CopyLayout(layout, copied, TypeImageLayout, "sha512", ""); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(root, "copy.tar")
+	if err := ConvertLayout(copied, archive, TypeImage); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateFile(archive, refs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnpackFile(archive, filepath.Join(root, "rootfs"), "", refs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "rootfs", "bin", "sh")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// dockerManifestPath is the path of the manifest in a `docker save` archive.
+const dockerManifestPath = "manifest.json"
+
+// dockerManifest is an entry of the manifest.json file found in archives
+// produced by `docker save`.
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// ImportDockerArchiveFile opens the `docker save` archive given by the
+// filename, then calls ImportDockerArchive.
+func ImportDockerArchiveFile(tarFile, dest string) error {
+	return ImportDockerArchiveFileContext(context.Background(), tarFile, dest)
+}
+
+// ImportDockerArchiveFileContext is like ImportDockerArchiveFile but stops
+// as soon as ctx is done, cleaning up any partial output.
+func ImportDockerArchiveFileContext(ctx context.Context, tarFile, dest string) error {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return ImportDockerArchiveContext(ctx, f, dest)
+}
+
+// ImportDockerArchive converts the images of a `docker save` tar stream
+// into an image layout in the given destination directory. The layout is
+// created if it does not exist, otherwise the images are added to it.
+// Repository tags are preserved as ref name annotations in index.json.
+func ImportDockerArchive(r io.ReadSeeker, dest string) error {
+	return ImportDockerArchiveContext(context.Background(), r, dest)
+}
+
+// ImportDockerArchiveContext is like ImportDockerArchive but stops as soon
+// as ctx is done, cleaning up any partial output.
+func ImportDockerArchiveContext(ctx context.Context, r io.ReadSeeker, dest string) error {
+	return importDockerArchive(ctx, newTarWalker(r), dest)
+}
+
+func importDockerArchive(ctx context.Context, w walker, dest string) error {
+	var manifests []dockerManifest
+
+	switch err := w.find(ctx, dockerManifestPath, func(path string, r io.Reader) error {
+		if err := json.NewDecoder(r).Decode(&manifests); err != nil {
+			return errors.Wrapf(err, "%s: manifest format mismatch", path)
+		}
+
+		return nil
+	}); {
+	case os.IsNotExist(errors.Cause(err)):
+		return fmt.Errorf("%s not found, legacy docker archives are not supported", dockerManifestPath)
+	case err != nil:
+		return err
+	}
+
+	if len(manifests) == 0 {
+		return fmt.Errorf("%s: no images found", dockerManifestPath)
+	}
+
+	lw, err := newLayoutWriter(ctx, dest)
+	if err != nil {
+		return err
+	}
+
+	index, err := lw.readIndex()
+	if err != nil {
+		return err
+	}
+
+	for _, dm := range manifests {
+		desc, err := importDockerImage(ctx, w, lw, &dm)
+		if err != nil {
+			return err
+		}
+
+		if len(dm.RepoTags) == 0 {
+			// importing the same untagged image again changes nothing
+			if !hasReference(index, desc.Digest) {
+				addReference(index, desc)
+			}
+			continue
+		}
+
+		for _, tag := range dm.RepoTags {
+			d := desc
+			d.Annotations = map[string]string{v1.AnnotationRefName: tag}
+			addReference(index, d)
+		}
+	}
+
+	return lw.writeIndex(index)
+}
+
+// importDockerImage stores the config and layers of a single image from a
+// docker archive in lw and returns the descriptor of the new manifest.
+func importDockerImage(ctx context.Context, w walker, lw *layoutWriter, dm *dockerManifest) (v1.Descriptor, error) {
+	var c v1.Image
+
+	if err := w.find(ctx, filepath.Clean(dm.Config), func(path string, r io.Reader) error {
+		if err := json.NewDecoder(r).Decode(&c); err != nil {
+			return errors.Wrapf(err, "%s: config format mismatch", path)
+		}
+
+		return nil
+	}); err != nil {
+		return v1.Descriptor{}, errors.Wrapf(err, "%s: unable to read config", dm.Config)
+	}
+
+	if len(c.RootFS.DiffIDs) != len(dm.Layers) {
+		return v1.Descriptor{}, fmt.Errorf("%s: config lists %d layers, manifest lists %d", dm.Config, len(c.RootFS.DiffIDs), len(dm.Layers))
+	}
+
+	m := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Layers:    []v1.Descriptor{},
+	}
+
+	for i, layer := range dm.Layers {
+		var desc v1.Descriptor
+
+		if err := w.find(ctx, filepath.Clean(layer), func(path string, r io.Reader) error {
+			buf := bufio.NewReader(r)
+			comp, err := DetectCompression(buf)
+			if err != nil {
+				return err
+			}
+
+			switch comp {
+			case "gzip":
+				desc.MediaType = v1.MediaTypeImageLayerGzip
+			case "plain":
+				desc.MediaType = v1.MediaTypeImageLayer
+			default:
+				return fmt.Errorf("%s: unsupported layer compression %s", path, comp)
+			}
+
+			// the layer is only stored once its diff_id is checked
+			desc.Digest, desc.Size, err = lw.putCheckedBlob(buf, func(blob string) error {
+				return checkDiffID(blob, desc.MediaType, c.RootFS.DiffIDs[i])
+			})
+			return errors.Wrap(err, path)
+		}); err != nil {
+			return v1.Descriptor{}, errors.Wrapf(err, "%s: unable to import layer", layer)
+		}
+
+		m.Layers = append(m.Layers, desc)
+	}
+
+	// Round-tripping through v1.Image drops the Docker specific fields
+	// (container_config, docker_version, ...) the image-spec does not know.
+	config, err := lw.putJSON(v1.MediaTypeImageConfig, c)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	m.Config = config
+
+	desc, err := lw.putJSON(v1.MediaTypeImageManifest, m)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Platform = &v1.Platform{
+		Architecture: c.Architecture,
+		OS:           c.OS,
+	}
+
+	return desc, nil
+}
+
+// checkDiffID checks that the uncompressed content of the layer of the
+// given media type in the file path matches diffID.
+func checkDiffID(path, mediaType string, diffID digest.Digest) error {
+	if err := validateDigest(diffID); err != nil {
+		return errors.Wrap(err, "diff_id")
+	}
+
+	f, err := os.Open(path) // nolint: errcheck, gosec
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if mediaType == v1.MediaTypeImageLayerGzip {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	verifier := diffID.Verifier()
+	if _, err := io.Copy(verifier, r); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("uncompressed content does not match diff_id %s", diffID)
+	}
+
+	return nil
+}
+
+// dockerRepositories is the content of the legacy repositories file found
+// in archives produced by `docker save`, mapping repositories and tags to
+// the ID of the topmost layer.
+type dockerRepositories map[string]map[string]string
+
+// ExportDockerArchiveLayout walks through the file tree given by src and
+// writes the image pointed to by the given refs to dest as an archive that
+// can be loaded with `docker load`.
+func ExportDockerArchiveLayout(src, dest, platform string, refs []string) error {
+	return ExportDockerArchiveLayoutContext(context.Background(), src, dest, platform, refs)
+}
+
+// ExportDockerArchiveLayoutContext is like ExportDockerArchiveLayout but
+// stops as soon as ctx is done, cleaning up any partial output.
+func ExportDockerArchiveLayoutContext(ctx context.Context, src, dest, platform string, refs []string) error {
+	return exportDockerArchive(ctx, newPathWalker(src), dest, platform, refs)
+}
+
+// ExportDockerArchiveZip opens and walks through the zip file given by src
+// and writes the image pointed to by the given refs to dest as an archive
+// that can be loaded with `docker load`.
+func ExportDockerArchiveZip(src, dest, platform string, refs []string) error {
+	return ExportDockerArchiveZipContext(context.Background(), src, dest, platform, refs)
+}
+
+// ExportDockerArchiveZipContext is like ExportDockerArchiveZip but stops as
+// soon as ctx is done, cleaning up any partial output.
+func ExportDockerArchiveZipContext(ctx context.Context, src, dest, platform string, refs []string) error {
+	return exportDockerArchive(ctx, newZipWalker(src), dest, platform, refs)
+}
+
+// ExportDockerArchiveFile opens the file pointed by tarFile and calls
+// ExportDockerArchive on it.
+func ExportDockerArchiveFile(tarFile, dest, platform string, refs []string) error {
+	return ExportDockerArchiveFileContext(context.Background(), tarFile, dest, platform, refs)
+}
+
+// ExportDockerArchiveFileContext is like ExportDockerArchiveFile but stops
+// as soon as ctx is done, cleaning up any partial output.
+func ExportDockerArchiveFileContext(ctx context.Context, tarFile, dest, platform string, refs []string) error {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return ExportDockerArchiveContext(ctx, f, dest, platform, refs)
+}
+
+// ExportDockerArchive walks through the tar stream and writes the image
+// pointed to by the given refs to dest as an archive that can be loaded with
+// `docker load`. Tags are restored from the ref name annotations of all
+// index.json entries referencing the image; ref names which are not of the
+// form repository:tag are skipped.
+func ExportDockerArchive(r io.ReadSeeker, dest, platform string, refs []string) error {
+	return ExportDockerArchiveContext(context.Background(), r, dest, platform, refs)
+}
+
+// ExportDockerArchiveContext is like ExportDockerArchive but stops as soon
+// as ctx is done, cleaning up any partial output.
+func ExportDockerArchiveContext(ctx context.Context, r io.ReadSeeker, dest, platform string, refs []string) error {
+	return exportDockerArchive(ctx, newTarWalker(r), dest, platform, refs)
+}
+
+func exportDockerArchive(ctx context.Context, w walker, dest, platform string, refs []string) (retErr error) {
+	ref, m, err := resolveManifest(ctx, w, platform, refs)
+	if err != nil {
+		return err
+	}
+
+	c, err := findConfig(ctx, w, &m.Config)
+	if err != nil {
+		return err
+	}
+
+	if len(c.RootFS.DiffIDs) != len(m.Layers) {
+		return fmt.Errorf("config lists %d layers, manifest lists %d", len(c.RootFS.DiffIDs), len(m.Layers))
+	}
+
+	tags, err := dockerTags(ctx, w, ref)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return errors.Wrap(err, "unable to create archive")
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if retErr != nil {
+			os.Remove(dest)
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+
+	dm := dockerManifest{
+		Config:   m.Config.Digest.Hex() + ".json",
+		RepoTags: tags,
+		Layers:   []string{},
+	}
+
+	written := make(map[string]bool)
+	for i, layer := range m.Layers {
+		id := c.RootFS.DiffIDs[i].Hex()
+		dm.Layers = append(dm.Layers, id+"/layer.tar")
+		if written[id] {
+			continue
+		}
+		written[id] = true
+
+		if err := exportDockerLayer(ctx, w, tw, id, layer); err != nil {
+			return err
+		}
+	}
+
+	var config bytes.Buffer
+	if _, err := w.get(ctx, m.Config, &config); err != nil {
+		return errors.Wrap(err, "unable to read config")
+	}
+
+	if err := writeTarFile(tw, dm.Config, config.Bytes()); err != nil {
+		return err
+	}
+
+	repositories := dockerRepositories{}
+	for _, tag := range tags {
+		i := strings.LastIndex(tag, ":")
+		if repositories[tag[:i]] == nil {
+			repositories[tag[:i]] = map[string]string{}
+		}
+		if len(c.RootFS.DiffIDs) > 0 {
+			repositories[tag[:i]][tag[i+1:]] = c.RootFS.DiffIDs[len(c.RootFS.DiffIDs)-1].Hex()
+		}
+	}
+
+	for _, file := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"repositories", repositories},
+		{dockerManifestPath, []dockerManifest{dm}},
+	} {
+		buf, err := json.Marshal(file.v)
+		if err != nil {
+			return err
+		}
+
+		if err := writeTarFile(tw, file.name, buf); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// dockerTags returns the repository:tag names carried by the index.json
+// entries referencing the same content as ref.
+func dockerTags(ctx context.Context, w walker, ref *v1.Descriptor) ([]string, error) {
+	descs, err := listReferences(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for _, desc := range descs {
+		name, ok := desc.Annotations[v1.AnnotationRefName]
+		if !ok || desc.Digest != ref.Digest {
+			continue
+		}
+
+		i := strings.LastIndex(name, ":")
+		if i <= 0 || i == len(name)-1 || strings.Contains(name[i:], "/") {
+			warnf(ctx, "ref name %q is not of the form repository:tag, skipping", name)
+			continue
+		}
+
+		tags = append(tags, name)
+	}
+
+	return tags, nil
+}
+
+// exportDockerLayer writes the uncompressed content of layer to tw as
+// id/layer.tar, along with the VERSION file docker expects next to it.
+func exportDockerLayer(ctx context.Context, w walker, tw *tar.Writer, id string, layer v1.Descriptor) error {
+	// The size of the uncompressed layer has to be known before its tar
+	// header can be written, so stage it in a temporary file.
+	tmp, err := ioutil.TempFile("", "oci-layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	lpath := filepath.Join("blobs", string(layer.Digest.Algorithm()), layer.Digest.Hex())
+	if err := w.find(ctx, lpath, func(path string, r io.Reader) error {
+		buf := bufio.NewReader(r)
+		comp, err := DetectCompression(buf)
+		if err != nil {
+			return err
+		}
+
+		reader, err := getReader(ctx, path, layer.MediaType, comp, buf)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(tmp, reader)
+		return err
+	}); err != nil {
+		return errors.Wrapf(err, "%s: unable to read layer", lpath)
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     id + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	}); err != nil {
+		return err
+	}
+
+	if err := writeTarFile(tw, id+"/VERSION", []byte("1.0")); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     id + "/layer.tar",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, tmp)
+	return err
+}
+
+// writeTarFile writes a regular file called name holding buf to tw.
+func writeTarFile(tw *tar.Writer, name string, buf []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(buf)),
+	}); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(buf)
+	return err
+}
@@ -0,0 +1,277 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const dockerConfigStr = `{
+    "architecture": "amd64",
+    "os": "linux",
+    "docker_version": "1.13.1",
+    "container_config": {
+        "Hostname": "f0a5e4e2a3b1"
+    },
+    "config": {
+        "Env": [
+            "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+        ],
+        "Cmd": [
+            "sh"
+        ]
+    },
+    "rootfs": {
+        "type": "layers",
+        "diff_ids": [
+            "<diff_id>"
+        ]
+    }
+}`
+
+// createDockerArchive writes a `docker save` style archive holding a single
+// image with one layer to name.
+func createDockerArchive(name string, repoTags []string) error {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{Name: "test", Size: 4, Mode: 0600}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte("test")); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return writeDockerArchive(name, repoTags, layer.Bytes(), digest.FromBytes(layer.Bytes()))
+}
+
+// writeDockerArchive writes a `docker save` style archive holding a single
+// image made of layer, whose config lists diffID, to name.
+func writeDockerArchive(name string, repoTags []string, layer []byte, diffID digest.Digest) error {
+	config := bytes.Replace([]byte(dockerConfigStr), []byte("<diff_id>"), []byte(diffID), 1)
+	configName := digest.FromBytes(config).Hex() + ".json"
+
+	manifest, err := json.Marshal([]dockerManifest{{
+		Config:   configName,
+		RepoTags: repoTags,
+		Layers:   []string{diffID.Hex() + "/layer.tar"},
+	}})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, content := range []tarContent{
+		{&tar.Header{Name: diffID.Hex() + "/", Typeflag: tar.TypeDir, Mode: 0755}, nil},
+		{&tar.Header{Name: diffID.Hex() + "/layer.tar", Size: int64(len(layer)), Mode: 0644}, layer},
+		{&tar.Header{Name: configName, Size: int64(len(config)), Mode: 0644}, config},
+		{&tar.Header{Name: "manifest.json", Size: int64(len(manifest)), Mode: 0644}, manifest},
+	} {
+		if err := tw.WriteHeader(content.header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content.b); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func TestImportDockerArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "test-docker-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	archive := filepath.Join(tmp, "busybox.tar")
+	if err := createDockerArchive(archive, []string{"busybox:latest", "busybox:1.26"}); err != nil {
+		t.Fatal(err)
+	}
+
+	layout := filepath.Join(tmp, "layout")
+	if err := ImportDockerArchiveFile(archive, layout); err != nil {
+		t.Fatal(err)
+	}
+
+	// importing twice must replace, not duplicate, the tagged entries
+	if err := ImportDockerArchiveFile(archive, layout); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range []string{"busybox:latest", "busybox:1.26"} {
+		if err := ValidateLayout(layout, []string{"name=" + tag}, nil); err != nil {
+			t.Fatalf("%s: %v", tag, err)
+		}
+	}
+
+	lw, err := newLayoutWriter(context.Background(), layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := lw.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("expected 2 index entries, got %d", len(index.Manifests))
+	}
+
+	dest := filepath.Join(tmp, "rootfs")
+	if err := UnpackLayout(layout, dest, "", []string{"name=busybox:latest"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "test")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportDockerArchiveLayers(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "test-docker-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layer := plainLayer(t, "bin/sh")
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	if _, err := gz.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		layer  []byte
+		diffID digest.Digest
+		ok     bool
+	}{
+		{"plain", layer, digest.FromBytes(layer), true},
+		{"gzip", gzipped.Bytes(), digest.FromBytes(layer), true},
+		{"plain-mismatch", layer, digest.FromString("other"), false},
+		{"gzip-mismatch", gzipped.Bytes(), digest.FromBytes(gzipped.Bytes()), false},
+	} {
+		archive := filepath.Join(tmp, c.name+".tar")
+		if err := writeDockerArchive(archive, nil, c.layer, c.diffID); err != nil {
+			t.Fatal(err)
+		}
+
+		layout := filepath.Join(tmp, c.name)
+		err := ImportDockerArchiveFile(archive, layout)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: expected a diff_id mismatch", c.name)
+			}
+			// the mismatching layer is not left in the layout
+			blob := filepath.Join(layout, "blobs", "sha256", digest.FromBytes(c.layer).Hex())
+			if _, err := os.Stat(blob); !os.IsNotExist(err) {
+				t.Errorf("%s: expected the layer blob not to be stored", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		// importing the same untagged image again must not duplicate it
+		if err := ImportDockerArchiveFile(archive, layout); err != nil {
+			t.Fatal(err)
+		}
+		lw, err := newLayoutWriter(context.Background(), layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := lw.readIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(index.Manifests) != 1 {
+			t.Errorf("%s: expected 1 index entry, got %d", c.name, len(index.Manifests))
+		}
+	}
+}
+
+func TestExportDockerArchive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "test-docker-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	archive := filepath.Join(tmp, "busybox.tar")
+	if err := createDockerArchive(archive, []string{"busybox:latest", "busybox:1.26"}); err != nil {
+		t.Fatal(err)
+	}
+
+	layout := filepath.Join(tmp, "layout")
+	if err := ImportDockerArchiveFile(archive, layout); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := filepath.Join(tmp, "exported.tar")
+	if err := ExportDockerArchiveLayout(layout, exported, "", []string{"name=busybox:latest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var manifests []dockerManifest
+	if err := newTarWalker(f).find(context.Background(), dockerManifestPath, func(path string, r io.Reader) error {
+		return json.NewDecoder(r).Decode(&manifests)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifests) != 1 || len(manifests[0].RepoTags) != 2 {
+		t.Fatalf("expected one image with two tags, got %+v", manifests)
+	}
+
+	// the exported archive must import back to the same image
+	reimported := filepath.Join(tmp, "reimported")
+	if err := ImportDockerArchiveFile(exported, reimported); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateLayout(reimported, []string{"name=busybox:1.26"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
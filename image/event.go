@@ -0,0 +1,218 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+// Event types.
+const (
+	// EventLayerStarted is sent before a layer is extracted.
+	EventLayerStarted EventType = iota
+
+	// EventLayerProgress is sent periodically while a layer is extracted,
+	// with the bytes read and entries extracted so far.
+	EventLayerProgress
+
+	// EventLayerFinished is sent once a layer is extracted, with the total
+	// bytes read and entries extracted.
+	EventLayerFinished
+
+	// EventBlobVerified is sent once the size and digest of a blob have
+	// been checked.
+	EventBlobVerified
+
+	// EventWarning reports a problem that does not stop the operation.
+	EventWarning
+
+	// EventDebug reports a detail of the operation, only of interest when
+	// debugging it.
+	EventDebug
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventLayerStarted:
+		return "layer started"
+	case EventLayerProgress:
+		return "layer progress"
+	case EventLayerFinished:
+		return "layer finished"
+	case EventBlobVerified:
+		return "blob verified"
+	case EventWarning:
+		return "warning"
+	case EventDebug:
+		return "debug"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event reports the progress of validate, unpack and create operations.
+type Event struct {
+	Type EventType
+
+	// Digest and MediaType identify the layer or blob, if any.
+	Digest    digest.Digest
+	MediaType string
+
+	// Size is the size of the layer or blob, as given by its descriptor.
+	Size int64
+
+	// Bytes is the number of bytes of the layer read so far, before
+	// decompression.
+	Bytes int64
+
+	// Entries is the number of entries of the layer extracted so far.
+	Entries int
+
+	// Message describes a warning or a debug detail.
+	Message string
+}
+
+// EventSink receives the events of the image package. Events are sent
+// synchronously from the goroutine doing the work, so Event should return
+// quickly.
+type EventSink interface {
+	Event(e Event)
+}
+
+// EventSinkFunc is an EventSink calling a function.
+type EventSinkFunc func(e Event)
+
+// Event calls f(e).
+func (f EventSinkFunc) Event(e Event) {
+	f(e)
+}
+
+var (
+	sinkLock sync.RWMutex
+	sink     EventSink
+)
+
+// SetEventSink sets the sink receiving the events of the image package. A
+// nil sink disables events, warnings are then written to the standard
+// logger of the log package.
+func SetEventSink(s EventSink) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	sink = s
+}
+
+// eventSinkKey is the context key of the sink set by WithEventSink.
+type eventSinkKey struct{}
+
+// WithEventSink returns a copy of ctx whose events are sent to s instead of
+// the sink set by SetEventSink, for use with the context-aware functions.
+func WithEventSink(ctx context.Context, s EventSink) context.Context {
+	return context.WithValue(ctx, eventSinkKey{}, s)
+}
+
+// emit sends e to the event sink of ctx, or to the one set by SetEventSink.
+func emit(ctx context.Context, e Event) {
+	s, ok := ctx.Value(eventSinkKey{}).(EventSink)
+	if !ok {
+		sinkLock.RLock()
+		s = sink
+		sinkLock.RUnlock()
+	}
+
+	if s != nil {
+		s.Event(e)
+	} else if e.Type == EventWarning {
+		log.Printf("warning: %s", e.Message)
+	}
+}
+
+// warnf sends a warning event.
+func warnf(ctx context.Context, format string, args ...interface{}) {
+	emit(ctx, Event{Type: EventWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// debugf sends a debug event.
+func debugf(ctx context.Context, format string, args ...interface{}) {
+	emit(ctx, Event{Type: EventDebug, Message: fmt.Sprintf(format, args...)})
+}
+
+// progressInterval is the number of bytes read between two
+// EventLayerProgress events.
+const progressInterval = 1 << 20
+
+// entryCounter is implemented by readers counting the entries extracted
+// from the layer they read.
+type entryCounter interface {
+	entry()
+}
+
+// layerProgress reads a layer, sending the layer events of its descriptor.
+type layerProgress struct {
+	ctx     context.Context
+	r       io.Reader
+	desc    v1.Descriptor
+	bytes   int64
+	entries int
+	emitted int64
+}
+
+// newLayerProgress returns a reader of r sending the events of the layer
+// described by desc, starting with EventLayerStarted.
+func newLayerProgress(ctx context.Context, desc v1.Descriptor, r io.Reader) *layerProgress {
+	p := &layerProgress{ctx: ctx, r: r, desc: desc}
+	p.emit(EventLayerStarted)
+	return p
+}
+
+func (p *layerProgress) emit(t EventType) {
+	emit(p.ctx, Event{
+		Type:      t,
+		Digest:    p.desc.Digest,
+		MediaType: p.desc.MediaType,
+		Size:      p.desc.Size,
+		Bytes:     p.bytes,
+		Entries:   p.entries,
+	})
+	p.emitted = p.bytes
+}
+
+func (p *layerProgress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.bytes += int64(n)
+	if p.bytes-p.emitted >= progressInterval {
+		p.emit(EventLayerProgress)
+	}
+	return n, err
+}
+
+func (p *layerProgress) entry() {
+	p.entries++
+}
+
+// finish sends EventLayerFinished.
+func (p *layerProgress) finish() {
+	p.emit(EventLayerFinished)
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUnpackEvents(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "etc/hostname", "etc/hosts"),
+		plainLayer(t, "bin/sh"),
+	)
+
+	var events []Event
+	SetEventSink(EventSinkFunc(func(e Event) {
+		events = append(events, e)
+	}))
+	defer SetEventSink(nil)
+
+	if err := UnpackLayout(layout, filepath.Join(root, "rootfs"), "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[EventType]int{}
+	var entries []int
+	for _, e := range events {
+		counts[e.Type]++
+		if e.Type == EventLayerFinished {
+			if e.Bytes == 0 || e.Size == 0 {
+				t.Errorf("%s: expected bytes and size, got %+v", e.Type, e)
+			}
+			entries = append(entries, e.Entries)
+		}
+	}
+
+	if counts[EventLayerStarted] != 2 || counts[EventLayerFinished] != 2 {
+		t.Errorf("expected 2 started and finished layers, got %v", counts)
+	}
+	// the manifest, the config and both layers are verified
+	if counts[EventBlobVerified] < 4 {
+		t.Errorf("expected at least 4 verified blobs, got %v", counts)
+	}
+	if len(entries) != 2 || entries[0] != 2 || entries[1] != 1 {
+		t.Errorf("unexpected entries %v", entries)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// FsckResult is the outcome of a layout check.
+type FsckResult struct {
+	// Problems describe the corrupt, misnamed, missing and stray files of
+	// the layout, and the blobs of unknown algorithms.
+	Problems []string
+
+	// Unreferenced are the blobs not reachable from index.json. They are
+	// not a problem, but can be removed.
+	Unreferenced []digest.Digest
+}
+
+// OK returns whether the layout has no problem.
+func (r *FsckResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *FsckResult) problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// FsckLayout checks the whole image layout src, regardless of the refs:
+// the top-level structure, every file under blobs against its name, and
+// every descriptor reachable from index.json. It only returns an error if
+// the layout cannot be read, the problems found are in the result.
+func FsckLayout(src string) (*FsckResult, error) {
+	return FsckLayoutContext(context.Background(), src)
+}
+
+// FsckLayoutContext is like FsckLayout but stops as soon as ctx is done.
+func FsckLayoutContext(ctx context.Context, src string) (*FsckResult, error) {
+	return fsck(ctx, newPathWalker(src))
+}
+
+// FsckZip is like FsckLayout for the zip archive src.
+func FsckZip(src string) (*FsckResult, error) {
+	return FsckZipContext(context.Background(), src)
+}
+
+// FsckZipContext is like FsckZip but stops as soon as ctx is done.
+func FsckZipContext(ctx context.Context, src string) (*FsckResult, error) {
+	return fsck(ctx, newZipWalker(src))
+}
+
+// FsckFile opens the tar file given by the filename, then calls Fsck.
+func FsckFile(tarFile string) (*FsckResult, error) {
+	return FsckFileContext(context.Background(), tarFile)
+}
+
+// FsckFileContext is like FsckFile but stops as soon as ctx is done.
+func FsckFileContext(ctx context.Context, tarFile string) (*FsckResult, error) {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return FsckContext(ctx, f)
+}
+
+// Fsck is like FsckLayout for the image layout read from the tar stream r.
+func Fsck(r io.ReadSeeker) (*FsckResult, error) {
+	return FsckContext(context.Background(), r)
+}
+
+// FsckContext is like Fsck but stops as soon as ctx is done.
+func FsckContext(ctx context.Context, r io.ReadSeeker) (*FsckResult, error) {
+	return fsck(ctx, newTarWalker(r))
+}
+
+func fsck(ctx context.Context, w walker) (*FsckResult, error) {
+	res := &FsckResult{}
+
+	if err := layoutValidate(ctx, w); err != nil {
+		res.problemf("%v", err)
+		return res, nil
+	}
+
+	blobs, err := fsckBlobs(ctx, w, res)
+	if err != nil {
+		return nil, err
+	}
+
+	descs, err := listReferences(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[digest.Digest]bool)
+	for i, desc := range descs {
+		if err := fsckDescriptor(ctx, w, desc, fmt.Sprintf("index.json: manifests[%d]", i), blobs, referenced, res); err != nil {
+			return nil, err
+		}
+	}
+
+	for d := range blobs {
+		if !referenced[d] {
+			res.Unreferenced = append(res.Unreferenced, d)
+		}
+	}
+	sort.Slice(res.Unreferenced, func(i, j int) bool {
+		return res.Unreferenced[i] < res.Unreferenced[j]
+	})
+
+	return res, nil
+}
+
+// fsckBlobs rehashes every file under blobs/<algorithm>/ and returns the
+// size of the blobs matching their name. Every other entry of the layout
+// apart from oci-layout and index.json is a stray file.
+func fsckBlobs(ctx context.Context, w walker, res *FsckResult) (map[digest.Digest]int64, error) {
+	blobs := make(map[digest.Digest]int64)
+	unknown := make(map[string]bool)
+
+	if err := w.walk(ctx, func(path string, info os.FileInfo, r io.Reader) error {
+		path = filepath.ToSlash(filepath.Clean(path))
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "." || path == indexPath || path == v1.ImageLayoutFile || path == "blobs":
+			return nil
+		case parts[0] != "blobs":
+			res.problemf("%s: stray file outside of blobs", path)
+			return nil
+		}
+
+		alg := digest.Algorithm(parts[1])
+		if err := CheckAlgorithm(alg); err != nil {
+			if !unknown[parts[1]] {
+				unknown[parts[1]] = true
+				res.problemf("blobs/%s: %v", parts[1], err)
+			}
+			return nil
+		}
+
+		switch {
+		case len(parts) == 2:
+			if !info.IsDir() {
+				res.problemf("%s: stray file, expected an algorithm directory", path)
+			}
+			return nil
+		case len(parts) > 3 || info.IsDir():
+			res.problemf("%s: stray file, blobs/%s must only hold blobs", path, alg)
+			return nil
+		}
+
+		d := digest.NewDigestFromHex(string(alg), parts[2])
+		if err := d.Validate(); err != nil {
+			res.problemf("%s: stray file, its name is not a %s digest", path, alg)
+			return nil
+		}
+
+		verifier := d.Verifier()
+		n, err := io.Copy(verifier, r)
+		if err != nil {
+			return errors.Wrapf(err, "%s: error hashing blob", path)
+		}
+		if !verifier.Verified() {
+			res.problemf("%s: content does not match its digest", path)
+			return nil
+		}
+
+		blobs[d] = n
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// fsckDescriptor checks the blob described by desc, found in parent, and
+// everything it references. Blobs already checked are skipped.
+func fsckDescriptor(ctx context.Context, w walker, desc v1.Descriptor, parent string, blobs map[digest.Digest]int64, referenced map[digest.Digest]bool, res *FsckResult) error {
+	if err := validateDigest(desc.Digest); err != nil {
+		res.problemf("%s: %v", parent, err)
+		return nil
+	}
+	if err := validateData(&desc); err != nil {
+		res.problemf("%s: %v", parent, err)
+		return nil
+	}
+	if referenced[desc.Digest] {
+		return nil
+	}
+	referenced[desc.Digest] = true
+
+	bpath := filepath.ToSlash(filepath.Join("blobs", string(desc.Digest.Algorithm()), desc.Digest.Hex()))
+	size, ok := blobs[desc.Digest]
+	switch {
+	case !ok && len(desc.URLs) > 0:
+		// non-distributable content is fetched from its URLs by consumers
+		return nil
+	case !ok && desc.Data != nil:
+		// the content is embedded in the descriptor
+		return nil
+	case !ok:
+		res.problemf("%s: %s is missing or corrupt", parent, bpath)
+		return nil
+	case size != desc.Size:
+		res.problemf("%s: %s has size %d, expected %d", parent, bpath, size, desc.Size)
+		return nil
+	}
+
+	switch desc.MediaType {
+	case v1.MediaTypeImageManifest:
+		m, err := findManifest(ctx, w, &desc)
+		if err != nil {
+			return fsckParseError(ctx, res, parent, err)
+		}
+
+		if err := fsckDescriptor(ctx, w, m.Config, bpath+": config", blobs, referenced, res); err != nil {
+			return err
+		}
+		for i, layer := range m.Layers {
+			if err := fsckDescriptor(ctx, w, layer, fmt.Sprintf("%s: layers[%d]", bpath, i), blobs, referenced, res); err != nil {
+				return err
+			}
+		}
+	case v1.MediaTypeImageIndex:
+		index, err := findIndex(ctx, w, &desc)
+		if err != nil {
+			return fsckParseError(ctx, res, parent+": "+bpath, err)
+		}
+
+		for i, manifest := range index.Manifests {
+			if err := fsckDescriptor(ctx, w, manifest, fmt.Sprintf("%s: manifests[%d]", bpath, i), blobs, referenced, res); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// fsckParseError records err, from parsing the blob found in parent, as a
+// problem unless ctx is done.
+func fsckParseError(ctx context.Context, res *FsckResult, parent string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	res.problemf("%s: %v", parent, err)
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestFsck(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config, plainLayer(t, "etc/hostname"))
+
+	res, err := FsckLayout(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() || len(res.Unreferenced) != 0 {
+		t.Fatalf("expected a clean layout, got %+v", res)
+	}
+
+	orphan := []byte("orphan")
+	corrupt := digest.FromString("expected")
+	files := map[string][]byte{
+		"blobs/sha256/" + digest.FromBytes(orphan).Hex(): orphan,
+		"blobs/sha256/" + corrupt.Hex():                  []byte("actual"),
+		"blobs/sha256/index.json":                        []byte("{}"),
+		"blobs/md5/d41d8cd98f00b204e9800998ecf8427e":     nil,
+		"notes.txt": nil,
+	}
+	for name, content := range files {
+		path := filepath.Join(layout, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := filepath.Join(root, "layout.tar")
+	if err := ConvertLayout(layout, archive, TypeImage); err != nil {
+		t.Fatal(err)
+	}
+
+	// the archive leaves out the files outside of blobs
+	for _, tt := range []struct {
+		fsck     func() (*FsckResult, error)
+		problems []string
+	}{
+		{
+			func() (*FsckResult, error) { return FsckLayout(layout) },
+			[]string{corrupt.Hex(), "blobs/sha256/index.json", "blobs/md5", "notes.txt"},
+		},
+		{
+			func() (*FsckResult, error) { return FsckFile(archive) },
+			[]string{corrupt.Hex(), "blobs/sha256/index.json", "blobs/md5"},
+		},
+	} {
+		res, err := tt.fsck()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		problems := strings.Join(res.Problems, "\n")
+		for _, expected := range tt.problems {
+			if !strings.Contains(problems, expected) {
+				t.Errorf("expected a problem with %s, got:\n%s", expected, problems)
+			}
+		}
+		if len(res.Problems) != len(tt.problems) {
+			t.Errorf("expected %d problems, got:\n%s", len(tt.problems), problems)
+		}
+
+		if expected := []digest.Digest{digest.FromBytes(orphan)}; !reflect.DeepEqual(res.Unreferenced, expected) {
+			t.Errorf("expected unreferenced blobs %v, got %v", expected, res.Unreferenced)
+		}
+	}
+
+	// a nested index.json is not the one of the layout
+	if err := os.Rename(filepath.Join(layout, "index.json"), filepath.Join(layout, "blobs", "index.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateLayout(layout, nil, nil); err == nil {
+		t.Error("expected a missing index.json")
+	}
+}
@@ -15,6 +15,7 @@
 package image
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -24,30 +25,47 @@ import (
 	"strings"
 
 	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
 
 // ValidateLayout walks through the given file tree and validates the manifest
 // pointed to by the given refs or returns an error if the validation failed.
 func ValidateLayout(src string, refs []string, out *log.Logger) error {
-	return validate(newPathWalker(src), refs, out)
+	return ValidateLayoutContext(context.Background(), src, refs, out)
+}
+
+// ValidateLayoutContext is like ValidateLayout but stops as soon as ctx is
+// done.
+func ValidateLayoutContext(ctx context.Context, src string, refs []string, out *log.Logger) error {
+	return validate(ctx, newPathWalker(src), refs, out)
 }
 
 // ValidateZip walks through the given file tree and validates the manifest
 // pointed to by the given refs or returns an error if the validation failed.
 func ValidateZip(src string, refs []string, out *log.Logger) error {
-	return validate(newZipWalker(src), refs, out)
+	return ValidateZipContext(context.Background(), src, refs, out)
+}
+
+// ValidateZipContext is like ValidateZip but stops as soon as ctx is done.
+func ValidateZipContext(ctx context.Context, src string, refs []string, out *log.Logger) error {
+	return validate(ctx, newZipWalker(src), refs, out)
 }
 
 // ValidateFile opens the tar file given by the filename, then calls ValidateReader
 func ValidateFile(tarFile string, refs []string, out *log.Logger) error {
+	return ValidateFileContext(context.Background(), tarFile, refs, out)
+}
+
+// ValidateFileContext is like ValidateFile but stops as soon as ctx is done.
+func ValidateFileContext(ctx context.Context, tarFile string, refs []string, out *log.Logger) error {
 	f, err := os.Open(tarFile) // nolint: errcheck, gosec
 	if err != nil {
 		return errors.Wrap(err, "unable to open file")
 	}
 	defer f.Close()
 
-	return Validate(f, refs, out)
+	return ValidateContext(ctx, f, refs, out)
 }
 
 // Validate walks through a tar stream and validates the manifest.
@@ -56,7 +74,12 @@ func ValidateFile(tarFile string, refs []string, out *log.Logger) error {
 // * Checks that mime-types are correct
 // returns error on validation failure
 func Validate(r io.ReadSeeker, refs []string, out *log.Logger) error {
-	return validate(newTarWalker(r), refs, out)
+	return ValidateContext(context.Background(), r, refs, out)
+}
+
+// ValidateContext is like Validate but stops as soon as ctx is done.
+func ValidateContext(ctx context.Context, r io.ReadSeeker, refs []string, out *log.Logger) error {
+	return validate(ctx, newTarWalker(r), refs, out)
 }
 
 var validRefMediaTypes = []string{
@@ -64,17 +87,17 @@ var validRefMediaTypes = []string{
 	v1.MediaTypeImageIndex,
 }
 
-func validate(w walker, refs []string, out *log.Logger) error {
+func validate(ctx context.Context, w walker, refs []string, out *log.Logger) error {
 	var descs []v1.Descriptor
 	var err error
 
-	if err = layoutValidate(w); err != nil {
+	if err = layoutValidate(ctx, w); err != nil {
 		return err
 	}
 
 	if len(refs) == 0 {
 		out.Print("No ref specified, verify all refs")
-		descs, err = listReferences(w)
+		descs, err = listReferences(ctx, w)
 		if err != nil {
 			return err
 		}
@@ -86,7 +109,7 @@ func validate(w walker, refs []string, out *log.Logger) error {
 			return nil
 		}
 	} else {
-		descs, err = findDescriptor(w, refs)
+		descs, err = findDescriptor(ctx, w, refs)
 		if err != nil {
 			return err
 		}
@@ -94,43 +117,43 @@ func validate(w walker, refs []string, out *log.Logger) error {
 
 	for _, desc := range descs {
 		d := &desc
-		if err = validateDescriptor(d, w, validRefMediaTypes); err != nil {
+		if err = validateDescriptor(ctx, d, w, validRefMediaTypes); err != nil {
 			return err
 		}
 
 		if d.MediaType == validRefMediaTypes[0] {
-			m, err := findManifest(w, d)
+			m, err := findManifest(ctx, w, d)
 			if err != nil {
 				return err
 			}
 
-			if err := validateManifest(m, w); err != nil {
+			if err := validateManifest(ctx, m, w); err != nil {
 				return err
 			}
 		}
 
 		if d.MediaType == validRefMediaTypes[1] {
-			index, err := findIndex(w, d)
+			index, err := findIndex(ctx, w, d)
 			if err != nil {
 				return err
 			}
 
-			if err := validateIndex(index, w); err != nil {
+			if err := validateIndex(ctx, index, w); err != nil {
 				return err
 			}
 
 			if len(index.Manifests) == 0 {
-				fmt.Println("warning: no manifests found")
+				warnf(ctx, "no manifests found")
 				return nil
 			}
 
 			for _, manifest := range index.Manifests {
-				m, err := findManifest(w, &manifest)
+				m, err := findManifest(ctx, w, &manifest)
 				if err != nil {
 					return err
 				}
 
-				if err := validateManifest(m, w); err != nil {
+				if err := validateManifest(ctx, m, w); err != nil {
 					return err
 				}
 			}
@@ -148,25 +171,43 @@ func validate(w walker, refs []string, out *log.Logger) error {
 // specified in the manifest pointed to by the given ref, unpacks all layers in
 // the given destination directory or returns an error if the unpacking failed.
 func UnpackLayout(src, dest, platform string, refs []string) error {
-	return unpack(newPathWalker(src), dest, platform, refs)
+	return UnpackLayoutContext(context.Background(), src, dest, platform, refs)
+}
+
+// UnpackLayoutContext is like UnpackLayout but stops as soon as ctx is done,
+// cleaning up any partial output.
+func UnpackLayoutContext(ctx context.Context, src, dest, platform string, refs []string) error {
+	return unpack(ctx, newPathWalker(src), dest, platform, refs)
 }
 
 // UnpackZip opens and walks through the zip file given by src and, using the layers
 // specified in the manifest pointed to by the given ref, unpacks all layers in
 // the given destination directory or returns an error if the unpacking failed.
 func UnpackZip(src, dest, platform string, refs []string) error {
-	return unpack(newZipWalker(src), dest, platform, refs)
+	return UnpackZipContext(context.Background(), src, dest, platform, refs)
+}
+
+// UnpackZipContext is like UnpackZip but stops as soon as ctx is done,
+// cleaning up any partial output.
+func UnpackZipContext(ctx context.Context, src, dest, platform string, refs []string) error {
+	return unpack(ctx, newZipWalker(src), dest, platform, refs)
 }
 
 // UnpackFile opens the file pointed by tarFileName and calls Unpack on it.
 func UnpackFile(tarFileName, dest, platform string, refs []string) error {
+	return UnpackFileContext(context.Background(), tarFileName, dest, platform, refs)
+}
+
+// UnpackFileContext is like UnpackFile but stops as soon as ctx is done,
+// cleaning up any partial output.
+func UnpackFileContext(ctx context.Context, tarFileName, dest, platform string, refs []string) error {
 	f, err := os.Open(tarFileName) // nolint: errcheck, gosec
 	if err != nil {
 		return errors.Wrap(err, "unable to open file")
 	}
 	defer f.Close()
 
-	return Unpack(f, dest, platform, refs)
+	return UnpackContext(ctx, f, dest, platform, refs)
 }
 
 // Unpack walks through the tar stream and, using the layers specified in
@@ -174,146 +215,187 @@ func UnpackFile(tarFileName, dest, platform string, refs []string) error {
 // destination directory or returns an error if the unpacking failed.
 // The destination will be created if it does not exist.
 func Unpack(r io.ReadSeeker, dest, platform string, refs []string) error {
-	return unpack(newTarWalker(r), dest, platform, refs)
+	return UnpackContext(context.Background(), r, dest, platform, refs)
 }
 
-func unpack(w walker, dest, platform string, refs []string) error {
-	if err := layoutValidate(w); err != nil {
+// UnpackContext is like Unpack but stops as soon as ctx is done, cleaning up
+// any partial output.
+func UnpackContext(ctx context.Context, r io.ReadSeeker, dest, platform string, refs []string) error {
+	return unpack(ctx, newTarWalker(r), dest, platform, refs)
+}
+
+func unpack(ctx context.Context, w walker, dest, platform string, refs []string) error {
+	_, m, err := resolveManifest(ctx, w, platform, refs)
+	if err != nil {
 		return err
 	}
 
-	descs, err := findDescriptor(w, refs)
+	return unpackManifest(ctx, m, w, dest)
+}
+
+// resolveManifest validates the layout and returns the descriptor in
+// index.json selected by refs together with the manifest it resolves to.
+// If the descriptor points to an index, the manifest matching platform is
+// returned.
+func resolveManifest(ctx context.Context, w walker, platform string, refs []string) (*v1.Descriptor, *v1.Manifest, error) {
+	ref, _, m, err := resolveImage(ctx, w, platform, refs)
+	return ref, m, err
+}
+
+// resolveImage is like resolveManifest but also returns the descriptor of
+// the manifest, which is the one listed by the index if refs select one.
+func resolveImage(ctx context.Context, w walker, platform string, refs []string) (*v1.Descriptor, *v1.Descriptor, *v1.Manifest, error) {
+	if err := layoutValidate(ctx, w); err != nil {
+		return nil, nil, nil, err
+	}
+
+	descs, err := findDescriptor(ctx, w, refs)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	ref := &descs[0]
-	if err = validateDescriptor(ref, w, validRefMediaTypes); err != nil {
-		return err
+	if err = validateDescriptor(ctx, ref, w, validRefMediaTypes); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if keys := verifyKeys(ctx); len(keys) > 0 {
+		if _, err := verifySignatures(ctx, w, ref, keys); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
 	if ref.MediaType == validRefMediaTypes[0] {
-		m, err := findManifest(w, ref)
+		m, err := findManifest(ctx, w, ref)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
 
-		if err := validateManifest(m, w); err != nil {
-			return err
+		if err := validateManifest(ctx, m, w); err != nil {
+			return nil, nil, nil, err
 		}
 
-		return unpackManifest(m, w, dest)
+		if isArtifact(m) {
+			return nil, nil, nil, fmt.Errorf("%s is an artifact of type %q, not an image", ref.Digest, artifactType(m))
+		}
+
+		return ref, ref, m, nil
 	}
 
-	if ref.MediaType == validRefMediaTypes[1] {
-		index, err := findIndex(w, ref)
-		if err != nil {
-			return err
-		}
+	index, err := findIndex(ctx, w, ref)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		if err = validateIndex(index, w); err != nil {
-			return err
-		}
+	if err = validateIndex(ctx, index, w); err != nil {
+		return nil, nil, nil, err
+	}
 
-		manifests, err := filterManifest(w, index.Manifests, platform)
-		if err != nil {
-			return err
-		}
+	descs, manifests, err := filterManifest(ctx, w, index.Manifests, platform)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		for _, m := range manifests {
-			return unpackManifest(m, w, dest)
-		}
+	if len(manifests) == 0 {
+		return nil, nil, nil, fmt.Errorf("there is no matching manifest")
 	}
 
-	return nil
+	return ref, &descs[0], manifests[0], nil
 }
 
 // CreateRuntimeBundleLayout walks through the file tree given by src and
 // creates an OCI runtime bundle in the given destination dest
 // or returns an error if the unpacking failed.
 func CreateRuntimeBundleLayout(src, dest, root, platform string, refs []string) error {
-	return createRuntimeBundle(newPathWalker(src), dest, root, platform, refs)
+	return CreateRuntimeBundleLayoutWithOptions(src, dest, root, platform, refs, nil)
+}
+
+// CreateRuntimeBundleLayoutWithOptions is like CreateRuntimeBundleLayout
+// but creates the bundle with the settings of opts.
+func CreateRuntimeBundleLayoutWithOptions(src, dest, root, platform string, refs []string, opts *BundleOptions) error {
+	return CreateRuntimeBundleLayoutContext(context.Background(), src, dest, root, platform, refs, opts)
+}
+
+// CreateRuntimeBundleLayoutContext is like
+// CreateRuntimeBundleLayoutWithOptions but stops as soon as ctx is done,
+// cleaning up any partial output.
+func CreateRuntimeBundleLayoutContext(ctx context.Context, src, dest, root, platform string, refs []string, opts *BundleOptions) error {
+	return createRuntimeBundle(ctx, newPathWalker(src), dest, root, platform, refs, opts)
 }
 
 // CreateRuntimeBundleZip opens and walks through the zip file given by src
 // and creates an OCI runtime bundle in the given destination dest
 // or returns an error if the unpacking failed.
 func CreateRuntimeBundleZip(src, dest, root, platform string, refs []string) error {
-	return createRuntimeBundle(newZipWalker(src), dest, root, platform, refs)
+	return CreateRuntimeBundleZipWithOptions(src, dest, root, platform, refs, nil)
+}
+
+// CreateRuntimeBundleZipWithOptions is like CreateRuntimeBundleZip but
+// creates the bundle with the settings of opts.
+func CreateRuntimeBundleZipWithOptions(src, dest, root, platform string, refs []string, opts *BundleOptions) error {
+	return CreateRuntimeBundleZipContext(context.Background(), src, dest, root, platform, refs, opts)
+}
+
+// CreateRuntimeBundleZipContext is like CreateRuntimeBundleZipWithOptions
+// but stops as soon as ctx is done, cleaning up any partial output.
+func CreateRuntimeBundleZipContext(ctx context.Context, src, dest, root, platform string, refs []string, opts *BundleOptions) error {
+	return createRuntimeBundle(ctx, newZipWalker(src), dest, root, platform, refs, opts)
 }
 
 // CreateRuntimeBundleFile opens the file pointed by tarFile and calls
 // CreateRuntimeBundle.
 func CreateRuntimeBundleFile(tarFile, dest, root, platform string, refs []string) error {
+	return CreateRuntimeBundleFileWithOptions(tarFile, dest, root, platform, refs, nil)
+}
+
+// CreateRuntimeBundleFileWithOptions is like CreateRuntimeBundleFile but
+// creates the bundle with the settings of opts.
+func CreateRuntimeBundleFileWithOptions(tarFile, dest, root, platform string, refs []string, opts *BundleOptions) error {
+	return CreateRuntimeBundleFileContext(context.Background(), tarFile, dest, root, platform, refs, opts)
+}
+
+// CreateRuntimeBundleFileContext is like CreateRuntimeBundleFileWithOptions
+// but stops as soon as ctx is done, cleaning up any partial output.
+func CreateRuntimeBundleFileContext(ctx context.Context, tarFile, dest, root, platform string, refs []string, opts *BundleOptions) error {
 	f, err := os.Open(tarFile) // nolint: errcheck, gosec
 	if err != nil {
 		return errors.Wrap(err, "unable to open file")
 	}
 	defer f.Close()
 
-	return createRuntimeBundle(newTarWalker(f), dest, root, platform, refs)
+	return createRuntimeBundle(ctx, newTarWalker(f), dest, root, platform, refs, opts)
 }
 
 // CreateRuntimeBundle walks through the given tar stream and
 // creates an OCI runtime bundle in the given destination dest
 // or returns an error if the unpacking failed.
 func CreateRuntimeBundle(r io.ReadSeeker, dest, root, platform string, refs []string) error {
-	return createRuntimeBundle(newTarWalker(r), dest, root, platform, refs)
+	return CreateRuntimeBundleWithOptions(r, dest, root, platform, refs, nil)
 }
 
-func createRuntimeBundle(w walker, dest, rootfs, platform string, refs []string) error {
-	if err := layoutValidate(w); err != nil {
-		return err
-	}
+// CreateRuntimeBundleWithOptions is like CreateRuntimeBundle but creates the
+// bundle with the settings of opts.
+func CreateRuntimeBundleWithOptions(r io.ReadSeeker, dest, root, platform string, refs []string, opts *BundleOptions) error {
+	return CreateRuntimeBundleContext(context.Background(), r, dest, root, platform, refs, opts)
+}
 
-	descs, err := findDescriptor(w, refs)
-	if err != nil {
-		return err
-	}
+// CreateRuntimeBundleContext is like CreateRuntimeBundleWithOptions but
+// stops as soon as ctx is done, cleaning up any partial output.
+func CreateRuntimeBundleContext(ctx context.Context, r io.ReadSeeker, dest, root, platform string, refs []string, opts *BundleOptions) error {
+	return createRuntimeBundle(ctx, newTarWalker(r), dest, root, platform, refs, opts)
+}
 
-	ref := &descs[0]
-	if err = validateDescriptor(ref, w, validRefMediaTypes); err != nil {
+func createRuntimeBundle(ctx context.Context, w walker, dest, rootfs, platform string, refs []string, opts *BundleOptions) error {
+	_, m, err := resolveManifest(ctx, w, platform, refs)
+	if err != nil {
 		return err
 	}
 
-	if ref.MediaType == validRefMediaTypes[0] {
-		m, err := findManifest(w, ref)
-		if err != nil {
-			return err
-		}
-
-		if err := validateManifest(m, w); err != nil {
-			return err
-		}
-
-		return createBundle(w, m, dest, rootfs)
-	}
-
-	if ref.MediaType == validRefMediaTypes[1] {
-		index, err := findIndex(w, ref)
-		if err != nil {
-			return err
-		}
-
-		if err = validateIndex(index, w); err != nil {
-			return err
-		}
-
-		manifests, err := filterManifest(w, index.Manifests, platform)
-		if err != nil {
-			return err
-		}
-
-		for _, m := range manifests {
-			return createBundle(w, m, dest, rootfs)
-		}
-	}
-
-	return nil
+	return createBundle(ctx, w, m, dest, rootfs, opts)
 }
 
-func createBundle(w walker, m *v1.Manifest, dest, rootfs string) (retErr error) {
-	c, err := findConfig(w, &m.Config)
+func createBundle(ctx context.Context, w walker, m *v1.Manifest, dest, rootfs string, opts *BundleOptions) (retErr error) {
+	c, err := findConfig(ctx, w, &m.Config)
 	if err != nil {
 		return err
 	}
@@ -326,7 +408,7 @@ func createBundle(w walker, m *v1.Manifest, dest, rootfs string) (retErr error)
 			defer func() {
 				if retErr != nil {
 					if err3 := os.RemoveAll(dest); err3 != nil {
-						fmt.Printf("Failed to clean up %q: %s\n", dest, err3.Error())
+						warnf(ctx, "failed to clean up %q: %v", dest, err3)
 					}
 				}
 			}()
@@ -335,15 +417,35 @@ func createBundle(w walker, m *v1.Manifest, dest, rootfs string) (retErr error)
 		}
 	}
 
-	if err = unpackManifest(m, w, filepath.Join(dest, rootfs)); err != nil {
+	if c.OS == "windows" {
+		err = unpackWindowsLayers(ctx, w, m, c, dest)
+	} else {
+		err = unpackManifest(ctx, m, w, filepath.Join(dest, rootfs))
+	}
+	if err != nil {
 		return err
 	}
 
-	spec, err := runtimeSpec(c, rootfs)
+	var template *specs.Spec
+	if opts != nil {
+		template = opts.Template
+	}
+
+	spec, err := runtimeSpec(c, dest, rootfs, template)
 	if err != nil {
 		return err
 	}
 
+	volumes, err := volumeMounts(ctx, c, dest, rootfs, opts)
+	if err != nil {
+		return err
+	}
+	spec.Mounts = append(spec.Mounts, volumes...)
+
+	if err = applyOverrides(spec, opts); err != nil {
+		return err
+	}
+
 	f, err := os.Create(filepath.Join(dest, "config.json"))
 	if err != nil {
 		return err
@@ -353,37 +455,47 @@ func createBundle(w walker, m *v1.Manifest, dest, rootfs string) (retErr error)
 	return json.NewEncoder(f).Encode(spec)
 }
 
-// filertManifest returns a filtered list of manifests
-func filterManifest(w walker, Manifests []v1.Descriptor, platform string) ([]*v1.Manifest, error) {
-	var manifests []*v1.Manifest
+// filterManifest returns the descriptors of Manifests matching platform
+// together with the manifests they point to.
+func filterManifest(ctx context.Context, w walker, Manifests []v1.Descriptor, platform string) ([]v1.Descriptor, []*v1.Manifest, error) {
+	var (
+		descs     []v1.Descriptor
+		manifests []*v1.Manifest
+	)
 
 	argsParts := strings.Split(platform, ":")
 	if len(argsParts) != 2 {
-		return manifests, fmt.Errorf("platform must have os and arch when reftype is index")
+		return descs, manifests, fmt.Errorf("platform must have os and arch when reftype is index")
 	}
 
 	if len(Manifests) == 0 {
-		fmt.Println("warning: no manifests found")
-		return manifests, nil
+		warnf(ctx, "no manifests found")
+		return descs, manifests, nil
 	}
 
 	for _, manifest := range Manifests {
-		m, err := findManifest(w, &manifest)
+		m, err := findManifest(ctx, w, &manifest)
 		if err != nil {
-			return manifests, err
+			return descs, manifests, err
+		}
+
+		if err := validateManifest(ctx, m, w); err != nil {
+			return descs, manifests, err
 		}
 
-		if err := validateManifest(m, w); err != nil {
-			return manifests, err
+		// artifacts such as signatures do not run on any platform
+		if manifest.Platform == nil || isArtifact(m) {
+			continue
 		}
 		if strings.EqualFold(manifest.Platform.OS, argsParts[0]) && strings.EqualFold(manifest.Platform.Architecture, argsParts[1]) {
+			descs = append(descs, manifest)
 			manifests = append(manifests, m)
 		}
 	}
 
 	if len(manifests) == 0 {
-		return manifests, fmt.Errorf("there is no matching manifest")
+		return descs, manifests, fmt.Errorf("there is no matching manifest")
 	}
 
-	return manifests, nil
+	return descs, manifests, nil
 }
@@ -18,6 +18,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -28,6 +29,7 @@ import (
 
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -461,3 +463,213 @@ func newDescriptor(name string) (v1.Descriptor, error) {
 		Size:   size,
 	}, nil
 }
+
+// plainLayer returns a plain tar layer holding regular files with the given
+// names, each containing its own name.
+func plainLayer(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(name)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// createTestImage writes an image made of config and the plain layers to
+// the image layout at root, under the ref name ref. The diff_ids of config
+// are set from the layers.
+func createTestImage(t *testing.T, root, ref string, config *v1.Image, layers ...[]byte) v1.Descriptor {
+	lw, err := newLayoutWriter(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest v1.Manifest
+	manifest.SchemaVersion = 2
+	config.RootFS = v1.RootFS{Type: "layers"}
+	for _, layer := range layers {
+		d, size, err := lw.putBlob(bytes.NewReader(layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{MediaType: v1.MediaTypeImageLayer, Digest: d, Size: size})
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, d)
+	}
+
+	if manifest.Config, err = lw.putJSON(v1.MediaTypeImageConfig, config); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := lw.putJSON(v1.MediaTypeImageManifest, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc.Annotations = map[string]string{v1.AnnotationRefName: ref}
+
+	index, err := lw.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addReference(index, desc)
+	if err := lw.writeIndex(index); err != nil {
+		t.Fatal(err)
+	}
+
+	return desc
+}
+
+// createTestArtifact adds the artifact manifest m to the image layout root,
+// under the ref name ref if not empty.
+func createTestArtifact(t *testing.T, root, ref string, m v1.Manifest) v1.Descriptor {
+	lw, err := newLayoutWriter(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SchemaVersion = 2
+	m.MediaType = v1.MediaTypeImageManifest
+	desc, err := lw.putJSON(v1.MediaTypeImageManifest, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc.ArtifactType = m.ArtifactType
+	if ref != "" {
+		desc.Annotations = map[string]string{v1.AnnotationRefName: ref}
+	}
+
+	index, err := lw.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addReference(index, desc)
+	if err := lw.writeIndex(index); err != nil {
+		t.Fatal(err)
+	}
+
+	return desc
+}
+
+func TestUnpackContextCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "etc/hostname"),
+		plainLayer(t, "bin/sh"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel once the first layer has been extracted
+	ctx = WithEventSink(ctx, EventSinkFunc(func(e Event) {
+		if e.Type == EventLayerFinished {
+			cancel()
+		}
+	}))
+
+	dest := filepath.Join(root, "rootfs")
+	err = UnpackLayoutContext(ctx, layout, dest, "", []string{"name=latest"})
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// the partially unpacked destination is removed
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", dest, err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	err = CreateRuntimeBundleLayoutContext(ctx, layout, bundle, "rootfs", "", []string{"name=latest"}, nil)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(bundle); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", bundle, err)
+	}
+}
+
+func TestUnpackStaging(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "etc/hostname"),
+		plainLayer(t, "bin/sh"),
+	)
+
+	dest := filepath.Join(root, "rootfs")
+	if err := os.Mkdir(dest, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = WithEventSink(ctx, EventSinkFunc(func(e Event) {
+		if e.Type == EventLayerFinished {
+			cancel()
+		}
+	}))
+
+	// a failed unpack keeps the existing destination as it was
+	err = UnpackLayoutContext(ctx, layout, dest, "", []string{"name=latest"})
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	entries, err := ioutil.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected %s to be empty, got %d entries", dest, len(entries))
+	}
+
+	if err := UnpackLayout(layout, dest, "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/hostname", "bin/sh"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expected the permissions of %s to be kept, got %v", dest, info.Mode())
+	}
+
+	// no staging directory is left behind
+	siblings, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range siblings {
+		if strings.HasPrefix(s.Name(), ".") {
+			t.Errorf("unexpected staging directory %s", s.Name())
+		}
+	}
+
+	// a non-empty destination is refused
+	if err := UnpackLayout(layout, dest, "", []string{"name=latest"}); err == nil {
+		t.Errorf("expected an error unpacking to the non-empty %s", dest)
+	}
+}
@@ -16,6 +16,7 @@ package image
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -28,11 +29,11 @@ import (
 	"github.com/pkg/errors"
 )
 
-func findIndex(w walker, d *v1.Descriptor) (*v1.Index, error) {
+func findIndex(ctx context.Context, w walker, d *v1.Descriptor) (*v1.Index, error) {
 	var index v1.Index
 	ipath := filepath.Join("blobs", string(d.Digest.Algorithm()), d.Digest.Hex())
 
-	switch err := w.walk(func(path string, info os.FileInfo, r io.Reader) error {
+	switch err := w.walk(ctx, func(path string, info os.FileInfo, r io.Reader) error {
 		if info.IsDir() || filepath.Clean(path) != ipath {
 			return nil
 		}
@@ -51,7 +52,7 @@ func findIndex(w walker, d *v1.Descriptor) (*v1.Index, error) {
 		}
 
 		return errEOW
-	}); err {
+	}); errors.Cause(err) {
 	case errEOW:
 		return &index, nil
 	case nil:
@@ -61,11 +62,22 @@ func findIndex(w walker, d *v1.Descriptor) (*v1.Index, error) {
 	}
 }
 
-func validateIndex(index *v1.Index, w walker) error {
+func validateIndex(ctx context.Context, index *v1.Index, w walker) error {
+	if index.MediaType != "" && index.MediaType != v1.MediaTypeImageIndex {
+		return fmt.Errorf("invalid index MediaType %q", index.MediaType)
+	}
+
 	for _, manifest := range index.Manifests {
-		if err := validateDescriptor(&manifest, w, []string{v1.MediaTypeImageManifest}); err != nil {
+		if err := validateDescriptor(ctx, &manifest, w, []string{v1.MediaTypeImageManifest}); err != nil {
 			return errors.Wrap(err, "manifest validation failed")
 		}
 	}
+
+	if index.Subject != nil {
+		if err := validateSubject(index.Subject); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,215 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// whiteoutPrefix prefixes the name of the entries deleting the file of
+	// the same name from the lower layers.
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaqueDir is the entry hiding the content of its directory
+	// in the lower layers.
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// ChangeKind is the kind of a Change.
+type ChangeKind int
+
+// Change kinds.
+const (
+	// ChangeAdd is a path created by the layer.
+	ChangeAdd ChangeKind = iota
+
+	// ChangeModify is an existing path replaced or updated by the layer.
+	ChangeModify
+
+	// ChangeDelete is an existing path removed by a whiteout.
+	ChangeDelete
+)
+
+// String returns the one letter code of the kind, as shown by "docker diff".
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeModify:
+		return "C"
+	case ChangeDelete:
+		return "D"
+	default:
+		return fmt.Sprintf("ChangeKind(%d)", int(k))
+	}
+}
+
+// Change is a change made to a root filesystem by a layer.
+type Change struct {
+	Kind ChangeKind
+
+	// Path is the absolute path of the change inside the root filesystem,
+	// with forward slashes.
+	Path string
+}
+
+// String returns the kind and the path of the change.
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s", c.Kind, c.Path)
+}
+
+// recordChange appends the change of path in dest to changes, if not nil.
+func recordChange(changes *[]Change, dest, path string, kind ChangeKind) {
+	if changes == nil {
+		return
+	}
+
+	rel, err := filepath.Rel(dest, path)
+	if err != nil {
+		rel = path
+	}
+	*changes = append(*changes, Change{Kind: kind, Path: "/" + filepath.ToSlash(rel)})
+}
+
+// removeOpaque removes the content of dir coming from the lower layers,
+// that is every path not in the entries of the current layer.
+func removeOpaque(dest, dir string, entries map[string]bool, changes *[]Change) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if entries[path] {
+			if info.IsDir() {
+				if err := removeOpaque(dest, path, entries, changes); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		recordChange(changes, dest, path, ChangeDelete)
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrap(err, "unable to delete opaque directory content")
+		}
+	}
+
+	return nil
+}
+
+// ApplyLayerOptions are the options of ApplyLayer.
+type ApplyLayerOptions struct {
+	// Digest is the digest of the layer. If set, the layer is checked
+	// against it before being applied.
+	Digest digest.Digest
+}
+
+// ApplyLayer applies the layer read from r, of the given media type, on top
+// of the existing root filesystem rootfs, including its whiteouts, and
+// returns the changes made to rootfs. The media type may be empty, the
+// compression is detected from the content.
+//
+// With opts.Digest, the layer is first copied to a temporary file and
+// checked, so that rootfs is left untouched if it does not match. Otherwise
+// the layer is applied as it is read: if it turns out to be invalid, rootfs
+// is left partially updated.
+func ApplyLayer(rootfs string, r io.Reader, mediaType string, opts *ApplyLayerOptions) ([]Change, error) {
+	return ApplyLayerContext(context.Background(), rootfs, r, mediaType, opts)
+}
+
+// ApplyLayerContext is like ApplyLayer but stops as soon as ctx is done.
+func ApplyLayerContext(ctx context.Context, rootfs string, r io.Reader, mediaType string, opts *ApplyLayerOptions) ([]Change, error) {
+	if opts == nil {
+		opts = &ApplyLayerOptions{}
+	}
+
+	info, err := os.Stat(rootfs)
+	if err != nil {
+		return nil, errors.Wrap(err, "apply layer")
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("apply layer: %s is not a directory", rootfs)
+	}
+
+	desc := v1.Descriptor{MediaType: mediaType, Digest: opts.Digest}
+	if opts.Digest != "" {
+		if err := validateDigest(opts.Digest); err != nil {
+			return nil, errors.Wrap(err, "apply layer")
+		}
+
+		f, err := spoolLayer(ctx, r, opts.Digest)
+		if err != nil {
+			return nil, errors.Wrap(err, "apply layer")
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		r = f
+	}
+
+	var changes []Change
+	p := newLayerProgress(ctx, desc, r)
+	if err := applyLayer(ctx, mediaType, "layer", rootfs, p, &changes); err != nil {
+		return changes, errors.Wrap(err, "apply layer")
+	}
+
+	// the progress covers the padding after the end of the archive
+	if _, err := io.Copy(ioutil.Discard, p); err != nil {
+		return changes, errors.Wrap(err, "apply layer")
+	}
+	p.finish()
+
+	return changes, nil
+}
+
+// spoolLayer copies the layer read from r to a new temporary file, checks
+// it against d and returns the file, rewound. The caller removes it.
+func spoolLayer(ctx context.Context, r io.Reader, d digest.Digest) (*os.File, error) {
+	f, err := ioutil.TempFile("", "oci-layer-")
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := d.Verifier()
+	_, err = io.Copy(io.MultiWriter(f, verifier), ctxReader{ctx, r})
+	if err == nil && !verifier.Verified() {
+		err = fmt.Errorf("layer does not match digest %s", d)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
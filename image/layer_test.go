@@ -0,0 +1,232 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestApplyLayer(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	base := plainLayer(t, "etc/hostname", "etc/hosts", "var/cache/x", "var/lib/old")
+	changes, err := ApplyLayer(rootfs, bytes.NewReader(base), v1.MediaTypeImageLayer, &ApplyLayerOptions{Digest: digest.FromBytes(base)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Errorf("expected 4 changes, got %v", changes)
+	}
+
+	// a symlink of the rootfs must not let entries escape it
+	if err := os.Symlink("/", filepath.Join(rootfs, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := plainLayer(t, "etc/hostname", "etc/new", "etc/.wh.hosts", "var/.wh..wh..opq", "var/lib/kept", "escape/outside")
+	changes, err = ApplyLayer(rootfs, bytes.NewReader(layer), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Change{
+		{ChangeModify, "/etc/hostname"},
+		{ChangeAdd, "/etc/new"},
+		{ChangeDelete, "/etc/hosts"},
+		{ChangeDelete, "/var/cache"},
+		{ChangeDelete, "/var/lib"},
+		{ChangeAdd, "/var/lib/kept"},
+		{ChangeAdd, "/outside"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+
+	for _, name := range []string{"etc/hostname", "etc/new", "var/lib/kept", "outside"} {
+		if _, err := os.Stat(filepath.Join(rootfs, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range []string{"etc/hosts", "etc/.wh.hosts", "var/cache", "var/lib/old", "var/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: expected not to exist", name)
+		}
+	}
+
+	// a mismatching layer is not applied at all
+	if _, err := ApplyLayer(rootfs, bytes.NewReader(base), "", &ApplyLayerOptions{Digest: digest.FromBytes(layer)}); err == nil {
+		t.Error("expected a digest mismatch")
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "etc", "hosts")); !os.IsNotExist(err) {
+		t.Error("expected a mismatching layer not to be applied")
+	}
+}
+
+func TestApplyLayerSymlinkEscape(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// <rootfs>/../../pwned is still inside root
+	rootfs := filepath.Join(root, "a", "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	host := filepath.Join(root, "host")
+	if err := os.Mkdir(host, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/b/c/d/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "a/b/c/d/l1", Typeflag: tar.TypeSymlink, Linkname: "/missing/../../../pwned", Mode: 0777},
+		{Name: "a/b/c/d/l1/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: host, Mode: 0777},
+		{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "nonexistent/../evil", Mode: 0777},
+		{Name: "x/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("pwned")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ApplyLayer(rootfs, &buf, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{filepath.Join(root, "pwned"), filepath.Join(host, "file")} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("expected the layer not to escape rootfs to %s", name)
+		}
+	}
+	for _, name := range []string{filepath.Join(rootfs, "pwned", "file"), filepath.Join(rootfs, host, "file")} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWriteLayerReproducible(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// build the same tree twice, at different times
+	build := func(name string, mtime time.Time) string {
+		dir := filepath.Join(root, name)
+		for _, file := range []string{"usr/bin/app", "etc/app.conf", "etc/a/b"} {
+			path := filepath.Join(dir, file)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("app", filepath.Join(dir, "usr", "bin", "app-link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode()&os.ModeSymlink != 0 {
+				return err
+			}
+			return os.Chtimes(path, mtime, mtime)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	epoch := time.Unix(1500000000, 0).UTC()
+	first := build("first", time.Now().Add(-time.Hour))
+	second := build("second", time.Now())
+
+	opts := &LayerOptions{Gzip: true, Reproducible: true, SourceDateEpoch: &epoch}
+	var buf1, buf2 bytes.Buffer
+	diffID1, err := WriteLayer(first, &buf1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID2, err := WriteLayer(second, &buf2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffID1 != diffID2 {
+		t.Errorf("expected the same diff_id, got %s and %s", diffID1, diffID2)
+	}
+	if d1, d2 := digest.FromBytes(buf1.Bytes()), digest.FromBytes(buf2.Bytes()); d1 != d2 {
+		t.Errorf("expected the same digest, got %s and %s", d1, d2)
+	}
+
+	gz, err := gzip.NewReader(&buf1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if !hdr.ModTime.Equal(epoch) || hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: expected a normalized header, got %+v", hdr.Name, hdr)
+		}
+	}
+
+	expected := []string{"etc/", "etc/a/", "etc/a/b", "etc/app.conf", "usr/", "usr/bin/", "usr/bin/app", "usr/bin/app-link"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected entries %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// SourceDateEpochEnv is the environment variable holding the timestamp,
+// in seconds since the epoch, that reproducible layers clamp their
+// modification times to, as defined by reproducible-builds.org.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// SourceDateEpoch returns the time set by SourceDateEpochEnv, or nil if it
+// is unset.
+func SourceDateEpoch() (*time.Time, error) {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return nil, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s=%q is not a number of seconds", SourceDateEpochEnv, value)
+	}
+
+	t := time.Unix(seconds, 0).UTC()
+	return &t, nil
+}
+
+// LayerOptions are the options of WriteLayer.
+type LayerOptions struct {
+	// Gzip compresses the layer.
+	Gzip bool
+
+	// Reproducible makes the layer depend on the content of the tree
+	// only: modification times are truncated to the second and clamped
+	// to SourceDateEpoch, owners are root, and access and change times,
+	// user and group names are left out.
+	Reproducible bool
+
+	// SourceDateEpoch clamps the modification times of a reproducible
+	// layer. If nil, they are not clamped.
+	SourceDateEpoch *time.Time
+
+	// Algorithm is the digest algorithm of the diff_id, sha256 if empty.
+	Algorithm digest.Algorithm
+}
+
+// WriteLayer writes the directory tree dir to w as a layer, and returns its
+// diff_id, the digest of the uncompressed tar archive. Entries are written
+// in lexical order, directories before their content. Hard links are
+// written as separate regular files, and sockets are left out with a
+// warning.
+func WriteLayer(dir string, w io.Writer, opts *LayerOptions) (digest.Digest, error) {
+	return WriteLayerContext(context.Background(), dir, w, opts)
+}
+
+// WriteLayerContext is like WriteLayer but stops as soon as ctx is done.
+func WriteLayerContext(ctx context.Context, dir string, w io.Writer, opts *LayerOptions) (digest.Digest, error) {
+	if opts == nil {
+		opts = &LayerOptions{}
+	}
+
+	algorithm := opts.Algorithm
+	if algorithm == "" {
+		algorithm = digest.Canonical
+	}
+	if err := CheckAlgorithm(algorithm); err != nil {
+		return "", err
+	}
+
+	var gz *gzip.Writer
+	if opts.Gzip {
+		// the gzip header has no name, modification time nor OS
+		// dependent content, so the output only depends on the input
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	diffID := algorithm.Digester()
+	tw := tar.NewWriter(io.MultiWriter(w, diffID.Hash()))
+
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSocket != 0 {
+			warnf(ctx, "%s: skipping socket", path)
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "%s", path)
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if opts.Reproducible {
+			normalizeHeader(hdr, opts.SourceDateEpoch)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			return copyFile(tw, path)
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return "", err
+		}
+	}
+
+	return diffID.Digest(), nil
+}
+
+// normalizeHeader removes the metadata of hdr which does not come from the
+// content of the tree, and clamps its modification time to epoch if not
+// nil.
+func normalizeHeader(hdr *tar.Header, epoch *time.Time) {
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second).UTC()
+	if epoch != nil && hdr.ModTime.After(*epoch) {
+		hdr.ModTime = *epoch
+	}
+
+	// PAX headers are only written for the fields which do not fit in a
+	// USTAR header, such as long names, with their records sorted
+	hdr.Format = tar.FormatPAX
+	hdr.PAXRecords = nil
+	hdr.Xattrs = nil
+}
@@ -16,24 +16,28 @@ package image
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/opencontainers/image-spec/schema"
 	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
-func layoutValidate(w walker) error {
+func layoutValidate(ctx context.Context, w walker) error {
 	var blobsExist, indexExist, layoutExist bool
 
-	if err := w.walk(func(path string, info os.FileInfo, r io.Reader) error {
-		if strings.EqualFold(filepath.Base(path), "blobs") {
+	if err := w.walk(ctx, func(path string, info os.FileInfo, r io.Reader) error {
+		// only the top-level entries count, a nested index.json is a blob
+		// or a stray file
+		path = filepath.Clean(path)
+
+		if path == "blobs" {
 			blobsExist = true
 			if !info.IsDir() {
 				return fmt.Errorf("blobs is not a directory")
@@ -42,7 +46,7 @@ func layoutValidate(w walker) error {
 			return nil
 		}
 
-		if strings.EqualFold(filepath.Base(path), "index.json") {
+		if path == indexPath {
 			indexExist = true
 			if info.IsDir() {
 				return fmt.Errorf("index.json is a directory")
@@ -60,7 +64,7 @@ func layoutValidate(w walker) error {
 			return nil
 		}
 
-		if strings.EqualFold(filepath.Base(path), "oci-layout") {
+		if path == v1.ImageLayoutFile {
 			layoutExist = true
 			if info.IsDir() {
 				return fmt.Errorf("oci-layout is a directory")
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -32,14 +33,13 @@ import (
 	"github.com/opencontainers/image-spec/schema"
 	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
-func findManifest(w walker, d *v1.Descriptor) (*v1.Manifest, error) {
+func findManifest(ctx context.Context, w walker, d *v1.Descriptor) (*v1.Manifest, error) {
 	var m v1.Manifest
 	mpath := filepath.Join("blobs", string(d.Digest.Algorithm()), d.Digest.Hex())
 
-	switch err := w.find(mpath, func(path string, r io.Reader) error {
+	switch err := w.find(ctx, mpath, func(path string, r io.Reader) error {
 		buf, err := ioutil.ReadAll(r)
 		if err != nil {
 			return errors.Wrapf(err, "%s: error reading manifest", path)
@@ -54,7 +54,7 @@ func findManifest(w walker, d *v1.Descriptor) (*v1.Manifest, error) {
 		}
 
 		return errEOW
-	}); err {
+	}); errors.Cause(err) {
 	case nil:
 		return nil, fmt.Errorf("%s: manifest not found", mpath)
 	case errEOW:
@@ -64,75 +64,159 @@ func findManifest(w walker, d *v1.Descriptor) (*v1.Manifest, error) {
 	}
 }
 
-func validateManifest(m *v1.Manifest, w walker) error {
-	if err := validateDescriptor(&m.Config, w, []string{v1.MediaTypeImageConfig}); err != nil {
-		return errors.Wrap(err, "config validation failed")
+func validateManifest(ctx context.Context, m *v1.Manifest, w walker) error {
+	if m.MediaType != "" && m.MediaType != v1.MediaTypeImageManifest {
+		return fmt.Errorf("invalid manifest MediaType %q", m.MediaType)
+	}
+
+	if m.Config.MediaType == v1.MediaTypeEmptyJSON && m.ArtifactType == "" {
+		return errors.New("artifactType must be set when the config is empty")
+	}
+
+	// artifacts carry any config and layers, only images are unpacked
+	var configMediaTypes, layerMediaTypes []string
+	if !isArtifact(m) {
+		configMediaTypes = []string{v1.MediaTypeImageConfig}
+		layerMediaTypes = []string{
+			v1.MediaTypeImageLayer,
+			v1.MediaTypeImageLayerGzip,
+			v1.MediaTypeImageLayerNonDistributable,
+			v1.MediaTypeImageLayerNonDistributableGzip,
+		}
 	}
 
-	validLayerMediaTypes := []string{
-		v1.MediaTypeImageLayer,
-		v1.MediaTypeImageLayerGzip,
-		v1.MediaTypeImageLayerNonDistributable,
-		v1.MediaTypeImageLayerNonDistributableGzip,
+	if err := validateDescriptor(ctx, &m.Config, w, configMediaTypes); err != nil {
+		return errors.Wrap(err, "config validation failed")
 	}
 
 	for _, d := range m.Layers {
-		if err := validateDescriptor(&d, w, validLayerMediaTypes); err != nil {
+		if err := validateDescriptor(ctx, &d, w, layerMediaTypes); err != nil {
 			return errors.Wrap(err, "layer validation failed")
 		}
 	}
 
+	if m.Subject != nil {
+		if err := validateSubject(m.Subject); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func unpackManifest(m *v1.Manifest, w walker, dest string) (retErr error) {
-	// error out if the dest directory is not empty
-	s, err := ioutil.ReadDir(dest)
-	if err != nil && !os.IsNotExist(err) { // We'll create the dir later
-		return errors.Wrap(err, "unpack: unable to open dest") // err contains dest
+// isArtifact returns whether m describes an artifact rather than an image,
+// that is whether its config is not an image config.
+func isArtifact(m *v1.Manifest) bool {
+	return m.Config.MediaType != v1.MediaTypeImageConfig
+}
+
+// artifactType returns the type of the artifact described by m: its
+// artifactType, or the media type of its config.
+func artifactType(m *v1.Manifest) string {
+	if m.ArtifactType != "" {
+		return m.ArtifactType
 	}
-	if len(s) > 0 {
-		return fmt.Errorf("%s is not empty", dest)
-	}
-	defer func() {
-		// if we encounter error during unpacking
-		// clean up the partially-unpacked destination
-		if retErr != nil {
-			if err := os.RemoveAll(dest); err != nil {
-				fmt.Printf("Error: failed to remove partially-unpacked destination %v", err)
-			}
-		}
-	}()
+	return m.Config.MediaType
+}
+
+// unpackManifest extracts the layers of m to dest, which must be empty or
+// absent. The layers are extracted to a staging directory next to dest,
+// renamed to dest only once complete, so dest is either complete or left
+// as it was.
+func unpackManifest(ctx context.Context, m *v1.Manifest, w walker, dest string) error {
+	staging, err := stageDir(dest)
+	if err != nil {
+		return errors.Wrap(err, "unpack")
+	}
+	defer os.RemoveAll(staging)
+
 	for _, d := range m.Layers {
 		lpath := filepath.Join("blobs", string(d.Digest.Algorithm()), d.Digest.Hex())
-		switch err := w.find(lpath, func(path string, r io.Reader) error {
-			if err := unpackLayer(d.MediaType, path, dest, r); err != nil {
+		switch err := w.find(ctx, lpath, func(path string, r io.Reader) error {
+			p := newLayerProgress(ctx, d, r)
+			if err := unpackLayer(ctx, d.MediaType, path, staging, p); err != nil {
 				return errors.Wrap(err, "unpack: error extracting layer")
 			}
+			p.finish()
 
 			return errEOW
-		}); err {
+		}); errors.Cause(err) {
 		case nil:
-			return fmt.Errorf("%s: layer not found", dest)
+			return fmt.Errorf("%s: layer not found", lpath)
 		case errEOW:
 		default:
 			return err
 		}
 	}
+
+	return errors.Wrap(commitDir(staging, dest), "unpack")
+}
+
+// stageDir returns a new staging directory next to dest, to be renamed to
+// dest by commitDir. It fails if dest is not an empty directory or absent.
+func stageDir(dest string) (string, error) {
+	s, err := ioutil.ReadDir(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "unable to open dest") // err contains dest
+	}
+	if len(s) > 0 {
+		return "", fmt.Errorf("%s is not empty", dest)
+	}
+
+	dest = filepath.Clean(dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	return ioutil.TempDir(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp-")
+}
+
+// commitDir renames the staging directory to dest. An existing dest must
+// be an empty directory, its permissions are kept. If the rename fails,
+// dest is left as it was.
+func commitDir(staging, dest string) error {
+	info, err := os.Stat(dest)
+	if err != nil {
+		if err := os.Chmod(staging, 0755); err != nil {
+			return err
+		}
+		return os.Rename(staging, dest)
+	}
+
+	mode := info.Mode().Perm()
+	if err := os.Chmod(staging, mode); err != nil {
+		return err
+	}
+
+	// os.Rename never replaces a directory, remove the empty dest first
+	if err := os.Remove(dest); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		restoreErr := os.Mkdir(dest, mode)
+		if restoreErr == nil {
+			restoreErr = os.Chmod(dest, mode)
+		}
+		if restoreErr != nil {
+			return errors.Wrapf(err, "unable to restore %s: %v", dest, restoreErr)
+		}
+		return err
+	}
+
 	return nil
 }
 
-func getReader(path, mediaType, comp string, buf io.Reader) (io.Reader, error) {
+func getReader(ctx context.Context, path, mediaType, comp string, buf io.Reader) (io.Reader, error) {
 	switch comp {
 	case "gzip":
 		if !strings.HasSuffix(mediaType, "+gzip") {
-			logrus.Debugf("%q: %s media type with non-%s file", path, comp, comp)
+			debugf(ctx, "%q: %s media type with non-%s file", path, comp, comp)
 		}
 
 		return gzip.NewReader(buf)
 	case "bzip2":
 		if !strings.HasSuffix(mediaType, "+bzip2") {
-			logrus.Debugf("%q: %s media type with non-%s file", path, comp, comp)
+			debugf(ctx, "%q: %s media type with non-%s file", path, comp, comp)
 		}
 
 		return bzip2.NewReader(buf), nil
@@ -140,7 +224,7 @@ func getReader(path, mediaType, comp string, buf io.Reader) (io.Reader, error) {
 		return nil, errors.New("xz layers are not supported")
 	default:
 		if strings.Contains(mediaType, "+") {
-			logrus.Debugf("%q: %s media type with non-%s file", path, comp, comp)
+			debugf(ctx, "%q: %s media type with non-%s file", path, comp, comp)
 		}
 
 		return buf, nil
@@ -161,7 +245,7 @@ func DetectCompression(r *bufio.Reader) (string, error) {
 		// "xz":    {0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00},
 	} {
 		if len(source) < len(m) {
-			logrus.Debug("Len too short")
+			debugf(context.Background(), "Len too short")
 			continue
 		}
 		if bytes.Equal(m, source[:len(m)]) {
@@ -171,7 +255,15 @@ func DetectCompression(r *bufio.Reader) (string, error) {
 	return "plain", nil
 }
 
-func unpackLayer(mediaType, path, dest string, r io.Reader) error {
+// unpackLayer extracts the layer read from r to dest, applying its
+// whiteouts. If r is an entryCounter, it is told about every entry.
+func unpackLayer(ctx context.Context, mediaType, path, dest string, r io.Reader) error {
+	return applyLayer(ctx, mediaType, path, dest, r, nil)
+}
+
+// applyLayer is like unpackLayer but records the changes made to dest in
+// changes, if not nil.
+func applyLayer(ctx context.Context, mediaType, path, dest string, r io.Reader, changes *[]Change) error {
 	entries := make(map[string]bool)
 
 	buf := bufio.NewReader(r)
@@ -181,13 +273,14 @@ func unpackLayer(mediaType, path, dest string, r io.Reader) error {
 		return err
 	}
 
-	reader, err := getReader(path, mediaType, comp, buf)
+	reader, err := getReader(ctx, path, mediaType, comp, buf)
 	if err != nil {
 		return err
 	}
 
 	var dirs []*tar.Header
 	tr := tar.NewReader(reader)
+	counter, _ := r.(entryCounter)
 
 loop:
 	for {
@@ -201,11 +294,18 @@ loop:
 			return errors.Wrapf(err, "error advancing tar stream")
 		}
 
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
 		var whiteout bool
-		whiteout, err = unpackLayerEntry(dest, hdr, tr, &entries)
+		whiteout, err = unpackLayerEntry(dest, hdr, tr, &entries, changes)
 		if err != nil {
 			return err
 		}
+		if counter != nil {
+			counter.entry()
+		}
 		if whiteout {
 			continue loop
 		}
@@ -217,7 +317,10 @@ loop:
 		}
 	}
 	for _, hdr := range dirs {
-		path := filepath.Join(dest, hdr.Name)
+		path, err := rootfsPath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
 
 		finfo := hdr.FileInfo()
 		// I believe the old version was using time.Now().UTC() to overcome an
@@ -229,36 +332,46 @@ loop:
 	return nil
 }
 
-// unpackLayerEntry unpacks a single entry from a layer.
-func unpackLayerEntry(dest string, header *tar.Header, reader io.Reader, entries *map[string]bool) (whiteout bool, err error) {
+// unpackLayerEntry unpacks a single entry from a layer. The parent
+// directories of the entry are resolved inside dest, so the entry is never
+// written through a symlink pointing outside of it. The change made to dest
+// is appended to changes, if not nil.
+func unpackLayerEntry(dest string, header *tar.Header, reader io.Reader, entries *map[string]bool, changes *[]Change) (whiteout bool, err error) {
 	header.Name = filepath.Clean(header.Name)
-	if !strings.HasSuffix(header.Name, string(os.PathSeparator)) {
-		// Not the root directory, ensure that the parent directory exists
-		parent := filepath.Dir(header.Name)
-		parentPath := filepath.Join(dest, parent)
-		if _, err2 := os.Lstat(parentPath); err2 != nil && os.IsNotExist(err2) {
-			if err3 := os.MkdirAll(parentPath, 0750); err3 != nil {
-				return false, err3
-			}
+	rel, err := filepath.Rel(dest, filepath.Join(dest, header.Name))
+	if err != nil {
+		return false, err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return false, fmt.Errorf("%q is outside of %q", header.Name, dest)
+	}
+
+	parentPath, err := rootfsPath(dest, filepath.Dir(rel))
+	if err != nil {
+		return false, err
+	}
+	if _, err2 := os.Lstat(parentPath); err2 != nil && os.IsNotExist(err2) {
+		if err3 := os.MkdirAll(parentPath, 0750); err3 != nil {
+			return false, err3
 		}
 	}
-	path := filepath.Join(dest, header.Name)
+	path := filepath.Join(parentPath, filepath.Base(rel))
 	if (*entries)[path] {
 		return false, fmt.Errorf("duplicate entry for %s", path)
 	}
 	(*entries)[path] = true
-	rel, err := filepath.Rel(dest, path)
-	if err != nil {
-		return false, err
-	}
 	info := header.FileInfo()
-	if strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-		return false, fmt.Errorf("%q is outside of %q", header.Name, dest)
+
+	if info.Name() == whiteoutOpaqueDir {
+		return true, removeOpaque(dest, parentPath, *entries, changes)
 	}
 
-	if strings.HasPrefix(info.Name(), ".wh.") {
-		path = strings.Replace(path, ".wh.", "", 1)
+	if strings.HasPrefix(info.Name(), whiteoutPrefix) {
+		path = filepath.Join(parentPath, strings.TrimPrefix(info.Name(), whiteoutPrefix))
 
+		if _, err := os.Lstat(path); err == nil {
+			recordChange(changes, dest, path, ChangeDelete)
+		}
 		if err = os.RemoveAll(path); err != nil {
 			return true, errors.Wrap(err, "unable to delete whiteout path")
 		}
@@ -266,6 +379,14 @@ func unpackLayerEntry(dest string, header *tar.Header, reader io.Reader, entries
 		return true, nil
 	}
 
+	if header.Typeflag != tar.TypeXGlobalHeader {
+		kind := ChangeAdd
+		if _, err := os.Lstat(path); err == nil {
+			kind = ChangeModify
+		}
+		recordChange(changes, dest, path, kind)
+	}
+
 	if header.Typeflag != tar.TypeDir {
 		err = os.RemoveAll(path)
 		if err != nil && !os.IsNotExist(err) {
@@ -18,6 +18,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -28,15 +29,10 @@ import (
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 
 	bz2 "github.com/dsnet/compress/bzip2"
 )
 
-func init() {
-	logrus.SetLevel(logrus.DebugLevel)
-}
-
 func TestUnpackLayerDuplicateEntries(t *testing.T) {
 	tmp1, err := ioutil.TempDir("", "test-dup")
 	if err != nil {
@@ -69,7 +65,7 @@ func TestUnpackLayerDuplicateEntries(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmp2)
-	if err := unpackLayer("application/vnd.oci.image.layer.v1.tar+gzip", f.Name(), tmp2, r); err != nil && !strings.Contains(err.Error(), "duplicate entry for") {
+	if err := unpackLayer(context.Background(), "application/vnd.oci.image.layer.v1.tar+gzip", f.Name(), tmp2, r); err != nil && !strings.Contains(err.Error(), "duplicate entry for") {
 		t.Fatalf("Expected to fail with duplicate entry, got %v", err)
 	}
 }
@@ -149,7 +145,7 @@ func testUnpackLayer(t *testing.T, compression string, invalid bool) {
 			},
 		},
 	}
-	err = unpackManifest(&testManifest, newPathWalker(tmp1), filepath.Join(tmp1, "rootfs"))
+	err = unpackManifest(context.Background(), &testManifest, newPathWalker(tmp1), filepath.Join(tmp1, "rootfs"))
 	if err != nil {
 		t.Fatal(errors.Wrapf(err, "%q / %s", blobPath, compression))
 	}
@@ -220,7 +216,7 @@ func TestUnpackLayerRemovePartiallyUnpackedFile(t *testing.T) {
 			},
 		},
 	}
-	err = unpackManifest(&testManifest, newPathWalker(tmp1), filepath.Join(tmp1, "rootfs"))
+	err = unpackManifest(context.Background(), &testManifest, newPathWalker(tmp1), filepath.Join(tmp1, "rootfs"))
 	if err != nil && !strings.Contains(err.Error(), "duplicate entry for") {
 		t.Fatal(err)
 	}
@@ -233,3 +229,72 @@ func TestUnpackLayerRemovePartiallyUnpackedFile(t *testing.T) {
 		t.Fatal("Except partially unpacked file has been removed")
 	}
 }
+
+func TestValidateArtifact(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	subject := createTestImage(t, layout, "latest", &config, plainLayer(t, "etc/hostname"))
+	subject.Annotations = nil
+
+	lw, err := newLayoutWriter(context.Background(), layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the empty config is only embedded, the layer is not a tar archive
+	signature := []byte("not a tar archive")
+	d, size, err := lw.putBlob(bytes.NewReader(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := v1.Descriptor{MediaType: "application/vnd.example.signature", Digest: d, Size: size}
+	createTestArtifact(t, layout, "signature", v1.Manifest{
+		ArtifactType: "application/vnd.example.signature",
+		Config:       v1.DescriptorEmptyJSON,
+		Layers:       []v1.Descriptor{layer},
+		Subject:      &subject,
+	})
+
+	corrupt := v1.DescriptorEmptyJSON
+	corrupt.Data = []byte("[]")
+	createTestArtifact(t, layout, "corrupt", v1.Manifest{
+		ArtifactType: "application/vnd.example.signature",
+		Config:       corrupt,
+		Layers:       []v1.Descriptor{layer},
+	})
+
+	createTestArtifact(t, layout, "untyped", v1.Manifest{
+		Config: v1.DescriptorEmptyJSON,
+		Layers: []v1.Descriptor{layer},
+	})
+
+	if err := ValidateLayout(layout, []string{"name=signature"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"corrupt", "untyped"} {
+		if err := ValidateLayout(layout, []string{"name=" + ref}, nil); err == nil {
+			t.Errorf("%s: expected a validation error", ref)
+		}
+	}
+
+	err = UnpackLayout(layout, filepath.Join(root, "rootfs"), "", []string{"name=signature"})
+	if err == nil || !strings.Contains(err.Error(), "artifact") {
+		t.Errorf("expected an artifact error, got %v", err)
+	}
+
+	// the embedded config is written out when copied
+	copied := filepath.Join(root, "copy")
+	if err := CopyLayout(layout, copied, TypeImageLayout, "signature", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(copied, "blobs", "sha256", v1.DescriptorEmptyJSON.Digest.Hex())); err != nil {
+		t.Error(err)
+	}
+}
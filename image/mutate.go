@@ -0,0 +1,442 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// mutateCreatedBy is the created_by of the history entries of the layers
+// appended by MutateLayout.
+const mutateCreatedBy = "oci-image-tool mutate"
+
+// MutateOptions are the changes made to an image by MutateLayout. The zero
+// value changes nothing.
+type MutateOptions struct {
+	// RemoveLayers are the indexes of the layers to remove, from 0 for the
+	// base layer. Negative indexes count from the topmost layer, -1.
+	RemoveLayers []int
+
+	// AppendLayers are the paths of plain or gzip tar files appended on
+	// top of the layers, once RemoveLayers are removed. Directories are
+	// written as reproducible gzip layers by WriteLayer, clamped to
+	// SourceDateEpoch.
+	AppendLayers []string
+
+	// Entrypoint and Cmd replace those of the config if not nil. An empty
+	// non-nil slice clears them.
+	Entrypoint []string
+	Cmd        []string
+
+	// Env sets the NAME=VALUE variables, replacing the variables of the
+	// same name. UnsetEnv removes the variables with the given names.
+	Env      []string
+	UnsetEnv []string
+
+	// User, WorkingDir and StopSignal replace those of the config if not
+	// nil. An empty string clears them.
+	User       *string
+	WorkingDir *string
+	StopSignal *string
+
+	// Labels sets config labels, RemoveLabels removes them.
+	Labels       map[string]string
+	RemoveLabels []string
+
+	// Annotations sets manifest annotations, RemoveAnnotations removes
+	// them.
+	Annotations       map[string]string
+	RemoveAnnotations []string
+
+	// NewRef is the ref name of the mutated image. If empty, the mutated
+	// image replaces the original one in index.json.
+	NewRef string
+}
+
+// MutateConfig applies the config changes of opts to c.
+func MutateConfig(c *v1.Image, opts *MutateOptions) {
+	if opts.Entrypoint != nil {
+		c.Config.Entrypoint = opts.Entrypoint
+	}
+	if opts.Cmd != nil {
+		c.Config.Cmd = opts.Cmd
+	}
+
+	env := mergeEnv(c.Config.Env, opts.Env)
+	if len(opts.UnsetEnv) > 0 {
+		kept := env[:0]
+	vars:
+		for _, e := range env {
+			for _, name := range opts.UnsetEnv {
+				if strings.SplitN(e, "=", 2)[0] == name {
+					continue vars
+				}
+			}
+			kept = append(kept, e)
+		}
+		env = kept
+	}
+	if len(env) > 0 || c.Config.Env != nil {
+		c.Config.Env = env
+	}
+
+	if opts.User != nil {
+		c.Config.User = *opts.User
+	}
+	if opts.WorkingDir != nil {
+		c.Config.WorkingDir = *opts.WorkingDir
+	}
+	if opts.StopSignal != nil {
+		c.Config.StopSignal = *opts.StopSignal
+	}
+
+	c.Config.Labels = mutateMap(c.Config.Labels, opts.Labels, opts.RemoveLabels)
+}
+
+// MutateManifest applies the manifest changes of opts to m. The layers
+// are changed by MutateLayout, which stores them.
+func MutateManifest(m *v1.Manifest, opts *MutateOptions) {
+	m.Annotations = mutateMap(m.Annotations, opts.Annotations, opts.RemoveAnnotations)
+}
+
+// mutateMap returns a copy of m with the entries of set added and the keys
+// of remove removed, or nil if it is empty.
+func mutateMap(m, set map[string]string, remove []string) map[string]string {
+	mutated := map[string]string{}
+	for k, v := range m {
+		mutated[k] = v
+	}
+	for k, v := range set {
+		mutated[k] = v
+	}
+	for _, k := range remove {
+		delete(mutated, k)
+	}
+
+	if len(mutated) == 0 {
+		return nil
+	}
+	return mutated
+}
+
+// MutateLayout applies opts to the image selected by refs in the image
+// layout directory src, and returns the descriptor of the mutated image in
+// index.json. The config, manifest and, if refs select an index, index are
+// written with their new digests: the mutated manifest replaces the one
+// matching platform in the index.
+//
+// The mutated image replaces the original one in index.json, or is added
+// under opts.NewRef if set. The blobs of the original image are kept.
+func MutateLayout(src, platform string, refs []string, opts *MutateOptions) (v1.Descriptor, error) {
+	return MutateLayoutContext(context.Background(), src, platform, refs, opts)
+}
+
+// MutateLayoutContext is like MutateLayout but stops as soon as ctx is done.
+func MutateLayoutContext(ctx context.Context, src, platform string, refs []string, opts *MutateOptions) (v1.Descriptor, error) {
+	if opts == nil {
+		opts = &MutateOptions{}
+	}
+
+	w := newPathWalker(src)
+	if err := layoutValidate(ctx, w); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	descs, err := findDescriptor(ctx, w, refs)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	ref := descs[0]
+	if err = validateDescriptor(ctx, &ref, w, validRefMediaTypes); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	lw, err := newLayoutWriter(ctx, src)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	var desc v1.Descriptor
+	if ref.MediaType == v1.MediaTypeImageManifest {
+		desc, err = mutateImage(ctx, w, lw, ref, opts)
+	} else {
+		desc, err = mutateIndex(ctx, w, lw, ref, platform, opts)
+	}
+	if err != nil {
+		return v1.Descriptor{}, errors.Wrap(err, "mutate")
+	}
+
+	index, err := lw.readIndex()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	if opts.NewRef != "" {
+		desc.Annotations = mutateMap(desc.Annotations, map[string]string{v1.AnnotationRefName: opts.NewRef}, nil)
+		addReference(index, desc)
+	} else {
+		for i, d := range index.Manifests {
+			if d.Digest == ref.Digest && d.Annotations[v1.AnnotationRefName] == ref.Annotations[v1.AnnotationRefName] {
+				index.Manifests[i] = desc
+			}
+		}
+	}
+
+	return desc, lw.writeIndex(index)
+}
+
+// mutateIndex mutates the manifest of the index desc matching platform,
+// and returns the descriptor of the new index.
+func mutateIndex(ctx context.Context, w walker, lw *layoutWriter, desc v1.Descriptor, platform string, opts *MutateOptions) (v1.Descriptor, error) {
+	index, err := findIndex(ctx, w, &desc)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	parts := strings.Split(platform, ":")
+	if len(parts) != 2 {
+		return v1.Descriptor{}, fmt.Errorf("platform must have os and arch when reftype is index")
+	}
+
+	found := -1
+	for i, m := range index.Manifests {
+		if m.MediaType != v1.MediaTypeImageManifest || m.Platform == nil {
+			continue
+		}
+		if strings.EqualFold(m.Platform.OS, parts[0]) && strings.EqualFold(m.Platform.Architecture, parts[1]) {
+			if found >= 0 {
+				return v1.Descriptor{}, fmt.Errorf("index %s has several manifests for %s", desc.Digest, platform)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return v1.Descriptor{}, fmt.Errorf("there is no matching manifest")
+	}
+
+	if index.Manifests[found], err = mutateImage(ctx, w, lw, index.Manifests[found], opts); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	mutated, err := lw.putJSON(desc.MediaType, index)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Digest, desc.Size = mutated.Digest, mutated.Size
+
+	return desc, nil
+}
+
+// mutateImage applies opts to the manifest desc and its config, and
+// returns the descriptor of the new manifest. The platform and annotations
+// of desc are kept.
+func mutateImage(ctx context.Context, w walker, lw *layoutWriter, desc v1.Descriptor, opts *MutateOptions) (v1.Descriptor, error) {
+	m, err := findManifest(ctx, w, &desc)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	c, err := findConfig(ctx, w, &m.Config)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if len(m.Layers) != len(c.RootFS.DiffIDs) {
+		return v1.Descriptor{}, fmt.Errorf("manifest has %d layers but config has %d diff_ids", len(m.Layers), len(c.RootFS.DiffIDs))
+	}
+
+	if err := removeLayers(ctx, m, c, opts.RemoveLayers); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	// the history of reproducible builds is dated SourceDateEpoch
+	epoch, err := SourceDateEpoch()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	for _, path := range opts.AppendLayers {
+		if err := ctx.Err(); err != nil {
+			return v1.Descriptor{}, err
+		}
+
+		layer, diffID, err := putLayer(ctx, lw, path, epoch)
+		if err != nil {
+			return v1.Descriptor{}, errors.Wrapf(err, "%s", path)
+		}
+
+		now := time.Now().UTC()
+		if epoch != nil {
+			now = *epoch
+		}
+		m.Layers = append(m.Layers, layer)
+		c.RootFS.DiffIDs = append(c.RootFS.DiffIDs, diffID)
+		c.History = append(c.History, v1.History{Created: &now, CreatedBy: mutateCreatedBy})
+	}
+
+	MutateConfig(c, opts)
+	MutateManifest(m, opts)
+
+	if m.Config, err = lw.putJSON(m.Config.MediaType, c); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	mutated, err := lw.putJSON(desc.MediaType, m)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Digest, desc.Size = mutated.Digest, mutated.Size
+
+	return desc, nil
+}
+
+// removeLayers removes the layers of the given indexes from m and c, with
+// their history entries.
+func removeLayers(ctx context.Context, m *v1.Manifest, c *v1.Image, indexes []int) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	remove := map[int]bool{}
+	for _, i := range indexes {
+		if i < 0 {
+			i += len(m.Layers)
+		}
+		if i < 0 || i >= len(m.Layers) {
+			return fmt.Errorf("layer %d: out of range, the image has %d layers", i, len(m.Layers))
+		}
+		remove[i] = true
+	}
+
+	// the history entries of the layers, if they match
+	var history []int
+	for i, h := range c.History {
+		if !h.EmptyLayer {
+			history = append(history, i)
+		}
+	}
+	if len(history) != len(m.Layers) {
+		warnf(ctx, "the history of the config does not match its layers, it is left unchanged")
+		history = nil
+	}
+
+	var removed []int
+	layers, diffIDs := m.Layers[:0], c.RootFS.DiffIDs[:0]
+	for i := range m.Layers {
+		if remove[i] {
+			if history != nil {
+				removed = append(removed, history[i])
+			}
+			continue
+		}
+		layers = append(layers, m.Layers[i])
+		diffIDs = append(diffIDs, c.RootFS.DiffIDs[i])
+	}
+	m.Layers, c.RootFS.DiffIDs = layers, diffIDs
+
+	sort.Sort(sort.Reverse(sort.IntSlice(removed)))
+	for _, i := range removed {
+		c.History = append(c.History[:i], c.History[i+1:]...)
+	}
+
+	return nil
+}
+
+// putLayer stores the plain or gzip tar file path in lw, and returns its
+// descriptor and diff_id. A directory is written as a reproducible gzip
+// layer clamped to epoch.
+func putLayer(ctx context.Context, lw *layoutWriter, path string, epoch *time.Time) (v1.Descriptor, digest.Digest, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return putDirLayer(ctx, lw, path, epoch)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	defer f.Close()
+
+	buf := bufio.NewReader(f)
+	comp, err := DetectCompression(buf)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+
+	desc := v1.Descriptor{MediaType: v1.MediaTypeImageLayer}
+	switch comp {
+	case "gzip":
+		desc.MediaType = v1.MediaTypeImageLayerGzip
+	case "plain":
+	default:
+		return v1.Descriptor{}, "", fmt.Errorf("%s layers are not supported", comp)
+	}
+
+	if desc.Digest, desc.Size, err = lw.putBlob(buf); err != nil {
+		return v1.Descriptor{}, "", err
+	}
+
+	// the diff_id is the digest of the uncompressed layer
+	blob, err := os.Open(lw.blobPath(desc.Digest))
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	defer blob.Close()
+
+	r, err := getReader(ctx, path, desc.MediaType, comp, blob)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+
+	diffID, err := lw.algorithm.FromReader(r)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+
+	return desc, diffID, nil
+}
+
+// putDirLayer stores the directory tree dir in lw as a reproducible gzip
+// layer clamped to epoch, and returns its descriptor and diff_id.
+func putDirLayer(ctx context.Context, lw *layoutWriter, dir string, epoch *time.Time) (v1.Descriptor, digest.Digest, error) {
+	pr, pw := io.Pipe()
+	var diffID digest.Digest
+	go func() {
+		var err error
+		diffID, err = WriteLayerContext(ctx, dir, pw, &LayerOptions{Gzip: true, Reproducible: true, SourceDateEpoch: epoch, Algorithm: lw.algorithm})
+		pw.CloseWithError(err)
+	}()
+
+	d, size, err := lw.putBlob(pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+
+	return v1.Descriptor{
+		MediaType: v1.MediaTypeImageLayerGzip,
+		Digest:    d,
+		Size:      size,
+	}, diffID, nil
+}
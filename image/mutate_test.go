@@ -0,0 +1,142 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMutateConfig(t *testing.T) {
+	user, stop := "nobody", ""
+	c := v1.Image{Config: v1.ImageConfig{
+		Env:        []string{"PATH=/bin", "DEBUG=1"},
+		Cmd:        []string{"sh"},
+		StopSignal: "SIGTERM",
+		Labels:     map[string]string{"a": "1", "b": "2"},
+	}}
+
+	MutateConfig(&c, &MutateOptions{
+		Entrypoint:   []string{"/bin/app"},
+		Cmd:          []string{},
+		Env:          []string{"PATH=/usr/bin:/bin", "LANG=C"},
+		UnsetEnv:     []string{"DEBUG"},
+		User:         &user,
+		StopSignal:   &stop,
+		Labels:       map[string]string{"c": "3"},
+		RemoveLabels: []string{"a"},
+	})
+
+	expected := v1.ImageConfig{
+		Entrypoint: []string{"/bin/app"},
+		Cmd:        []string{},
+		Env:        []string{"PATH=/usr/bin:/bin", "LANG=C"},
+		User:       "nobody",
+		Labels:     map[string]string{"b": "2", "c": "3"},
+	}
+	if !reflect.DeepEqual(c.Config, expected) {
+		t.Errorf("expected %+v, got %+v", expected, c.Config)
+	}
+}
+
+func TestMutateLayout(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		History:      []v1.History{{CreatedBy: "base"}, {CreatedBy: "env", EmptyLayer: true}, {CreatedBy: "debug"}},
+	}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "bin/sh"),
+		plainLayer(t, "usr/bin/gdb"),
+	)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(plainLayer(t, "bin/app")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := filepath.Join(root, "app.tar.gz")
+	if err := ioutil.WriteFile(layer, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := MutateLayout(layout, "", []string{"name=latest"}, &MutateOptions{
+		RemoveLayers: []int{-1},
+		AppendLayers: []string{layer},
+		Entrypoint:   []string{"/bin/app"},
+		Annotations:  map[string]string{"org.example.mutated": "true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Annotations[v1.AnnotationRefName] != "latest" {
+		t.Errorf("expected the mutated image to keep its ref, got %+v", desc)
+	}
+
+	if err := ValidateLayout(layout, []string{"name=latest"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newPathWalker(layout)
+	m, err := findManifest(context.Background(), w, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := findConfig(context.Background(), w, &m.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Layers) != 2 || m.Layers[1].MediaType != v1.MediaTypeImageLayerGzip || m.Annotations["org.example.mutated"] != "true" {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if !reflect.DeepEqual(c.Config.Entrypoint, []string{"/bin/app"}) {
+		t.Errorf("unexpected config %+v", c.Config)
+	}
+	var createdBy []string
+	for _, h := range c.History {
+		createdBy = append(createdBy, h.CreatedBy)
+	}
+	if expected := []string{"base", "env", mutateCreatedBy}; !reflect.DeepEqual(createdBy, expected) {
+		t.Errorf("expected history %v, got %v", expected, createdBy)
+	}
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := UnpackLayout(layout, rootfs, "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"bin/sh": "bin/sh", "bin/app": "bin/app"}
+	if files := treeFiles(t, rootfs); !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+}
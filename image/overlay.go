@@ -0,0 +1,304 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// overlayLayersDir is the directory holding the layer directories of the
+// overlay layout.
+const overlayLayersDir = "layers"
+
+// OverlayOptions are the options of the overlay unpack layout.
+type OverlayOptions struct {
+	// Rootless marks opaque directories with the user.overlay.opaque
+	// xattr instead of trusted.overlay.opaque, for overlayfs mounted with
+	// the userxattr option.
+	Rootless bool
+}
+
+// UnpackOverlayLayout is like UnpackLayout but extracts every layer to its
+// own directory layers/<diff_id>/ of dest, as an overlayfs lower directory,
+// and returns the lowerdir= mount option stacking them.
+func UnpackOverlayLayout(src, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	return UnpackOverlayLayoutContext(context.Background(), src, dest, platform, refs, opts)
+}
+
+// UnpackOverlayLayoutContext is like UnpackOverlayLayout but stops as soon
+// as ctx is done, cleaning up any partial output.
+func UnpackOverlayLayoutContext(ctx context.Context, src, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	return unpackOverlay(ctx, newPathWalker(src), dest, platform, refs, opts)
+}
+
+// UnpackOverlayZip is like UnpackZip but extracts every layer to its own
+// directory layers/<diff_id>/ of dest, as an overlayfs lower directory, and
+// returns the lowerdir= mount option stacking them.
+func UnpackOverlayZip(src, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	return UnpackOverlayZipContext(context.Background(), src, dest, platform, refs, opts)
+}
+
+// UnpackOverlayZipContext is like UnpackOverlayZip but stops as soon as ctx
+// is done, cleaning up any partial output.
+func UnpackOverlayZipContext(ctx context.Context, src, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	return unpackOverlay(ctx, newZipWalker(src), dest, platform, refs, opts)
+}
+
+// UnpackOverlayFile opens the file pointed by tarFileName and calls
+// UnpackOverlay on it.
+func UnpackOverlayFile(tarFileName, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	return UnpackOverlayFileContext(context.Background(), tarFileName, dest, platform, refs, opts)
+}
+
+// UnpackOverlayFileContext is like UnpackOverlayFile but stops as soon as
+// ctx is done, cleaning up any partial output.
+func UnpackOverlayFileContext(ctx context.Context, tarFileName, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	f, err := os.Open(tarFileName) // nolint: errcheck, gosec
+	if err != nil {
+		return "", errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return UnpackOverlayContext(ctx, f, dest, platform, refs, opts)
+}
+
+// UnpackOverlay is like Unpack but extracts every layer to its own
+// directory layers/<diff_id>/ of dest, as an overlayfs lower directory:
+// whiteouts become 0/0 character devices and opaque directories are marked
+// with the overlay.opaque xattr. It returns the lowerdir= mount option
+// stacking the layers, topmost first.
+//
+// dest may already hold the layers of other images: the directories of
+// the layers already extracted are reused as is. Every layer is checked
+// against its diff_id as it is extracted, but a directory found in dest is
+// not checked again, so a shared dest is only as trustworthy as every image
+// unpacked into it and anyone able to write to it.
+func UnpackOverlay(r io.ReadSeeker, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	return UnpackOverlayContext(context.Background(), r, dest, platform, refs, opts)
+}
+
+// UnpackOverlayContext is like UnpackOverlay but stops as soon as ctx is
+// done, cleaning up any partial output.
+func UnpackOverlayContext(ctx context.Context, r io.ReadSeeker, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	return unpackOverlay(ctx, newTarWalker(r), dest, platform, refs, opts)
+}
+
+func unpackOverlay(ctx context.Context, w walker, dest, platform string, refs []string, opts *OverlayOptions) (string, error) {
+	if opts == nil {
+		opts = &OverlayOptions{}
+	}
+
+	_, m, err := resolveManifest(ctx, w, platform, refs)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := findConfig(ctx, w, &m.Config)
+	if err != nil {
+		return "", err
+	}
+	if c.OS == "windows" {
+		return "", errors.New("the overlay layout is not supported for Windows images")
+	}
+
+	if err := unpackOverlayLayers(ctx, w, m, c, dest, opts); err != nil {
+		return "", err
+	}
+
+	return overlayLowerdir(c, dest)
+}
+
+// overlayLowerdir returns the lowerdir= mount option stacking the layer
+// directories of the image config c in dest, topmost first.
+func overlayLowerdir(c *v1.Image, dest string) (string, error) {
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return "", err
+	}
+
+	// ":" separates the directories and "," the mount options
+	escaper := strings.NewReplacer(`\`, `\\`, ":", `\:`, ",", `\,`)
+
+	var dirs []string
+	for i := len(c.RootFS.DiffIDs) - 1; i >= 0; i-- {
+		dir := filepath.Join(abs, overlayLayersDir, c.RootFS.DiffIDs[i].Hex())
+		dirs = append(dirs, escaper.Replace(dir))
+	}
+
+	return "lowerdir=" + strings.Join(dirs, ":"), nil
+}
+
+// unpackOverlayLayers extracts every layer of the manifest m of the image
+// config c to its own directory of dest. The directories of the layers
+// already extracted are kept without being checked.
+func unpackOverlayLayers(ctx context.Context, w walker, m *v1.Manifest, c *v1.Image, dest string, opts *OverlayOptions) error {
+	if len(m.Layers) != len(c.RootFS.DiffIDs) {
+		return fmt.Errorf("manifest has %d layers but config has %d diff_ids", len(m.Layers), len(c.RootFS.DiffIDs))
+	}
+	if len(m.Layers) == 0 {
+		// overlayfs needs at least one lower directory
+		return errors.New("rootfs.diff_ids: the overlay layout needs at least one layer")
+	}
+
+	for i, d := range m.Layers {
+		diffID := c.RootFS.DiffIDs[i]
+		if err := validateDigest(diffID); err != nil {
+			return errors.Wrapf(err, "rootfs.diff_ids[%d]", i)
+		}
+
+		layerDir := filepath.Join(dest, overlayLayersDir, diffID.Hex())
+		if _, err := os.Stat(layerDir); err == nil {
+			// extracted for this image or another one
+			continue
+		}
+
+		staging, err := stageDir(layerDir)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(staging)
+
+		lpath := filepath.Join("blobs", string(d.Digest.Algorithm()), d.Digest.Hex())
+		switch err := w.find(ctx, lpath, func(path string, r io.Reader) error {
+			p := newLayerProgress(ctx, d, r)
+			if err := unpackOverlayLayer(ctx, d.MediaType, path, staging, p, diffID, opts); err != nil {
+				return errors.Wrap(err, "unpack: error extracting layer")
+			}
+			p.finish()
+
+			return errEOW
+		}); errors.Cause(err) {
+		case nil:
+			return fmt.Errorf("%s: layer not found", lpath)
+		case errEOW:
+		default:
+			return err
+		}
+
+		if err := commitDir(staging, layerDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unpackOverlayLayer extracts the layer read from r to dest, converting its
+// whiteouts to the overlayfs format, and checks its uncompressed content
+// against diffID.
+func unpackOverlayLayer(ctx context.Context, mediaType, path, dest string, r io.Reader, diffID digest.Digest, opts *OverlayOptions) error {
+	entries := make(map[string]bool)
+
+	buf := bufio.NewReader(r)
+
+	comp, err := DetectCompression(buf)
+	if err != nil {
+		return err
+	}
+
+	reader, err := getReader(ctx, path, mediaType, comp, buf)
+	if err != nil {
+		return err
+	}
+
+	verifier := diffID.Verifier()
+	uncompressed := io.TeeReader(reader, verifier)
+	tr := tar.NewReader(uncompressed)
+	counter, _ := r.(entryCounter)
+
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			// the diff_id covers the padding after the end of the archive
+			if _, err := io.Copy(ioutil.Discard, uncompressed); err != nil {
+				return err
+			}
+			if !verifier.Verified() {
+				return fmt.Errorf("uncompressed content does not match diff_id %s", diffID)
+			}
+			return nil
+		case nil:
+			// success, continue below
+		default:
+			return errors.Wrapf(err, "error advancing tar stream")
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		base := filepath.Base(name)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			// unpackLayerEntry applies whiteouts, convert them instead
+			if err := unpackOverlayWhiteout(dest, name, &entries, opts); err != nil {
+				return err
+			}
+		} else if _, err := unpackLayerEntry(dest, hdr, tr, &entries, nil); err != nil {
+			return err
+		}
+
+		if counter != nil {
+			counter.entry()
+		}
+	}
+}
+
+// unpackOverlayWhiteout converts the whiteout name to the overlayfs format
+// in dest: a 0/0 character device for a whiteout, the overlay.opaque xattr
+// of its directory for an opaque whiteout.
+func unpackOverlayWhiteout(dest, name string, entries *map[string]bool, opts *OverlayOptions) error {
+	rel, err := filepath.Rel(dest, filepath.Join(dest, name))
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return fmt.Errorf("%q is outside of %q", name, dest)
+	}
+
+	dir, err := rootfsPath(dest, filepath.Dir(rel))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, filepath.Base(rel))
+	if (*entries)[path] {
+		return fmt.Errorf("duplicate entry for %s", path)
+	}
+	(*entries)[path] = true
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if filepath.Base(rel) == whiteoutOpaqueDir {
+		return errors.Wrapf(overlayOpaque(dir, opts.Rootless), "%s: unable to mark opaque directory", name)
+	}
+
+	path = filepath.Join(dir, strings.TrimPrefix(filepath.Base(rel), whiteoutPrefix))
+	return errors.Wrapf(overlayWhiteout(path), "%s: unable to create whiteout", name)
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// overlayWhiteout creates the overlayfs whiteout path, a 0/0 character
+// device.
+func overlayWhiteout(path string) error {
+	if err := syscall.Mknod(path, syscall.S_IFCHR, 0); err != nil {
+		if err == syscall.EPERM {
+			return errors.Wrap(err, "creating whiteouts needs CAP_MKNOD")
+		}
+		return err
+	}
+	return nil
+}
+
+// overlayOpaque marks dir as an overlayfs opaque directory, with the
+// user.overlay.opaque xattr if rootless or trusted.overlay.opaque
+// otherwise.
+func overlayOpaque(dir string, rootless bool) error {
+	name := "trusted.overlay.opaque"
+	if rootless {
+		name = "user.overlay.opaque"
+	}
+
+	return syscall.Setxattr(dir, name, []byte("y"), 0)
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUnpackOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating whiteouts needs root")
+	}
+
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "etc/hostname", "etc/hosts", "var/lib/x"),
+		plainLayer(t, "etc/.wh.hosts", "var/lib/.wh..wh..opq", "var/lib/y"),
+	)
+
+	dest := filepath.Join(root, "overlay")
+	lowerdir, err := UnpackOverlayLayout(layout, dest, "", []string{"name=latest"}, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "unable to mark opaque directory") {
+			t.Skipf("trusted xattrs are not supported: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower := filepath.Join(abs, "layers", config.RootFS.DiffIDs[0].Hex())
+	upper := filepath.Join(abs, "layers", config.RootFS.DiffIDs[1].Hex())
+	if expected := "lowerdir=" + upper + ":" + lower; lowerdir != expected {
+		t.Errorf("expected %q, got %q", expected, lowerdir)
+	}
+
+	for _, name := range []string{
+		filepath.Join(lower, "etc", "hosts"),
+		filepath.Join(lower, "var", "lib", "x"),
+		filepath.Join(upper, "var", "lib", "y"),
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(upper, "etc", "hosts"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("expected a 0/0 character device, got mode %o rdev %d", st.Mode, st.Rdev)
+	}
+	if _, err := os.Lstat(filepath.Join(upper, "etc", ".wh.hosts")); !os.IsNotExist(err) {
+		t.Error("expected the whiteout marker not to exist")
+	}
+
+	buf := make([]byte, 1)
+	if n, err := syscall.Getxattr(filepath.Join(upper, "var", "lib"), "trusted.overlay.opaque", buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("expected an opaque directory, got %q, %v", buf, err)
+	}
+
+	// the layers already extracted are reused
+	if _, err := UnpackOverlayLayout(layout, dest, "", []string{"name=latest"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnpackOverlayDiffID(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	layer := plainLayer(t, "etc/hostname")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config, layer)
+
+	// the same layer, announced with the diff_id of another one
+	lw, err := newLayoutWriter(context.Background(), layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RootFS.DiffIDs = []digest.Digest{digest.FromBytes(plainLayer(t, "etc/hosts"))}
+	configDesc, err := lw.putJSON(v1.MediaTypeImageConfig, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestArtifact(t, layout, "bad", v1.Manifest{
+		Config: configDesc,
+		Layers: []v1.Descriptor{{MediaType: v1.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}},
+	})
+
+	dest := filepath.Join(root, "overlay")
+	if _, err := UnpackOverlayLayout(layout, dest, "", []string{"name=bad"}, nil); err == nil || !strings.Contains(err.Error(), "does not match diff_id") {
+		t.Fatalf("expected a diff_id mismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "layers", config.RootFS.DiffIDs[0].Hex())); !os.IsNotExist(err) {
+		t.Error("expected the mismatching layer not to be committed")
+	}
+
+	if _, err := UnpackOverlayLayout(layout, dest, "", []string{"name=latest"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
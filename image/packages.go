@@ -0,0 +1,501 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+)
+
+// Package types, as used in package URLs.
+const (
+	// PackageDeb is a Debian package, listed in the dpkg status database.
+	PackageDeb = "deb"
+
+	// PackageApk is an Alpine package, listed in the apk database.
+	PackageApk = "apk"
+
+	// PackagePython is a Python distribution, found from its metadata in
+	// site-packages.
+	PackagePython = "pypi"
+
+	// PackageGo is a Go module, found from the build information of a Go
+	// binary.
+	PackageGo = "golang"
+)
+
+// Package is a software package installed in the root filesystem of an
+// image.
+type Package struct {
+	// Type is the kind of the package, one of the Package constants.
+	Type string
+
+	Name    string
+	Version string
+
+	// Arch is the architecture of distribution packages.
+	Arch string
+
+	// License is the license declared by the package metadata, if any.
+	License string
+
+	// PURL is the package URL of the package.
+	PURL string
+
+	// Path is the absolute path, with forward slashes, of the file the
+	// package was found in: its package database or its Go binary.
+	Path string
+}
+
+// Package databases read from the root filesystem, besides Python
+// metadata.
+const (
+	dpkgStatusPath   = "var/lib/dpkg/status"
+	dpkgStatusDir    = "var/lib/dpkg/status.d"
+	apkInstalledPath = "lib/apk/db/installed"
+)
+
+// osReleasePaths are the locations of the os-release file, naming the
+// distribution of the packages, by order of precedence.
+var osReleasePaths = []string{"etc/os-release", "usr/lib/os-release"}
+
+// osReleaseType is the databaseType of os-release files.
+const osReleaseType = "os-release"
+
+// databaseType returns the kind of package database at path, relative to
+// the root filesystem, as a Package type or osReleaseType. It returns an
+// empty string if path is not a package database.
+func databaseType(path string) string {
+	path = filepath.ToSlash(path)
+	dir, base := filepath.Dir(path), filepath.Base(path)
+
+	switch {
+	case path == dpkgStatusPath:
+		return PackageDeb
+	case dir == dpkgStatusDir && !strings.Contains(base, "."):
+		// distroless images have a status file per package, next to
+		// their md5sums
+		return PackageDeb
+	case path == apkInstalledPath:
+		return PackageApk
+	case isPythonMetadata(dir, base):
+		return PackagePython
+	}
+
+	for _, p := range osReleasePaths {
+		if path == p {
+			return osReleaseType
+		}
+	}
+
+	return ""
+}
+
+// isPythonMetadata reports whether base, in the directory dir, holds the
+// metadata of an installed Python distribution.
+func isPythonMetadata(dir, base string) bool {
+	inSitePackages := func(dir string) bool {
+		name := filepath.Base(dir)
+		return name == "site-packages" || name == "dist-packages"
+	}
+
+	switch {
+	case base == "METADATA" && strings.HasSuffix(dir, ".dist-info"):
+		return inSitePackages(filepath.Dir(dir))
+	case base == "PKG-INFO" && strings.HasSuffix(dir, ".egg-info"):
+		return inSitePackages(filepath.Dir(dir))
+	case strings.HasSuffix(base, ".egg-info"):
+		// distutils installs the metadata as a single file
+		return inSitePackages(dir)
+	}
+
+	return false
+}
+
+// osRelease is the distribution named by os-release.
+type osRelease struct {
+	id        string
+	versionID string
+}
+
+// parseOSRelease returns the distribution of the os-release file buf.
+func parseOSRelease(buf []byte) osRelease {
+	var r osRelease
+	for _, line := range strings.Split(string(buf), "\n") {
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+		switch key {
+		case "ID":
+			r.id = value
+		case "VERSION_ID":
+			r.versionID = value
+		}
+	}
+	return r
+}
+
+// namespace returns the package URL namespace of the distribution, or def
+// if it is unknown.
+func (r osRelease) namespace(def string) string {
+	if r.id == "" {
+		return def
+	}
+	return r.id
+}
+
+// distro returns the distro qualifier of package URLs, or an empty string
+// if the distribution is unknown.
+func (r osRelease) distro() string {
+	if r.id == "" || r.versionID == "" {
+		return ""
+	}
+	return r.id + "-" + r.versionID
+}
+
+// controlStanzas splits buf, in the format of Debian control files, into
+// stanzas of fields separated by empty lines. Continuation lines are
+// dropped. The "K:value" lines of the apk database use the same format.
+func controlStanzas(buf []byte) []map[string]string {
+	var (
+		stanzas []map[string]string
+		fields  map[string]string
+	)
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			fields = nil
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		if fields == nil {
+			fields = map[string]string{}
+			stanzas = append(stanzas, fields)
+		}
+		fields[line[:i]] = strings.TrimSpace(line[i+1:])
+	}
+
+	return stanzas
+}
+
+// dpkgPackages returns the installed packages of the dpkg status database
+// buf, read from path.
+func dpkgPackages(path string, buf []byte, release osRelease) []Package {
+	var pkgs []Package
+	for _, fields := range controlStanzas(buf) {
+		name, version := fields["Package"], fields["Version"]
+		if name == "" || version == "" {
+			continue
+		}
+		// the files of status.d have no status, they are all installed
+		if status, ok := fields["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+
+		arch := fields["Architecture"]
+		pkgs = append(pkgs, Package{
+			Type:    PackageDeb,
+			Name:    name,
+			Version: version,
+			Arch:    arch,
+			PURL:    packageURL(PackageDeb, release.namespace("debian"), name, version, "arch", arch, "distro", release.distro()),
+			Path:    path,
+		})
+	}
+	return pkgs
+}
+
+// apkPackages returns the installed packages of the apk database buf, read
+// from path.
+func apkPackages(path string, buf []byte, release osRelease) []Package {
+	var pkgs []Package
+	for _, fields := range controlStanzas(buf) {
+		name, version := fields["P"], fields["V"]
+		if name == "" || version == "" {
+			continue
+		}
+
+		arch := fields["A"]
+		pkgs = append(pkgs, Package{
+			Type:    PackageApk,
+			Name:    name,
+			Version: version,
+			Arch:    arch,
+			License: fields["L"],
+			PURL:    packageURL(PackageApk, release.namespace("alpine"), name, version, "arch", arch, "distro", release.distro()),
+			Path:    path,
+		})
+	}
+	return pkgs
+}
+
+// pythonNameSeparators are normalized to a dash in Python package names.
+var pythonNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// pythonPackage returns the Python distribution described by the metadata
+// buf, read from path, if it has a name and a version.
+func pythonPackage(path string, buf []byte) (Package, bool) {
+	// the metadata headers end at the first empty line
+	stanzas := controlStanzas(buf)
+	if len(stanzas) == 0 {
+		return Package{}, false
+	}
+
+	fields := stanzas[0]
+	name, version := fields["Name"], fields["Version"]
+	if name == "" || version == "" {
+		return Package{}, false
+	}
+
+	license := fields["License-Expression"]
+	if license == "" {
+		license = fields["License"]
+	}
+
+	purlName := strings.ToLower(pythonNameSeparators.ReplaceAllString(name, "-"))
+	return Package{
+		Type:    PackagePython,
+		Name:    name,
+		Version: version,
+		License: license,
+		PURL:    packageURL(PackagePython, "", purlName, version),
+		Path:    path,
+	}, true
+}
+
+// goPackages returns the main module and the dependencies of the Go binary
+// at path, whose build information is bi.
+func goPackages(path string, bi *debug.BuildInfo) []Package {
+	var pkgs []Package
+	add := func(m *debug.Module) {
+		if m.Replace != nil {
+			m = m.Replace
+		}
+		if m.Path == "" {
+			return
+		}
+
+		version := m.Version
+		if version == "(devel)" {
+			version = ""
+		}
+
+		namespace, name := "", m.Path
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			namespace, name = name[:i], name[i+1:]
+		}
+
+		pkgs = append(pkgs, Package{
+			Type:    PackageGo,
+			Name:    m.Path,
+			Version: version,
+			PURL:    packageURL(PackageGo, namespace, name, version),
+			Path:    path,
+		})
+	}
+
+	add(&bi.Main)
+	for _, dep := range bi.Deps {
+		add(dep)
+	}
+	return pkgs
+}
+
+// packageURL returns the package URL of the given type, namespace, name
+// and version. The qualifiers are key and value pairs, empty values are
+// left out.
+func packageURL(typ, namespace, name, version string, qualifiers ...string) string {
+	var b strings.Builder
+	b.WriteString("pkg:" + typ + "/")
+	if namespace != "" {
+		for _, segment := range strings.Split(namespace, "/") {
+			b.WriteString(purlEscape(segment) + "/")
+		}
+	}
+	b.WriteString(purlEscape(name))
+	if version != "" {
+		b.WriteString("@" + purlEscape(version))
+	}
+
+	sep := "?"
+	for i := 0; i+1 < len(qualifiers); i += 2 {
+		if qualifiers[i+1] == "" {
+			continue
+		}
+		b.WriteString(sep + qualifiers[i] + "=" + purlEscape(qualifiers[i+1]))
+		sep = "&"
+	}
+
+	return b.String()
+}
+
+// purlEscape percent-encodes s, but for the unreserved characters of URLs.
+func purlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+const (
+	// goBuildInfoHeaderSize is the size of the header of the build
+	// information of Go binaries, starting with goBuildInfoMagic.
+	goBuildInfoHeaderSize = 32
+
+	// goBuildInfoInline is the flag of the header telling that the
+	// strings follow the header, as written since Go 1.18.
+	goBuildInfoInline = 0x2
+
+	// goBuildInfoMaxString is the length of the longest string read from
+	// the build information.
+	goBuildInfoMaxString = 1 << 20
+
+	// goBuildInfoChunk is the size of the chunks of binaries searched for
+	// goBuildInfoMagic.
+	goBuildInfoChunk = 64 << 10
+)
+
+var goBuildInfoMagic = []byte("\xff Go buildinf:")
+
+// executableMagics are the first bytes of ELF, Mach-O and PE executables.
+var executableMagics = [][]byte{
+	[]byte("\x7fELF"),
+	{0xfe, 0xed, 0xfa, 0xce},
+	{0xfe, 0xed, 0xfa, 0xcf},
+	{0xce, 0xfa, 0xed, 0xfe},
+	{0xcf, 0xfa, 0xed, 0xfe},
+	[]byte("MZ"),
+}
+
+// goBuildInfo returns the build information of the Go binary read from r,
+// or nil if r is not a Go binary with build information. The binary is
+// searched as it is read, without loading it in memory, so only the build
+// information written by Go 1.18 and later is supported.
+func goBuildInfo(r io.Reader) (*debug.BuildInfo, error) {
+	br := bufio.NewReaderSize(r, goBuildInfoChunk)
+
+	head, _ := br.Peek(4)
+	executable := false
+	for _, magic := range executableMagics {
+		if bytes.HasPrefix(head, magic) {
+			executable = true
+			break
+		}
+	}
+	if !executable {
+		return nil, nil
+	}
+
+	for {
+		buf, err := br.Peek(goBuildInfoChunk)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		var skip int
+		switch i := bytes.Index(buf, goBuildInfoMagic); {
+		case i < 0 || i+goBuildInfoHeaderSize > len(buf):
+			if err == io.EOF {
+				return nil, nil
+			}
+			// keep the bytes which may start a header
+			skip = len(buf) - goBuildInfoHeaderSize + 1
+			if i >= 0 {
+				skip = i
+			}
+		case isGoBuildInfoHeader(buf[i : i+goBuildInfoHeaderSize]):
+			if _, err := br.Discard(i + goBuildInfoHeaderSize); err != nil {
+				return nil, err
+			}
+			return readGoBuildInfo(br)
+		default:
+			skip = i + 1
+		}
+
+		if _, err := br.Discard(skip); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isGoBuildInfoHeader reports whether header, starting with
+// goBuildInfoMagic, is followed by inline strings. The magic alone is also
+// found in the binaries reading build information.
+func isGoBuildInfoHeader(header []byte) bool {
+	ptrSize, flags := header[len(goBuildInfoMagic)], header[len(goBuildInfoMagic)+1]
+	return (ptrSize == 4 || ptrSize == 8) && flags&goBuildInfoInline != 0
+}
+
+// readGoBuildInfo reads the Go version and module information following
+// the header of the build information.
+func readGoBuildInfo(br *bufio.Reader) (*debug.BuildInfo, error) {
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return "", err
+		}
+		if n > goBuildInfoMaxString {
+			return "", fmt.Errorf("build information string of %d bytes", n)
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(br, buf)
+		return string(buf), err
+	}
+
+	version, err := readString()
+	if err != nil {
+		return nil, err
+	}
+	mod, err := readString()
+	if err != nil {
+		return nil, err
+	}
+
+	// the module information is framed by 16 byte sentinels
+	if len(mod) < 33 || mod[len(mod)-17] != '\n' {
+		return nil, nil
+	}
+
+	bi, err := debug.ParseBuildInfo(mod[16 : len(mod)-16])
+	if err != nil {
+		return nil, err
+	}
+	bi.GoVersion = version
+	return bi, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// annotationQueryPrefix prefixes the annotation key in annotation criteria.
+const annotationQueryPrefix = "annotation."
+
+// refQuery is a single criterion selecting descriptors from index.json,
+// given on the command line as key=value.
+type refQuery struct {
+	key   string
+	value string
+}
+
+// parseRefQuery parses a criterion of the form key=value. Supported keys
+// are name (glob pattern), digest (full digest, digest prefix or hex prefix),
+// mediaType, platform.os, platform.architecture, platform.variant and
+// annotation.<key>.
+func parseRefQuery(ref string) (refQuery, error) {
+	i := strings.Index(ref, "=")
+	if i <= 0 {
+		return refQuery{}, fmt.Errorf("ref %q must be of the form A=B", ref)
+	}
+
+	q := refQuery{key: ref[:i], value: ref[i+1:]}
+
+	switch q.key {
+	case "name":
+		if _, err := path.Match(q.value, ""); err != nil {
+			return refQuery{}, errors.Wrapf(err, "ref %q", ref)
+		}
+	case "digest", "mediaType", "platform.os", "platform.architecture", "platform.variant":
+	default:
+		if !strings.HasPrefix(q.key, annotationQueryPrefix) || len(q.key) == len(annotationQueryPrefix) {
+			return refQuery{}, fmt.Errorf("criteria %q unimplemented", q.key)
+		}
+	}
+
+	return q, nil
+}
+
+// designates reports whether the criterion designates descriptors one by
+// one, with a digest or an exact name, rather than by their properties.
+func (q refQuery) designates() bool {
+	switch q.key {
+	case "digest":
+		return true
+	case "name":
+		return !strings.ContainsAny(q.value, `*?[\`)
+	default:
+		return false
+	}
+}
+
+// match reports whether d satisfies the criterion.
+func (q refQuery) match(d *v1.Descriptor) bool {
+	switch q.key {
+	case "name":
+		name, ok := d.Annotations[v1.AnnotationRefName]
+		if !ok {
+			return false
+		}
+		// the pattern has been checked by parseRefQuery
+		matched, _ := path.Match(q.value, name)
+		return matched
+	case "digest":
+		if strings.Contains(q.value, ":") {
+			return strings.HasPrefix(string(d.Digest), q.value)
+		}
+		return q.value != "" && strings.HasPrefix(d.Digest.Hex(), q.value)
+	case "mediaType":
+		return d.MediaType == q.value
+	// Descriptors without a platform, typically pointing to a
+	// multi-platform index, are not excluded by platform criteria.
+	case "platform.os":
+		return d.Platform == nil || d.Platform.OS == q.value
+	case "platform.architecture":
+		return d.Platform == nil || d.Platform.Architecture == q.value
+	case "platform.variant":
+		return d.Platform == nil || d.Platform.Variant == q.value
+	default:
+		value, ok := d.Annotations[strings.TrimPrefix(q.key, annotationQueryPrefix)]
+		return ok && value == q.value
+	}
+}
+
+// queryDescriptors returns the descriptors matching all refs. Referrers,
+// such as signatures and SBOMs, and referrers indexes are left out unless
+// a criterion designates them by digest or exact name, so that they do not
+// make queries on the images ambiguous.
+func queryDescriptors(descs []v1.Descriptor, refs []string) ([]v1.Descriptor, error) {
+	var queries []refQuery
+	designated := false
+	for _, ref := range refs {
+		q, err := parseRefQuery(ref)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+		designated = designated || q.designates()
+	}
+
+	var matches []v1.Descriptor
+
+descs:
+	for i := range descs {
+		if !designated && isReferrer(&descs[i]) {
+			continue
+		}
+		for _, q := range queries {
+			if !q.match(&descs[i]) {
+				continue descs
+			}
+		}
+		matches = append(matches, descs[i])
+	}
+
+	return matches, nil
+}
+
+// describeDescriptor returns a one line summary of d for error messages.
+func describeDescriptor(d *v1.Descriptor) string {
+	s := fmt.Sprintf("digest=%s mediaType=%s", d.Digest, d.MediaType)
+
+	if name, ok := d.Annotations[v1.AnnotationRefName]; ok {
+		s = fmt.Sprintf("name=%s %s", name, s)
+	}
+
+	if d.Platform != nil {
+		s += fmt.Sprintf(" platform=%s/%s", d.Platform.OS, d.Platform.Architecture)
+		if d.Platform.Variant != "" {
+			s += "/" + d.Platform.Variant
+		}
+	}
+
+	return s
+}
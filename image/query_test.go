@@ -0,0 +1,103 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestQueryDescriptors(t *testing.T) {
+	descs := []v1.Descriptor{
+		{
+			MediaType:   v1.MediaTypeImageIndex,
+			Digest:      digest.FromString("index"),
+			Annotations: map[string]string{v1.AnnotationRefName: "v1.0"},
+		},
+		{
+			MediaType:   v1.MediaTypeImageManifest,
+			Digest:      digest.FromString("amd64"),
+			Platform:    &v1.Platform{OS: "linux", Architecture: "amd64"},
+			Annotations: map[string]string{v1.AnnotationRefName: "v1.1-amd64", "com.example.stage": "release"},
+		},
+		{
+			MediaType:   v1.MediaTypeImageManifest,
+			Digest:      digest.FromString("arm"),
+			Platform:    &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			Annotations: map[string]string{v1.AnnotationRefName: "v1.1-arm"},
+		},
+		{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    digest.FromString("untagged"),
+			Platform:  &v1.Platform{OS: "windows", Architecture: "amd64"},
+		},
+		{
+			MediaType:    v1.MediaTypeImageManifest,
+			Digest:       digest.FromString("signature"),
+			ArtifactType: SignatureArtifactType,
+		},
+		{
+			MediaType:   v1.MediaTypeImageIndex,
+			Digest:      digest.FromString("referrers"),
+			Annotations: map[string]string{v1.AnnotationRefName: referrersRefName(digest.FromString("amd64"))},
+		},
+	}
+
+	for _, tc := range []struct {
+		refs    []string
+		matches int
+		invalid bool
+	}{
+		{[]string{"name=v1.0"}, 1, false},
+		{[]string{"name=v1.1-*"}, 2, false},
+		{[]string{"name=v1.*", "platform.architecture=arm"}, 2, false},
+		{[]string{"name=v1.1-*", "platform.architecture=arm"}, 1, false},
+		{[]string{"platform.os=windows"}, 2, false},
+		{[]string{"platform.variant=v7", "mediaType=" + v1.MediaTypeImageManifest}, 1, false},
+		{[]string{"mediaType=" + v1.MediaTypeImageManifest}, 3, false},
+		{[]string{"annotation.com.example.stage=release"}, 1, false},
+		{[]string{"annotation.com.example.stage=beta"}, 0, false},
+		{[]string{"digest=" + string(digest.FromString("arm"))}, 1, false},
+		{[]string{"digest=" + string(digest.FromString("arm"))[:15]}, 1, false},
+		{[]string{"digest=" + digest.FromString("arm").Hex()[:8]}, 1, false},
+		{[]string{"digest="}, 0, false},
+		// referrers are only matched by digest or exact name
+		{[]string{"name=*"}, 3, false},
+		{[]string{"mediaType=" + v1.MediaTypeImageIndex}, 1, false},
+		{[]string{"digest=" + digest.FromString("signature").Hex()[:8]}, 1, false},
+		{[]string{"name=" + referrersRefName(digest.FromString("amd64"))}, 1, false},
+		{[]string{"name=["}, 0, true},
+		{[]string{"name"}, 0, true},
+		{[]string{"platform.kernel=4.9"}, 0, true},
+		{[]string{"annotation.=x"}, 0, true},
+	} {
+		matches, err := queryDescriptors(descs, tc.refs)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.refs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.refs, err)
+			continue
+		}
+		if len(matches) != tc.matches {
+			t.Errorf("%v: expected %d matches, got %d", tc.refs, tc.matches, len(matches))
+		}
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// maxManifestSize is the size of the largest blob considered when scanning
+// for referrers, registries reject larger manifests.
+const maxManifestSize = 4 << 20
+
+// referrersRefName returns the ref name of the referrers index of subject,
+// following the referrers tag schema of the distribution-spec.
+func referrersRefName(subject digest.Digest) string {
+	name := string(subject.Algorithm()) + "-" + subject.Hex()
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return name
+}
+
+// isReferrersRefName reports whether name is the ref name of a referrers
+// index, as returned by referrersRefName.
+func isReferrersRefName(name string) bool {
+	i := strings.Index(name, "-")
+	if i < 0 {
+		return false
+	}
+	algorithm, hex := digest.Algorithm(name[:i]), name[i+1:]
+	if CheckAlgorithm(algorithm) != nil {
+		return false
+	}
+
+	// long digests are truncated to 128 characters
+	if hex == "" || (len(hex) != algorithm.Size()*2 && len(name) != 128) {
+		return false
+	}
+	for _, c := range hex {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isReferrer reports whether the index.json entry d is a referrer, that is
+// an artifact with a subject, or a referrers index.
+func isReferrer(d *v1.Descriptor) bool {
+	if d.ArtifactType != "" {
+		return true
+	}
+	return d.MediaType == v1.MediaTypeImageIndex && isReferrersRefName(d.Annotations[v1.AnnotationRefName])
+}
+
+// ReferrersLayout returns the descriptors of the manifests and indexes of
+// the image layout src whose subject is dgst, such as signatures and
+// SBOMs. If artifactType is not empty, only the referrers of that type
+// are returned. The descriptors carry the artifactType and annotations of
+// their manifest, as returned by the referrers API of registries.
+//
+// If the layout has the referrers index of dgst written by
+// IndexReferrersLayout, it is read together with the manifests and indexes
+// listed in index.json, so that referrers added since the referrers index
+// was written are still found. Otherwise every blob of the layout is
+// scanned.
+func ReferrersLayout(src string, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	return ReferrersLayoutContext(context.Background(), src, dgst, artifactType)
+}
+
+// ReferrersLayoutContext is like ReferrersLayout but stops as soon as ctx
+// is done.
+func ReferrersLayoutContext(ctx context.Context, src string, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	return referrers(ctx, newPathWalker(src), dgst, artifactType)
+}
+
+// ReferrersZip is like ReferrersLayout for the zip archive src.
+func ReferrersZip(src string, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	return ReferrersZipContext(context.Background(), src, dgst, artifactType)
+}
+
+// ReferrersZipContext is like ReferrersZip but stops as soon as ctx is done.
+func ReferrersZipContext(ctx context.Context, src string, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	return referrers(ctx, newZipWalker(src), dgst, artifactType)
+}
+
+// ReferrersFile opens the tar file given by the filename, then calls
+// Referrers.
+func ReferrersFile(tarFile string, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	return ReferrersFileContext(context.Background(), tarFile, dgst, artifactType)
+}
+
+// ReferrersFileContext is like ReferrersFile but stops as soon as ctx is
+// done.
+func ReferrersFileContext(ctx context.Context, tarFile string, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return ReferrersContext(ctx, f, dgst, artifactType)
+}
+
+// Referrers is like ReferrersLayout for the image layout read from the tar
+// stream r.
+func Referrers(r io.ReadSeeker, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	return ReferrersContext(context.Background(), r, dgst, artifactType)
+}
+
+// ReferrersContext is like Referrers but stops as soon as ctx is done.
+func ReferrersContext(ctx context.Context, r io.ReadSeeker, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	return referrers(ctx, newTarWalker(r), dgst, artifactType)
+}
+
+func referrers(ctx context.Context, w walker, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	if err := validateDigest(dgst); err != nil {
+		return nil, errors.Wrap(err, "referrers")
+	}
+
+	if err := layoutValidate(ctx, w); err != nil {
+		return nil, err
+	}
+
+	return findReferrers(ctx, w, dgst, artifactType)
+}
+
+// findReferrers returns the referrers of dgst of the given artifact type,
+// or of any type if artifactType is empty. The referrers index of dgst is
+// only a hint: if there is one, the manifests and indexes listed in
+// index.json are scanned instead of every blob, since referrers may have
+// been added by copies or other tools without updating it.
+func findReferrers(ctx context.Context, w walker, dgst digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	descs, err := referrersFromIndex(ctx, w, dgst)
+	if err != nil {
+		return nil, err
+	}
+	if descs == nil {
+		if descs, err = scanReferrers(ctx, w, dgst, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		refs, err := listReferences(ctx, w)
+		if err != nil {
+			return nil, err
+		}
+		listed := map[digest.Digest]bool{}
+		for _, ref := range refs {
+			listed[ref.Digest] = true
+		}
+
+		scanned, err := scanReferrers(ctx, w, dgst, listed)
+		if err != nil {
+			return nil, err
+		}
+		descs = mergeReferrers(descs, scanned)
+	}
+
+	if artifactType == "" {
+		return descs, nil
+	}
+
+	filtered := []v1.Descriptor{}
+	for _, desc := range descs {
+		if desc.ArtifactType == artifactType {
+			filtered = append(filtered, desc)
+		}
+	}
+	return filtered, nil
+}
+
+// referrersFromIndex returns the manifests of the referrers index of dgst,
+// or nil if the layout has none.
+func referrersFromIndex(ctx context.Context, w walker, dgst digest.Digest) ([]v1.Descriptor, error) {
+	refs, err := listReferences(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+
+	name := referrersRefName(dgst)
+	for i := range refs {
+		if refs[i].MediaType != v1.MediaTypeImageIndex || refs[i].Annotations[v1.AnnotationRefName] != name {
+			continue
+		}
+
+		index, err := findIndex(ctx, w, &refs[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "referrers index %s", name)
+		}
+		if index.Manifests == nil {
+			index.Manifests = []v1.Descriptor{}
+		}
+		return index.Manifests, nil
+	}
+
+	return nil, nil
+}
+
+// mergeReferrers returns the referrers of indexed followed by those of
+// scanned missing from indexed.
+func mergeReferrers(indexed, scanned []v1.Descriptor) []v1.Descriptor {
+	seen := map[digest.Digest]bool{}
+	for _, desc := range indexed {
+		seen[desc.Digest] = true
+	}
+	for _, desc := range scanned {
+		if !seen[desc.Digest] {
+			indexed = append(indexed, desc)
+		}
+	}
+	return indexed
+}
+
+// referrerBlob holds the fields of manifests and indexes needed to list
+// them as referrers.
+type referrerBlob struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType"`
+	Config       *v1.Descriptor    `json:"config"`
+	Manifests    []v1.Descriptor   `json:"manifests"`
+	Subject      *v1.Descriptor    `json:"subject"`
+	Annotations  map[string]string `json:"annotations"`
+}
+
+// scanReferrers reads every blob of the layout which may be a manifest or
+// an index, or only those of the digests in only if it is not nil, and
+// returns the descriptors of those whose subject is dgst, sorted by digest.
+func scanReferrers(ctx context.Context, w walker, dgst digest.Digest, only map[digest.Digest]bool) ([]v1.Descriptor, error) {
+	descs := []v1.Descriptor{}
+
+	if err := w.walk(ctx, func(path string, info os.FileInfo, r io.Reader) error {
+		parts := strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+		if info.IsDir() || len(parts) != 3 || parts[0] != "blobs" || info.Size() > maxManifestSize {
+			return nil
+		}
+
+		d := digest.NewDigestFromHex(parts[1], parts[2])
+		if validateDigest(d) != nil || (only != nil && !only[d]) {
+			return nil
+		}
+
+		// skip layers and other binary blobs without reading them
+		buf := bufio.NewReader(r)
+		if first, err := buf.Peek(1); err != nil || first[0] != '{' {
+			return nil
+		}
+
+		content, err := ioutil.ReadAll(buf)
+		if err != nil {
+			return errors.Wrapf(err, "%s: error reading blob", path)
+		}
+
+		var blob referrerBlob
+		if json.Unmarshal(content, &blob) != nil || blob.Subject == nil || blob.Subject.Digest != dgst {
+			return nil
+		}
+
+		if actual := d.Algorithm().FromBytes(content); actual != d {
+			warnf(ctx, "%s: skipping referrer not matching its digest", path)
+			return nil
+		}
+
+		if desc, ok := blob.descriptor(d, info.Size()); ok {
+			descs = append(descs, desc)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(descs, func(i, j int) bool {
+		return descs[i].Digest < descs[j].Digest
+	})
+
+	return descs, nil
+}
+
+// descriptor returns the referrer descriptor of the blob b, of digest d and
+// the given size, or false if b is neither a manifest nor an index.
+func (b *referrerBlob) descriptor(d digest.Digest, size int64) (v1.Descriptor, bool) {
+	desc := v1.Descriptor{
+		MediaType:    b.MediaType,
+		Digest:       d,
+		Size:         size,
+		ArtifactType: b.ArtifactType,
+		Annotations:  b.Annotations,
+	}
+
+	if desc.MediaType == "" {
+		switch {
+		case b.Config != nil:
+			desc.MediaType = v1.MediaTypeImageManifest
+		case b.Manifests != nil:
+			desc.MediaType = v1.MediaTypeImageIndex
+		}
+	}
+
+	switch desc.MediaType {
+	case v1.MediaTypeImageManifest:
+		if desc.ArtifactType == "" && b.Config != nil {
+			desc.ArtifactType = b.Config.MediaType
+		}
+	case v1.MediaTypeImageIndex:
+	default:
+		return v1.Descriptor{}, false
+	}
+
+	return desc, true
+}
+
+// IndexReferrersLayout scans the image layout directory src for the
+// referrers of dgst and stores them in the referrers index of dgst, an
+// index added to index.json under the ref name "<algorithm>-<encoded>",
+// replacing the previous one. Later lookups of the referrers of dgst then
+// read the referrers index and the manifests listed in index.json instead
+// of every blob. The descriptor of the
+// referrers index is returned.
+func IndexReferrersLayout(src string, dgst digest.Digest) (v1.Descriptor, error) {
+	return IndexReferrersLayoutContext(context.Background(), src, dgst)
+}
+
+// IndexReferrersLayoutContext is like IndexReferrersLayout but stops as
+// soon as ctx is done.
+func IndexReferrersLayoutContext(ctx context.Context, src string, dgst digest.Digest) (v1.Descriptor, error) {
+	if err := validateDigest(dgst); err != nil {
+		return v1.Descriptor{}, errors.Wrap(err, "referrers")
+	}
+
+	w := newPathWalker(src)
+	if err := layoutValidate(ctx, w); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	lw, err := newLayoutWriter(ctx, src)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return writeReferrersIndex(ctx, w, lw, dgst)
+}
+
+// writeReferrersIndex scans the layout for the referrers of dgst and
+// writes its referrers index.
+func writeReferrersIndex(ctx context.Context, w walker, lw *layoutWriter, dgst digest.Digest) (v1.Descriptor, error) {
+	descs, err := scanReferrers(ctx, w, dgst, nil)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	desc, err := lw.putJSON(v1.MediaTypeImageIndex, v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: descs,
+	})
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Annotations = map[string]string{v1.AnnotationRefName: referrersRefName(dgst)}
+
+	index, err := lw.readIndex()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	addReference(index, desc)
+
+	return desc, lw.writeIndex(index)
+}
+
+// putArtifact writes the manifest of an artifact of the given type, made
+// of the empty config and layer, whose subject is subject, and returns its
+// descriptor.
+func putArtifact(lw *layoutWriter, artifactType string, layer, subject v1.Descriptor, annotations map[string]string) (v1.Descriptor, error) {
+	empty := v1.DescriptorEmptyJSON
+	if !lw.hasBlob(empty.Digest) {
+		if err := lw.putVerifiedBlob(empty, bytes.NewReader(empty.Data)); err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+
+	desc, err := lw.putJSON(v1.MediaTypeImageManifest, v1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       empty,
+		Layers:       []v1.Descriptor{layer},
+		Subject:      &v1.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+		Annotations:  annotations,
+	})
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.ArtifactType = artifactType
+
+	return desc, nil
+}
+
+// addReferrer adds the referrer desc, whose subject is subject, to the
+// index.json of the layout written by lw, without a ref name, so that it
+// is part of the layout, unless it already is. The referrers index of
+// subject is updated if the layout has one.
+func addReferrer(ctx context.Context, lw *layoutWriter, desc v1.Descriptor, subject digest.Digest) error {
+	index, err := lw.readIndex()
+	if err != nil {
+		return err
+	}
+
+	listed := false
+	for _, m := range index.Manifests {
+		if m.Digest == desc.Digest {
+			listed = true
+			break
+		}
+	}
+	if !listed {
+		addReference(index, desc)
+		if err := lw.writeIndex(index); err != nil {
+			return err
+		}
+	}
+
+	w := newPathWalker(lw.root)
+	indexed, err := referrersFromIndex(ctx, w, subject)
+	if err != nil || indexed == nil {
+		return err
+	}
+
+	_, err = writeReferrersIndex(ctx, w, lw, subject)
+	return err
+}
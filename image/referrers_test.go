@@ -0,0 +1,114 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReferrers(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	subject := createTestImage(t, layout, "latest", &config, plainLayer(t, "etc/hostname"))
+	subject.Annotations = nil
+
+	artifact := func(artifactType string, subject *v1.Descriptor) v1.Descriptor {
+		return createTestArtifact(t, layout, "", v1.Manifest{
+			ArtifactType: artifactType,
+			Config:       v1.DescriptorEmptyJSON,
+			Layers:       []v1.Descriptor{v1.DescriptorEmptyJSON},
+			Subject:      subject,
+			Annotations:  map[string]string{"org.example.type": artifactType},
+		})
+	}
+	signature := artifact("application/vnd.example.signature", &subject)
+	sbom := artifact("application/spdx+json", &subject)
+	artifact("application/vnd.example.unrelated", nil)
+
+	descs, err := ReferrersLayout(layout, subject.Digest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 2 {
+		t.Fatalf("expected 2 referrers, got %v", descs)
+	}
+	for _, desc := range descs {
+		if desc.Digest != signature.Digest && desc.Digest != sbom.Digest {
+			t.Errorf("unexpected referrer %s", desc.Digest)
+		}
+		if desc.Annotations["org.example.type"] != desc.ArtifactType || desc.MediaType != v1.MediaTypeImageManifest {
+			t.Errorf("expected the artifact type and annotations of the manifest, got %+v", desc)
+		}
+	}
+
+	descs, err = ReferrersLayout(layout, subject.Digest, "application/spdx+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 1 || descs[0].Digest != sbom.Digest {
+		t.Errorf("expected the SBOM only, got %v", descs)
+	}
+
+	if _, err := IndexReferrersLayout(layout, subject.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	// referrers added after the referrers index was written are still
+	// found through index.json
+	late := artifact("application/vnd.example.late", &subject)
+
+	archive := filepath.Join(root, "layout.tar")
+	if err := ConvertLayout(layout, archive, TypeImage); err != nil {
+		t.Fatal(err)
+	}
+	descs, err = ReferrersFile(archive, subject.Digest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 3 || descs[2].Digest != late.Digest {
+		t.Errorf("expected the 2 indexed referrers and the late one, got %v", descs)
+	}
+
+	if _, err := IndexReferrersLayout(layout, subject.Digest); err != nil {
+		t.Fatal(err)
+	}
+	descs, err = ReferrersLayout(layout, subject.Digest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 3 {
+		t.Errorf("expected 3 referrers, got %v", descs)
+	}
+
+	// the referrers index is part of the layout
+	res, err := FsckLayout(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() {
+		t.Errorf("unexpected problems %v", res.Problems)
+	}
+}
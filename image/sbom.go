@@ -0,0 +1,606 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/image-tools/version"
+	"github.com/pkg/errors"
+)
+
+// SBOM formats.
+const (
+	// SBOMFormatSPDX is the JSON format of SPDX 2.3.
+	SBOMFormatSPDX = "spdx"
+
+	// SBOMFormatCycloneDX is the JSON format of CycloneDX 1.5.
+	SBOMFormatCycloneDX = "cyclonedx"
+)
+
+// Media types of the SBOM formats, also used as the artifact type of the
+// SBOMs attached to images.
+const (
+	MediaTypeSPDX      = "application/spdx+json"
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+)
+
+// maxPackageDatabaseSize is the size of the largest package database read
+// from the layers.
+const maxPackageDatabaseSize = 64 << 20
+
+// BillOfMaterials lists the packages installed in the root filesystem of
+// an image.
+type BillOfMaterials struct {
+	// Subject is the descriptor of the manifest of the image.
+	Subject v1.Descriptor
+
+	// Name is the ref name of the image in index.json, if any.
+	Name string
+
+	// Created is the creation time of the bill of materials.
+	Created time.Time
+
+	// Packages are sorted by type, name, version and path.
+	Packages []Package
+}
+
+// SBOMLayout lists the packages installed in the image selected by refs in
+// the image layout directory src. If refs select an index, the manifest
+// matching platform is used.
+//
+// The layers are streamed twice, once to find the files of the merged
+// filesystem and once to read the package databases and the Go binaries
+// among them, so nothing is extracted to disk. The packages are read from
+// the dpkg and apk databases, the metadata of Python distributions in
+// site-packages and the build information of Go binaries.
+//
+// The bill of materials is dated SourceDateEpoch if set, so that it can be
+// reproduced.
+func SBOMLayout(src, platform string, refs []string) (*BillOfMaterials, error) {
+	return SBOMLayoutContext(context.Background(), src, platform, refs)
+}
+
+// SBOMLayoutContext is like SBOMLayout but stops as soon as ctx is done.
+func SBOMLayoutContext(ctx context.Context, src, platform string, refs []string) (*BillOfMaterials, error) {
+	return sbom(ctx, newPathWalker(src), platform, refs)
+}
+
+// SBOMZip is like SBOMLayout for the zip archive src.
+func SBOMZip(src, platform string, refs []string) (*BillOfMaterials, error) {
+	return SBOMZipContext(context.Background(), src, platform, refs)
+}
+
+// SBOMZipContext is like SBOMZip but stops as soon as ctx is done.
+func SBOMZipContext(ctx context.Context, src, platform string, refs []string) (*BillOfMaterials, error) {
+	return sbom(ctx, newZipWalker(src), platform, refs)
+}
+
+// SBOMFile opens the tar file given by the filename, then calls SBOM.
+func SBOMFile(tarFile, platform string, refs []string) (*BillOfMaterials, error) {
+	return SBOMFileContext(context.Background(), tarFile, platform, refs)
+}
+
+// SBOMFileContext is like SBOMFile but stops as soon as ctx is done.
+func SBOMFileContext(ctx context.Context, tarFile, platform string, refs []string) (*BillOfMaterials, error) {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return SBOMContext(ctx, f, platform, refs)
+}
+
+// SBOM is like SBOMLayout for the image layout read from the tar stream r.
+func SBOM(r io.ReadSeeker, platform string, refs []string) (*BillOfMaterials, error) {
+	return SBOMContext(context.Background(), r, platform, refs)
+}
+
+// SBOMContext is like SBOM but stops as soon as ctx is done.
+func SBOMContext(ctx context.Context, r io.ReadSeeker, platform string, refs []string) (*BillOfMaterials, error) {
+	return sbom(ctx, newTarWalker(r), platform, refs)
+}
+
+func sbom(ctx context.Context, w walker, platform string, refs []string) (*BillOfMaterials, error) {
+	ref, desc, m, err := resolveImage(ctx, w, platform, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := SourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+	if created == nil {
+		now := time.Now().UTC()
+		created = &now
+	}
+
+	pkgs, err := scanPackages(ctx, w, m.Layers)
+	if err != nil {
+		return nil, errors.Wrap(err, "sbom")
+	}
+
+	return &BillOfMaterials{
+		Subject:  v1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size},
+		Name:     ref.Annotations[v1.AnnotationRefName],
+		Created:  *created,
+		Packages: pkgs,
+	}, nil
+}
+
+// scanPackages returns the packages installed in the merged filesystem of
+// layers.
+func scanPackages(ctx context.Context, w walker, layers []v1.Descriptor) ([]Package, error) {
+	state := squashState{}
+	for i, d := range layers {
+		if err := readLayer(ctx, w, d, false, func(tr *tar.Reader, hdr *tar.Header) error {
+			state.add(i, hdr)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	var pkgs []Package
+	databases := map[string][]byte{}
+	for i, d := range layers {
+		if err := readLayer(ctx, w, d, true, func(tr *tar.Reader, hdr *tar.Header) error {
+			path, _ := squashPath(hdr.Name)
+			if hdr.Typeflag != tar.TypeReg || !state.visible(path, i, false) {
+				return nil
+			}
+
+			if databaseType(path) != "" {
+				if hdr.Size > maxPackageDatabaseSize {
+					warnf(ctx, "/%s: skipping package database of %d bytes", filepath.ToSlash(path), hdr.Size)
+					return nil
+				}
+				buf, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				databases[path] = buf
+				return nil
+			}
+
+			if hdr.Mode&0111 == 0 {
+				return nil
+			}
+			bi, err := goBuildInfo(tr)
+			if err != nil {
+				warnf(ctx, "/%s: unable to read Go build information: %v", filepath.ToSlash(path), err)
+				return nil
+			}
+			if bi != nil {
+				pkgs = append(pkgs, goPackages("/"+filepath.ToSlash(path), bi)...)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	pkgs = append(pkgs, databasePackages(databases)...)
+	sort.Slice(pkgs, func(i, j int) bool {
+		a, b := pkgs[i], pkgs[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Path < b.Path
+	})
+
+	return pkgs, nil
+}
+
+// databasePackages returns the packages listed by the package databases,
+// by path relative to the root filesystem.
+func databasePackages(databases map[string][]byte) []Package {
+	var release osRelease
+	for _, path := range osReleasePaths {
+		if buf, ok := databases[filepath.FromSlash(path)]; ok {
+			release = parseOSRelease(buf)
+			break
+		}
+	}
+
+	var paths []string
+	for path := range databases {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var pkgs []Package
+	for _, path := range paths {
+		buf, abs := databases[path], "/"+filepath.ToSlash(path)
+		switch databaseType(path) {
+		case PackageDeb:
+			pkgs = append(pkgs, dpkgPackages(abs, buf, release)...)
+		case PackageApk:
+			pkgs = append(pkgs, apkPackages(abs, buf, release)...)
+		case PackagePython:
+			if p, ok := pythonPackage(abs, buf); ok {
+				pkgs = append(pkgs, p)
+			}
+		}
+	}
+
+	return pkgs
+}
+
+// AttachSBOMLayout attaches the bill of materials bom, encoded in format,
+// to its image in the image layout directory src, as an artifact whose
+// subject is the manifest of the image and whose type is the media type
+// of the format. The artifact is added to index.json without a ref name,
+// and its descriptor is returned.
+func AttachSBOMLayout(src string, bom *BillOfMaterials, format string) (v1.Descriptor, error) {
+	return AttachSBOMLayoutContext(context.Background(), src, bom, format)
+}
+
+// AttachSBOMLayoutContext is like AttachSBOMLayout but stops as soon as
+// ctx is done.
+func AttachSBOMLayoutContext(ctx context.Context, src string, bom *BillOfMaterials, format string) (v1.Descriptor, error) {
+	mediaType, buf, err := bom.Encode(format)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	w := newPathWalker(src)
+	if err := layoutValidate(ctx, w); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	lw, err := newLayoutWriter(ctx, src)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if !lw.hasBlob(bom.Subject.Digest) {
+		return v1.Descriptor{}, fmt.Errorf("attach sbom: %s is not in %s", bom.Subject.Digest, src)
+	}
+
+	d, size, err := lw.putBlob(bytes.NewReader(buf))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	layer := v1.Descriptor{MediaType: mediaType, Digest: d, Size: size}
+
+	desc, err := putArtifact(lw, mediaType, layer, bom.Subject, map[string]string{
+		v1.AnnotationCreated: bom.Created.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return desc, addReferrer(ctx, lw, desc, bom.Subject.Digest)
+}
+
+// Encode returns the media type of format and the bill of materials
+// encoded in it.
+func (b *BillOfMaterials) Encode(format string) (string, []byte, error) {
+	var (
+		mediaType string
+		doc       interface{}
+	)
+	switch format {
+	case SBOMFormatSPDX:
+		mediaType, doc = MediaTypeSPDX, b.spdx()
+	case SBOMFormatCycloneDX:
+		mediaType, doc = MediaTypeCycloneDX, b.cycloneDX()
+	default:
+		return "", nil, fmt.Errorf("unknown SBOM format %q, must be %q or %q", format, SBOMFormatSPDX, SBOMFormatCycloneDX)
+	}
+
+	buf, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	return mediaType, append(buf, '\n'), nil
+}
+
+// name returns the name of the image, its ref name or its digest.
+func (b *BillOfMaterials) name() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return string(b.Subject.Digest)
+}
+
+// uuid returns a name based UUID identifying the bill of materials encoded
+// in format, the same for the same image at the same time.
+func (b *BillOfMaterials) uuid(format string) string {
+	sum := sha256.Sum256([]byte(format + "\n" + string(b.Subject.Digest) + "\n" + b.Created.UTC().Format(time.RFC3339Nano)))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// toolName is the name of oci-image-tool in the bills of materials.
+const toolName = "oci-image-tool"
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	LicenseDeclared       string            `json:"licenseDeclared,omitempty"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdx returns the SPDX document of the bill of materials. The image is a
+// package containing the others.
+func (b *BillOfMaterials) spdx() *spdxDocument {
+	const imageID = "SPDXRef-Image"
+
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              b.name(),
+		DocumentNamespace: "urn:uuid:" + b.uuid(SBOMFormatSPDX),
+		CreationInfo: spdxCreationInfo{
+			Created:  b.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: " + toolName + "-" + version.Version},
+		},
+		Packages: []spdxPackage{{
+			Name:             b.name(),
+			SPDXID:           imageID,
+			VersionInfo:      string(b.Subject.Digest),
+			DownloadLocation: "NOASSERTION",
+			Checksums: []spdxChecksum{{
+				Algorithm:     strings.ToUpper(string(b.Subject.Digest.Algorithm())),
+				ChecksumValue: b.Subject.Digest.Hex(),
+			}},
+			PrimaryPackagePurpose: "CONTAINER",
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: imageID,
+		}},
+	}
+
+	for i, p := range b.Packages {
+		id := "SPDXRef-Package-" + strconv.Itoa(i+1)
+		license := "NOASSERTION"
+		if isLicenseExpression(p.License) {
+			license = p.License
+		}
+
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             p.Name,
+			SPDXID:           id,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseDeclared:  license,
+			SourceInfo:       "found in " + p.Path,
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  p.PURL,
+			}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      imageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	return doc
+}
+
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string        `json:"timestamp"`
+	Tools     cdxTools      `json:"tools"`
+	Component *cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	BOMRef   string       `json:"bom-ref,omitempty"`
+	Type     string       `json:"type"`
+	Name     string       `json:"name"`
+	Version  string       `json:"version,omitempty"`
+	Hashes   []cdxHash    `json:"hashes,omitempty"`
+	Licenses []cdxLicense `json:"licenses,omitempty"`
+	PURL     string       `json:"purl,omitempty"`
+	Evidence *cdxEvidence `json:"evidence,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxLicense struct {
+	Expression string          `json:"expression,omitempty"`
+	License    *cdxLicenseName `json:"license,omitempty"`
+}
+
+type cdxLicenseName struct {
+	Name string `json:"name"`
+}
+
+type cdxEvidence struct {
+	Occurrences []cdxOccurrence `json:"occurrences"`
+}
+
+type cdxOccurrence struct {
+	Location string `json:"location"`
+}
+
+// cycloneDX returns the CycloneDX document of the bill of materials. The
+// image is the component described by the metadata.
+func (b *BillOfMaterials) cycloneDX() *cdxBOM {
+	bom := &cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + b.uuid(SBOMFormatCycloneDX),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: b.Created.UTC().Format(time.RFC3339),
+			Tools: cdxTools{Components: []cdxComponent{{
+				Type:    "application",
+				Name:    toolName,
+				Version: version.Version,
+			}}},
+			Component: &cdxComponent{
+				BOMRef:  string(b.Subject.Digest),
+				Type:    "container",
+				Name:    b.name(),
+				Version: string(b.Subject.Digest),
+				Hashes: []cdxHash{{
+					Alg:     strings.ToUpper(strings.Replace(string(b.Subject.Digest.Algorithm()), "sha", "SHA-", 1)),
+					Content: b.Subject.Digest.Hex(),
+				}},
+			},
+		},
+		Components: []cdxComponent{},
+	}
+
+	for i, p := range b.Packages {
+		var licenses []cdxLicense
+		switch {
+		case isLicenseExpression(p.License):
+			licenses = []cdxLicense{{Expression: p.License}}
+		case p.License != "":
+			licenses = []cdxLicense{{License: &cdxLicenseName{Name: p.License}}}
+		}
+
+		bom.Components = append(bom.Components, cdxComponent{
+			BOMRef:   "package-" + strconv.Itoa(i+1),
+			Type:     "library",
+			Name:     p.Name,
+			Version:  p.Version,
+			Licenses: licenses,
+			PURL:     p.PURL,
+			Evidence: &cdxEvidence{Occurrences: []cdxOccurrence{{Location: p.Path}}},
+		})
+	}
+
+	return bom
+}
+
+// licenseID matches the license identifiers of SPDX license expressions.
+var licenseID = regexp.MustCompile(`^(LicenseRef-)?[A-Za-z0-9.-]+\+?$`)
+
+// isLicenseExpression reports whether s is a valid SPDX license
+// expression, as opposed to the free-form licenses of some packages.
+func isLicenseExpression(s string) bool {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(s))
+	if len(tokens) == 0 {
+		return false
+	}
+
+	// operand is whether the previous token ends an operand
+	operand, depth := false, 0
+	for _, t := range tokens {
+		switch t {
+		case "(":
+			if operand {
+				return false
+			}
+			depth++
+		case ")":
+			if !operand || depth == 0 {
+				return false
+			}
+			depth--
+		case "AND", "OR", "WITH":
+			if !operand {
+				return false
+			}
+			operand = false
+		default:
+			if operand || !licenseID.MatchString(t) {
+				return false
+			}
+			operand = true
+		}
+	}
+
+	return operand && depth == 0
+}
@@ -0,0 +1,240 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fileLayer returns a plain layer made of files, by name, whose content is
+// given. Every file is executable.
+func fileLayer(t *testing.T, files map[string]string) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// goBinary returns an ELF file with the build information of a Go binary
+// made of the module information modinfo, at offset.
+func goBinary(offset int, modinfo string) []byte {
+	buf := make([]byte, offset)
+	copy(buf, "\x7fELF")
+
+	// the magic alone, as found in the binaries reading build information
+	buf = append(buf[:offset/2], goBuildInfoMagic...)
+	buf = append(buf, make([]byte, offset-len(buf))...)
+
+	buf = append(buf, goBuildInfoMagic...)
+	buf = append(buf, 8, goBuildInfoInline)
+	buf = append(buf, make([]byte, goBuildInfoHeaderSize-len(goBuildInfoMagic)-2)...)
+	for _, s := range []string{"go1.21.0", strings.Repeat("0", 16) + modinfo + strings.Repeat("1", 16)} {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	return append(buf, make([]byte, 64)...)
+}
+
+func TestGoBuildInfo(t *testing.T) {
+	modinfo := "path\texample.com/app/cmd/app\n" +
+		"mod\texample.com/app\tv1.2.3\th1:abc=\n" +
+		"dep\tgolang.org/x/text\tv0.14.0\th1:def=\n" +
+		"dep\texample.com/old\tv1.0.0\n" +
+		"=>\texample.com/new\tv1.1.0\th1:ghi=\n"
+
+	// the header is split across two chunks
+	for _, offset := range []int{64, goBuildInfoChunk - 20} {
+		bi, err := goBuildInfo(bytes.NewReader(goBinary(offset, modinfo)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bi == nil {
+			t.Fatalf("offset %d: expected build information", offset)
+		}
+		if bi.GoVersion != "go1.21.0" || bi.Path != "example.com/app/cmd/app" {
+			t.Errorf("offset %d: unexpected build information %+v", offset, bi)
+		}
+
+		var purls []string
+		for _, p := range goPackages("/app", bi) {
+			purls = append(purls, p.PURL)
+		}
+		expected := []string{
+			"pkg:golang/example.com/app@v1.2.3",
+			"pkg:golang/golang.org/x/text@v0.14.0",
+			"pkg:golang/example.com/new@v1.1.0",
+		}
+		if !reflect.DeepEqual(purls, expected) {
+			t.Errorf("offset %d: expected %v, got %v", offset, expected, purls)
+		}
+	}
+
+	for _, buf := range [][]byte{[]byte("#!/bin/sh\n"), []byte("\x7fELF not go"), nil} {
+		if bi, err := goBuildInfo(bytes.NewReader(buf)); err != nil || bi != nil {
+			t.Errorf("%q: expected no build information, got %+v, %v", buf, bi, err)
+		}
+	}
+}
+
+func TestSBOM(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	image := createTestImage(t, layout, "latest", &config,
+		fileLayer(t, map[string]string{
+			"usr/lib/os-release": "ID=debian\nVERSION_ID=\"12\"\n",
+			"var/lib/dpkg/status": "Package: libc6\nStatus: install ok installed\nArchitecture: amd64\nVersion: 2.36-9+deb12u3\nDescription: GNU C Library\n multi-line description\n\n" +
+				"Package: removed\nStatus: deinstall ok config-files\nVersion: 1.0\n",
+			"usr/lib/python3/dist-packages/requests-2.31.0.dist-info/METADATA": "Metadata-Version: 2.1\nName: requests\nVersion: 2.31.0\nLicense: Apache 2.0\n\nrequests\n",
+			"usr/lib/python3/dist-packages/old-1.0.dist-info/METADATA":         "Name: old\nVersion: 1.0\n",
+			"usr/local/bin/app": string(goBinary(64, "path\texample.com/app\nmod\texample.com/app\t(devel)\t\n")),
+			"usr/local/bin/sh":  "#!/bin/sh\n",
+		}),
+		fileLayer(t, map[string]string{
+			"usr/lib/python3/dist-packages/.wh.old-1.0.dist-info": "",
+			"var/lib/dpkg/status.d/tzdata":                        "Package: tzdata\nVersion: 2024a-0+deb12u1\nArchitecture: all\n",
+			"var/lib/dpkg/status.d/tzdata.md5sums":                "0123 usr/share/zoneinfo/UTC\n",
+		}),
+	)
+
+	os.Setenv(SourceDateEpochEnv, "1700000000")
+	defer os.Unsetenv(SourceDateEpochEnv)
+
+	bom, err := SBOMLayout(layout, "", []string{"name=latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bom.Subject.Digest != image.Digest || bom.Name != "latest" || bom.Created.Unix() != 1700000000 {
+		t.Errorf("unexpected bill of materials %+v", bom)
+	}
+
+	expected := []Package{
+		{Type: PackageDeb, Name: "libc6", Version: "2.36-9+deb12u3", Arch: "amd64", PURL: "pkg:deb/debian/libc6@2.36-9%2Bdeb12u3?arch=amd64&distro=debian-12", Path: "/var/lib/dpkg/status"},
+		{Type: PackageDeb, Name: "tzdata", Version: "2024a-0+deb12u1", Arch: "all", PURL: "pkg:deb/debian/tzdata@2024a-0%2Bdeb12u1?arch=all&distro=debian-12", Path: "/var/lib/dpkg/status.d/tzdata"},
+		{Type: PackageGo, Name: "example.com/app", PURL: "pkg:golang/example.com/app", Path: "/usr/local/bin/app"},
+		{Type: PackagePython, Name: "requests", Version: "2.31.0", License: "Apache 2.0", PURL: "pkg:pypi/requests@2.31.0", Path: "/usr/lib/python3/dist-packages/requests-2.31.0.dist-info/METADATA"},
+	}
+	if !reflect.DeepEqual(bom.Packages, expected) {
+		t.Errorf("expected packages\n%+v\ngot\n%+v", expected, bom.Packages)
+	}
+
+	for _, format := range []string{SBOMFormatSPDX, SBOMFormatCycloneDX} {
+		desc, err := AttachSBOMLayout(layout, bom, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// attaching the same bill of materials again changes nothing
+		if again, err := AttachSBOMLayout(layout, bom, format); err != nil || again.Digest != desc.Digest {
+			t.Errorf("%s: expected the same artifact %s, got %s, %v", format, desc.Digest, again.Digest, err)
+		}
+
+		mediaType, buf, err := bom.Encode(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(buf, &doc); err != nil {
+			t.Fatal(err)
+		}
+
+		referrers, err := ReferrersLayout(layout, image.Digest, mediaType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(referrers) != 1 || referrers[0].Digest != desc.Digest {
+			t.Errorf("%s: expected the referrer %s, got %v", format, desc.Digest, referrers)
+		}
+	}
+
+	res, err := FsckLayout(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() {
+		t.Errorf("unexpected problems %v", res.Problems)
+	}
+
+	if _, _, err := bom.Encode("xml"); err == nil {
+		t.Error("expected an unknown format error")
+	}
+}
+
+func TestPackageDatabases(t *testing.T) {
+	apk := "C:Q1abc=\nP:musl\nV:1.2.4-r2\nA:x86_64\nL:MIT\n\nP:busybox\nV:1.36.1-r5\nA:x86_64\nL:GPL-2.0-only\n"
+	pkgs := databasePackages(map[string][]byte{
+		filepath.FromSlash(apkInstalledPath): []byte(apk),
+		filepath.FromSlash("etc/os-release"): []byte("ID=alpine\nVERSION_ID=3.19.0\n"),
+	})
+
+	var purls []string
+	for _, p := range pkgs {
+		purls = append(purls, p.PURL)
+	}
+	expected := []string{
+		"pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64&distro=alpine-3.19.0",
+		"pkg:apk/alpine/busybox@1.36.1-r5?arch=x86_64&distro=alpine-3.19.0",
+	}
+	if !reflect.DeepEqual(purls, expected) {
+		t.Errorf("expected %v, got %v", expected, purls)
+	}
+
+	for license, valid := range map[string]bool{
+		"MIT": true,
+		"GPL-2.0-or-later WITH Classpath-exception-2.0": true,
+		"(MIT OR Apache-2.0) AND BSD-3-Clause":          true,
+		"Apache 2.0":                                    false,
+		"BSD License":                                   false,
+		"MIT AND":                                       false,
+		"":                                              false,
+	} {
+		if isLicenseExpression(license) != valid {
+			t.Errorf("%q: expected valid %v", license, valid)
+		}
+	}
+}
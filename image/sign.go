@@ -0,0 +1,483 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SignatureArtifactType is the artifact type of the signature artifacts
+// written by SignLayout, and the media type of their Signature layer.
+const SignatureArtifactType = "application/vnd.oci-image-tool.signature.v1+json"
+
+// signaturePrefix is prepended to the signed digest, so that the
+// signatures cannot be mistaken for those of other tools using the same
+// keys.
+const signaturePrefix = "oci-image-tool signature v1\n"
+
+// Signature is the payload of a signature artifact: a detached signature
+// over the digest of a manifest or index.
+type Signature struct {
+	// Digest is the digest of the signed manifest or index.
+	Digest digest.Digest `json:"digest"`
+
+	// Algorithm is the signature algorithm: ed25519, ecdsa-p256-sha256,
+	// ecdsa-p384-sha384 or ecdsa-p521-sha512.
+	Algorithm string `json:"algorithm"`
+
+	// KeyID identifies the public key of the signer, see KeyID.
+	KeyID string `json:"keyId"`
+
+	// Signature is the signature of signaturePrefix followed by Digest.
+	Signature []byte `json:"signature"`
+}
+
+// LoadPrivateKey reads the ed25519 or ECDSA private key of the PEM file
+// path, in PKCS #8 or SEC 1 form, as written by "openssl genpkey".
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unexpected %q PEM block, expected a private key", path, block.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T, expected an ed25519 or ECDSA key", path, key)
+	}
+}
+
+// LoadPublicKey reads the ed25519 or ECDSA public key of the PEM file path,
+// in PKIX form, as written by "openssl pkey -pubout".
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: unexpected %q PEM block, expected a public key", path, block.Type)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	if _, _, err := signatureAlgorithm(key); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return key, nil
+}
+
+// readPEM returns the first PEM block of the file path.
+func readPEM(path string) (*pem.Block, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
+
+// KeyID returns the identifier of the public key pub: the sha256 digest of
+// its PKIX form.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return digest.SHA256.FromBytes(der).String(), nil
+}
+
+// signatureAlgorithm returns the name of the signature algorithm of the
+// public key pub and the hash it signs, 0 for ed25519 which signs the
+// message itself.
+func signatureAlgorithm(pub crypto.PublicKey) (string, crypto.Hash, error) {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return "ed25519", 0, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return "ecdsa-p256-sha256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ecdsa-p384-sha384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ecdsa-p521-sha512", crypto.SHA512, nil
+		}
+		return "", 0, fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+	default:
+		return "", 0, fmt.Errorf("unsupported key type %T, expected an ed25519 or ECDSA key", pub)
+	}
+}
+
+// signedMessage returns the message signed for d, and its hash if the
+// algorithm signs a hash.
+func signedMessage(d digest.Digest, hash crypto.Hash) []byte {
+	msg := []byte(signaturePrefix + string(d))
+	if hash == 0 {
+		return msg
+	}
+
+	h := hash.New()
+	h.Write(msg) // nolint: errcheck
+	return h.Sum(nil)
+}
+
+// sign returns the signature of d by key.
+func sign(key crypto.Signer, d digest.Digest) (*Signature, error) {
+	algorithm, hash, err := signatureAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, err := KeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := key.Sign(rand.Reader, signedMessage(d, hash), hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to sign")
+	}
+
+	return &Signature{Digest: d, Algorithm: algorithm, KeyID: keyID, Signature: sig}, nil
+}
+
+// verify checks that sig is a valid signature by pub.
+func (sig *Signature) verify(pub crypto.PublicKey) error {
+	algorithm, hash, err := signatureAlgorithm(pub)
+	if err != nil {
+		return err
+	}
+	if sig.Algorithm != algorithm {
+		return fmt.Errorf("algorithm %s does not match the %s key", sig.Algorithm, algorithm)
+	}
+
+	var valid bool
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, signedMessage(sig.Digest, hash), sig.Signature)
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(pub, signedMessage(sig.Digest, hash), sig.Signature)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// SignLayout signs the manifest or index selected by refs in the image
+// layout directory src with key. The signature is stored in src as an
+// artifact of type SignatureArtifactType whose subject is the signed
+// descriptor, and the descriptor of the artifact is returned.
+func SignLayout(src string, refs []string, key crypto.Signer) (v1.Descriptor, error) {
+	return SignLayoutContext(context.Background(), src, refs, key)
+}
+
+// SignLayoutContext is like SignLayout but stops as soon as ctx is done.
+func SignLayoutContext(ctx context.Context, src string, refs []string, key crypto.Signer) (v1.Descriptor, error) {
+	w := newPathWalker(src)
+	if err := layoutValidate(ctx, w); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	descs, err := findDescriptor(ctx, w, refs)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	ref := descs[0]
+	if err := validateDescriptor(ctx, &ref, w, validRefMediaTypes); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	sig, err := sign(key, ref.Digest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	lw, err := newLayoutWriter(ctx, src)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	layer, err := lw.putJSON(SignatureArtifactType, sig)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	desc, err := putArtifact(lw, SignatureArtifactType, layer, ref, nil)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return desc, addReferrer(ctx, lw, desc, ref.Digest)
+}
+
+// VerifiedSignature is a valid signature found by VerifyLayout.
+type VerifiedSignature struct {
+	// Subject is the descriptor of index.json selected by the refs.
+	Subject v1.Descriptor
+
+	// Signature is the descriptor of the signature artifact.
+	Signature v1.Descriptor
+
+	// KeyID identifies the key of the signer.
+	KeyID string
+}
+
+// VerifyLayout checks that the manifest or index selected by refs in the
+// image layout src has a valid signature by one of keys, and returns the
+// first one found.
+func VerifyLayout(src string, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	return VerifyLayoutContext(context.Background(), src, refs, keys)
+}
+
+// VerifyLayoutContext is like VerifyLayout but stops as soon as ctx is
+// done.
+func VerifyLayoutContext(ctx context.Context, src string, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	return verify(ctx, newPathWalker(src), refs, keys)
+}
+
+// VerifyZip is like VerifyLayout for the zip archive src.
+func VerifyZip(src string, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	return VerifyZipContext(context.Background(), src, refs, keys)
+}
+
+// VerifyZipContext is like VerifyZip but stops as soon as ctx is done.
+func VerifyZipContext(ctx context.Context, src string, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	return verify(ctx, newZipWalker(src), refs, keys)
+}
+
+// VerifyFile opens the tar file given by the filename, then calls Verify.
+func VerifyFile(tarFile string, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	return VerifyFileContext(context.Background(), tarFile, refs, keys)
+}
+
+// VerifyFileContext is like VerifyFile but stops as soon as ctx is done.
+func VerifyFileContext(ctx context.Context, tarFile string, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	f, err := os.Open(tarFile) // nolint: errcheck, gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	return VerifyContext(ctx, f, refs, keys)
+}
+
+// Verify is like VerifyLayout for the image layout read from the tar
+// stream r.
+func Verify(r io.ReadSeeker, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	return VerifyContext(context.Background(), r, refs, keys)
+}
+
+// VerifyContext is like Verify but stops as soon as ctx is done.
+func VerifyContext(ctx context.Context, r io.ReadSeeker, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	return verify(ctx, newTarWalker(r), refs, keys)
+}
+
+func verify(ctx context.Context, w walker, refs []string, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	if err := layoutValidate(ctx, w); err != nil {
+		return nil, err
+	}
+
+	descs, err := findDescriptor(ctx, w, refs)
+	if err != nil {
+		return nil, err
+	}
+	ref := descs[0]
+	if err := validateDescriptor(ctx, &ref, w, validRefMediaTypes); err != nil {
+		return nil, err
+	}
+
+	return verifySignatures(ctx, w, &ref, keys)
+}
+
+// verifySignatures returns the first valid signature of subject by one of
+// keys among its signature artifacts.
+func verifySignatures(ctx context.Context, w walker, subject *v1.Descriptor, keys []crypto.PublicKey) (*VerifiedSignature, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("verify: no public key given")
+	}
+
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		id, err := KeyID(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "verify")
+		}
+		ids[i] = id
+	}
+
+	descs, err := findReferrers(ctx, w, subject.Digest, SignatureArtifactType)
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) == 0 {
+		return nil, fmt.Errorf("%s: no signature found", subject.Digest)
+	}
+
+	var problems []string
+	for _, desc := range descs {
+		sig, err := readSignature(ctx, w, desc, subject.Digest)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("  %s: %v", desc.Digest, err))
+			continue
+		}
+
+		known := false
+		for i, key := range keys {
+			if sig.KeyID != ids[i] {
+				continue
+			}
+			known = true
+
+			if err := sig.verify(key); err != nil {
+				problems = append(problems, fmt.Sprintf("  %s: %v", desc.Digest, err))
+				continue
+			}
+
+			return &VerifiedSignature{Subject: *subject, Signature: desc, KeyID: sig.KeyID}, nil
+		}
+
+		if !known {
+			problems = append(problems, fmt.Sprintf("  %s: signed by unknown key %s", desc.Digest, sig.KeyID))
+		}
+	}
+
+	return nil, fmt.Errorf("%s: no valid signature by the given keys:\n%s", subject.Digest, strings.Join(problems, "\n"))
+}
+
+// readSignature returns the payload of the signature artifact desc, which
+// must sign subject.
+func readSignature(ctx context.Context, w walker, desc v1.Descriptor, subject digest.Digest) (*Signature, error) {
+	buf, err := readBlob(ctx, w, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	// the payload is checked below, skip the schema validation of
+	// findManifest warning about artifact media types
+	var m v1.Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, errors.Wrap(err, "signature manifest format mismatch")
+	}
+	if m.Subject == nil || m.Subject.Digest != subject {
+		return nil, errors.New("subject mismatch")
+	}
+	if len(m.Layers) != 1 || m.Layers[0].MediaType != SignatureArtifactType {
+		return nil, fmt.Errorf("expected a single %s layer", SignatureArtifactType)
+	}
+
+	if buf, err = readBlob(ctx, w, m.Layers[0]); err != nil {
+		return nil, err
+	}
+
+	var sig Signature
+	if err := json.Unmarshal(buf, &sig); err != nil {
+		return nil, errors.Wrap(err, "signature format mismatch")
+	}
+	if sig.Digest != subject {
+		return nil, fmt.Errorf("signs %s instead", sig.Digest)
+	}
+
+	return &sig, nil
+}
+
+// readBlob returns the content of the small blob desc, from its embedded
+// data or the layout, once checked against its digest and size.
+func readBlob(ctx context.Context, w walker, desc v1.Descriptor) ([]byte, error) {
+	if err := validateDigest(desc.Digest); err != nil {
+		return nil, err
+	}
+	if desc.Size > maxManifestSize {
+		return nil, fmt.Errorf("%s: blob of %d bytes is too large", desc.Digest, desc.Size)
+	}
+
+	if desc.Data != nil {
+		return desc.Data, validateData(&desc)
+	}
+
+	var buf bytes.Buffer
+	if _, err := w.get(ctx, desc, &buf); err != nil {
+		return nil, errors.Wrapf(err, "%s", desc.Digest)
+	}
+
+	if int64(buf.Len()) != desc.Size {
+		return nil, fmt.Errorf("%s: size mismatch", desc.Digest)
+	}
+	if desc.Digest.Algorithm().FromBytes(buf.Bytes()) != desc.Digest {
+		return nil, fmt.Errorf("%s: digest mismatch", desc.Digest)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// verifyKeysKey is the context key of the keys set by WithVerifyKeys.
+type verifyKeysKey struct{}
+
+// WithVerifyKeys returns a copy of ctx with which the functions reading the
+// image selected by refs, such as unpack and create, only accept images
+// having a valid signature by one of keys, for use with the context-aware
+// functions. The signature must be over the descriptor of index.json
+// selected by the refs.
+func WithVerifyKeys(ctx context.Context, keys ...crypto.PublicKey) context.Context {
+	return context.WithValue(ctx, verifyKeysKey{}, keys)
+}
+
+// verifyKeys returns the keys set by WithVerifyKeys.
+func verifyKeys(ctx context.Context) []crypto.PublicKey {
+	keys, _ := ctx.Value(verifyKeysKey{}).([]crypto.PublicKey)
+	return keys
+}
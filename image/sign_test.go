@@ -0,0 +1,246 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeTestKeys writes the PEM files of key and its public key to dir and
+// returns their paths.
+func writeTestKeys(t *testing.T, dir, name string, key crypto.Signer) (string, string) {
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privPath, pubPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".pub")
+	if err := ioutil.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return privPath, pubPath
+}
+
+func TestSignVerify(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config, plainLayer(t, "etc/hostname"))
+	createTestImage(t, layout, "unsigned", &config, plainLayer(t, "etc/hosts"))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []crypto.PublicKey
+	for name, key := range map[string]crypto.Signer{"ed25519": edKey, "ecdsa": ecKey} {
+		privPath, pubPath := writeTestKeys(t, root, name, key)
+
+		signer, err := LoadPrivateKey(privPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := LoadPublicKey(pubPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, pub)
+
+		if _, err := VerifyLayout(layout, []string{"name=latest"}, []crypto.PublicKey{pub}); err == nil {
+			t.Errorf("%s: expected no signature", name)
+		}
+
+		desc, err := SignLayout(layout, []string{"name=latest"}, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		verified, err := VerifyLayout(layout, []string{"name=latest"}, []crypto.PublicKey{pub})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if verified.Signature.Digest != desc.Digest {
+			t.Errorf("%s: expected signature %s, got %s", name, desc.Digest, verified.Signature.Digest)
+		}
+	}
+
+	// both signatures are kept as part of the layout
+	res, err := FsckLayout(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() || len(res.Unreferenced) != 0 {
+		t.Errorf("expected a clean layout, got %+v", res)
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyLayout(layout, []string{"name=latest"}, []crypto.PublicKey{otherKey.Public()})
+	if err == nil || strings.Count(err.Error(), "unknown key") != 2 {
+		t.Errorf("expected 2 signatures by unknown keys, got %v", err)
+	}
+
+	archive := filepath.Join(root, "layout.tar")
+	if err := ConvertLayout(layout, archive, TypeImage); err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithVerifyKeys(context.Background(), keys...)
+	if err := UnpackFileContext(ctx, archive, filepath.Join(root, "signed"), "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackFileContext(ctx, archive, filepath.Join(root, "unsigned"), "", []string{"name=unsigned"}); err == nil {
+		t.Error("expected unsigned images to be rejected")
+	}
+}
+
+func TestUnpackSignedImage(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	image := createTestImage(t, layout, "latest", &config, plainLayer(t, "etc/hostname"))
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := SignLayout(layout, []string{"name=latest"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bom, err := SBOMLayout(layout, "", []string{"name=latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AttachSBOMLayout(layout, bom, SBOMFormatSPDX); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IndexReferrersLayout(layout, image.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	// the referrers and the referrers index do not make the image refs
+	// ambiguous
+	for i, refs := range [][]string{
+		{"mediaType=" + v1.MediaTypeImageManifest},
+		{"platform.os=linux"},
+		{"name=*"},
+		{},
+	} {
+		dest := filepath.Join(root, "dest", strconv.Itoa(i))
+		if err := UnpackLayout(layout, dest, "", refs); err != nil {
+			t.Errorf("%v: %v", refs, err)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dest, "etc", "hostname")); err != nil {
+			t.Errorf("%v: %v", refs, err)
+		}
+	}
+
+	// they are still found by digest
+	descs, err := findDescriptor(context.Background(), newPathWalker(layout), []string{"digest=" + string(signature.Digest)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descs[0].Digest != signature.Digest {
+		t.Errorf("expected the signature %s, got %s", signature.Digest, descs[0].Digest)
+	}
+}
+
+func TestVerifyCopiedSignature(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	layer := plainLayer(t, "etc/hostname")
+
+	// the destination has a referrers index written before the signature
+	// is copied in
+	dest := filepath.Join(root, "dest")
+	image := createTestImage(t, dest, "latest", &config, layer)
+	if _, err := IndexReferrersLayout(dest, image.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(root, "src")
+	createTestImage(t, src, "latest", &config, layer)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := SignLayout(src, []string{"name=latest"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyLayout(src, dest, TypeImageLayout, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []crypto.PublicKey{key.Public()}
+	verified, err := VerifyLayout(dest, []string{"name=latest"}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Signature.Digest != signature.Digest {
+		t.Errorf("expected the signature %s, got %s", signature.Digest, verified.Signature.Digest)
+	}
+
+	ctx := WithVerifyKeys(context.Background(), keys...)
+	if err := UnpackLayoutContext(ctx, dest, filepath.Join(root, "unpacked"), "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+}
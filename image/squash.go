@@ -0,0 +1,357 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// squashCreatedBy is the created_by of the history entry of squashed
+// images.
+const squashCreatedBy = "oci-image-tool squash"
+
+// SquashLayout merges the layers of the image selected by refs in the image
+// layout directory src into a single layer, applying their whiteouts. The
+// new image is added to src under the ref name newRef, and its manifest
+// descriptor is returned. If refs select an index, the manifest matching
+// platform is squashed.
+//
+// The layers are streamed twice, once to find the entries of the merged
+// filesystem and once to write them, so nothing is extracted to disk.
+func SquashLayout(src, platform string, refs []string, newRef string) (v1.Descriptor, error) {
+	return SquashLayoutContext(context.Background(), src, platform, refs, newRef)
+}
+
+// SquashLayoutContext is like SquashLayout but stops as soon as ctx is done.
+func SquashLayoutContext(ctx context.Context, src, platform string, refs []string, newRef string) (v1.Descriptor, error) {
+	if newRef == "" {
+		return v1.Descriptor{}, errors.New("squash: a new ref must be given")
+	}
+
+	w := newPathWalker(src)
+	_, m, err := resolveManifest(ctx, w, platform, refs)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	c, err := findConfig(ctx, w, &m.Config)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if len(m.Layers) != len(c.RootFS.DiffIDs) {
+		return v1.Descriptor{}, fmt.Errorf("manifest has %d layers but config has %d diff_ids", len(m.Layers), len(c.RootFS.DiffIDs))
+	}
+
+	lw, err := newLayoutWriter(ctx, src)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	layer, diffID, err := squashLayers(ctx, w, lw, m.Layers)
+	if err != nil {
+		return v1.Descriptor{}, errors.Wrap(err, "squash")
+	}
+
+	config := *c
+	config.RootFS = v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{diffID}}
+	config.History = []v1.History{{
+		Created:   c.Created,
+		CreatedBy: squashCreatedBy,
+		Comment:   fmt.Sprintf("squashed %d layers", len(m.Layers)),
+	}}
+
+	manifest := *m
+	if manifest.Config, err = lw.putJSON(v1.MediaTypeImageConfig, config); err != nil {
+		return v1.Descriptor{}, err
+	}
+	manifest.Layers = []v1.Descriptor{layer}
+
+	desc, err := lw.putJSON(v1.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Platform = &v1.Platform{OS: c.OS, Architecture: c.Architecture}
+	desc.Annotations = map[string]string{v1.AnnotationRefName: newRef}
+
+	index, err := lw.readIndex()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	addReference(index, desc)
+
+	return desc, lw.writeIndex(index)
+}
+
+// squashEntry records where a path of the merged filesystem is set,
+// replaced or deleted, as layer indexes. -1 means never.
+type squashEntry struct {
+	// layer is the topmost layer with an entry for the path, hdr its
+	// header if it is a directory.
+	layer int
+	hdr   *tar.Header
+
+	// replaced is the topmost layer deleting or replacing the path by a
+	// non-directory, which hides the content of lower layers below it.
+	replaced int
+
+	// opaque is the topmost layer hiding the content of lower layers
+	// below the directory.
+	opaque int
+}
+
+// squashState is the merged filesystem of the layers being squashed.
+type squashState map[string]*squashEntry
+
+func (s squashState) get(path string) *squashEntry {
+	e, ok := s[path]
+	if !ok {
+		e = &squashEntry{layer: -1, replaced: -1, opaque: -1}
+		s[path] = e
+	}
+	return e
+}
+
+// add records the entry hdr of the layer i.
+func (s squashState) add(i int, hdr *tar.Header) {
+	path, base := squashPath(hdr.Name)
+	dir := filepath.Dir(path)
+
+	switch {
+	case base == whiteoutOpaqueDir:
+		s.get(dir).opaque = i
+	case strings.HasPrefix(base, whiteoutPrefix):
+		s.get(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))).replaced = i
+	default:
+		e := s.get(path)
+		e.layer = i
+		e.hdr = nil
+		if hdr.Typeflag == tar.TypeDir {
+			e.hdr = hdr
+		} else {
+			e.replaced = i
+		}
+	}
+}
+
+// hidden reports whether the content of the layer i at path is hidden by
+// an upper layer deleting or replacing one of its parent directories.
+func (s squashState) hidden(path string, i int) bool {
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if e, ok := s[dir]; ok && (e.replaced > i || e.opaque > i) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether the entry of the layer i at path is part of the
+// merged filesystem. Directories are visible from the lowest layer they
+// were not deleted or replaced in, so that they come before their content.
+func (s squashState) visible(path string, i int, dir bool) bool {
+	e, ok := s[path]
+	if !ok || s.hidden(path, i) {
+		return false
+	}
+
+	if dir {
+		return e.hdr != nil && e.replaced < i
+	}
+
+	return e.layer == i && e.replaced == i
+}
+
+// squashPath returns the cleaned relative path of the tar entry name and
+// its base name.
+func squashPath(name string) (string, string) {
+	path := strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if path == "" {
+		path = "."
+	}
+	return path, filepath.Base(path)
+}
+
+// squashLayers writes the merged filesystem of layers to a new gzip layer
+// of lw, and returns its descriptor and diff_id.
+func squashLayers(ctx context.Context, w walker, lw *layoutWriter, layers []v1.Descriptor) (v1.Descriptor, digest.Digest, error) {
+	state := squashState{}
+	for i, d := range layers {
+		if err := readLayer(ctx, w, d, false, func(tr *tar.Reader, hdr *tar.Header) error {
+			state.add(i, hdr)
+			return nil
+		}); err != nil {
+			return v1.Descriptor{}, "", err
+		}
+	}
+
+	pr, pw := io.Pipe()
+	diffID := lw.algorithm.Digester()
+	go func() {
+		pw.CloseWithError(writeSquashedLayer(ctx, w, layers, state, io.MultiWriter(pw, diffID.Hash())))
+	}()
+
+	gzr, gzw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(gzw)
+		_, err := io.Copy(gz, pr)
+		if err == nil {
+			err = gz.Close()
+		}
+		pr.CloseWithError(err)
+		gzw.CloseWithError(err)
+	}()
+
+	d, size, err := lw.putBlob(gzr)
+	gzr.CloseWithError(err)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+
+	return v1.Descriptor{
+		MediaType: v1.MediaTypeImageLayerGzip,
+		Digest:    d,
+		Size:      size,
+	}, diffID.Digest(), nil
+}
+
+// writeSquashedLayer writes the entries of layers visible in the merged
+// filesystem state to out as a tar archive.
+func writeSquashedLayer(ctx context.Context, w walker, layers []v1.Descriptor, state squashState, out io.Writer) error {
+	tw := tar.NewWriter(out)
+	written := map[string]bool{}
+	var links []*tar.Header
+
+	for i, d := range layers {
+		if err := readLayer(ctx, w, d, true, func(tr *tar.Reader, hdr *tar.Header) error {
+			path, base := squashPath(hdr.Name)
+			if strings.HasPrefix(base, whiteoutPrefix) || written[path] {
+				return nil
+			}
+
+			isDir := hdr.Typeflag == tar.TypeDir
+			if !state.visible(path, i, isDir) {
+				return nil
+			}
+			written[path] = true
+
+			if isDir {
+				// the directory as set by the topmost layer
+				hdr = state[path].hdr
+			}
+
+			hdr.Name = path
+			if isDir {
+				hdr.Name += "/"
+			}
+
+			if hdr.Typeflag == tar.TypeLink {
+				// the target may come from an upper layer
+				links = append(links, hdr)
+				return nil
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if isDir {
+				return nil
+			}
+			_, err := io.Copy(tw, tr)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, hdr := range links {
+		target, _ := squashPath(hdr.Linkname)
+		if !written[target] {
+			return fmt.Errorf("%s: hard link target %s is not in the squashed layer", hdr.Name, hdr.Linkname)
+		}
+		hdr.Linkname = target
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// readLayer calls f with every entry of the layer d, sending the layer
+// events if progress is true.
+func readLayer(ctx context.Context, w walker, d v1.Descriptor, progress bool, f func(tr *tar.Reader, hdr *tar.Header) error) error {
+	lpath := filepath.Join("blobs", string(d.Digest.Algorithm()), d.Digest.Hex())
+	switch err := w.find(ctx, lpath, func(path string, r io.Reader) error {
+		var p *layerProgress
+		if progress {
+			p = newLayerProgress(ctx, d, r)
+			r = p
+		}
+
+		buf := bufio.NewReader(r)
+		comp, err := DetectCompression(buf)
+		if err != nil {
+			return err
+		}
+
+		reader, err := getReader(ctx, path, d.MediaType, comp, buf)
+		if err != nil {
+			return err
+		}
+
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.Wrapf(err, "%s: error advancing tar stream", path)
+			}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := f(tr, hdr); err != nil {
+				return err
+			}
+			if p != nil {
+				p.entry()
+			}
+		}
+
+		if p != nil {
+			p.finish()
+		}
+		return errEOW
+	}); errors.Cause(err) {
+	case nil:
+		return fmt.Errorf("%s: layer not found", lpath)
+	case errEOW:
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// treeFiles returns the contents of the regular files under root, by
+// relative path.
+func treeFiles(t *testing.T, root string) map[string]string {
+	files := map[string]string{}
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(buf)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSquashLayout(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "linux", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "etc/hostname", "etc/hosts", "var/lib/x", "bin/sh"),
+		plainLayer(t, "etc/.wh.hosts", "var/lib/.wh..wh..opq", "var/lib/y", "etc/motd"),
+		plainLayer(t, "etc/.wh.motd", "etc/hosts", "usr/.wh.bin"),
+	)
+
+	desc, err := SquashLayout(layout, "", []string{"name=latest"}, "squashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Annotations[v1.AnnotationRefName] != "squashed" || desc.Platform == nil || desc.Platform.OS != "linux" {
+		t.Errorf("unexpected descriptor %+v", desc)
+	}
+
+	if err := ValidateLayout(layout, []string{"name=squashed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newPathWalker(layout)
+	m, err := findManifest(context.Background(), w, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := findConfig(context.Background(), w, &m.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 1 || len(c.RootFS.DiffIDs) != 1 || len(c.History) != 1 {
+		t.Errorf("expected a single layer, got %d layers, %d diff_ids and %d history entries", len(m.Layers), len(c.RootFS.DiffIDs), len(c.History))
+	}
+
+	original := filepath.Join(root, "original")
+	if err := UnpackLayout(layout, original, "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+	squashed := filepath.Join(root, "squashed")
+	if err := UnpackLayout(layout, squashed, "", []string{"name=squashed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"etc/hostname": "etc/hostname",
+		"etc/hosts":    "etc/hosts",
+		"var/lib/y":    "var/lib/y",
+		"bin/sh":       "bin/sh",
+	}
+	if files := treeFiles(t, original); !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected the original image to hold %v, got %v", expected, files)
+	}
+	if files := treeFiles(t, squashed); !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected the squashed image to hold %v, got %v", expected, files)
+	}
+}
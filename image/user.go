@@ -0,0 +1,302 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// maxSymlinks is the number of symlinks followed by rootfsPath before it
+// gives up, like the kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// rootfsPath returns the host path of the absolute path name inside the
+// root filesystem at rootfs. Symlinks are resolved as if rootfs were the
+// root directory, so the result never points outside of rootfs.
+func rootfsPath(rootfs, name string) (string, error) {
+	var resolved string
+	remaining := filepath.ToSlash(name)
+	links := 0
+
+	for remaining != "" {
+		var part string
+		if i := strings.Index(remaining, "/"); i >= 0 {
+			part, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			part, remaining = remaining, ""
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." || resolved == string(os.PathSeparator) {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// kept as is, but every component is still looked up
+				// since a later ".." may lead back to existing ones
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = filepath.ToSlash(target) + "/" + remaining
+	}
+
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// passwdEntry is a line of /etc/passwd.
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+// groupEntry is a line of /etc/group.
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// parseColonFile calls f with the colon separated fields of every line of
+// the file name inside rootfs. A missing file is not an error.
+func parseColonFile(rootfs, name string, f func(fields []string) error) error {
+	path, err := rootfsPath(rootfs, name)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path) // nolint: errcheck, gosec
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to open file")
+	}
+	defer file.Close()
+
+	return parseColonReader(file, f)
+}
+
+// parseColonReader calls f with the colon separated fields of every line
+// of r, skipping empty lines and comments.
+func parseColonReader(r io.Reader, f func(fields []string) error) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := f(strings.Split(line, ":")); err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
+
+// parsePasswd returns the entries of /etc/passwd inside rootfs. Malformed
+// lines are skipped.
+func parsePasswd(rootfs string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+
+	err := parseColonFile(rootfs, "/etc/passwd", func(fields []string) error {
+		if len(fields) < 7 {
+			return nil
+		}
+
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil
+		}
+
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil
+		}
+
+		entries = append(entries, passwdEntry{
+			name: fields[0],
+			uid:  uid,
+			gid:  gid,
+			home: fields[5],
+		})
+		return nil
+	})
+
+	return entries, err
+}
+
+// parseGroup returns the entries of /etc/group inside rootfs. Malformed
+// lines are skipped.
+func parseGroup(rootfs string) ([]groupEntry, error) {
+	var entries []groupEntry
+
+	err := parseColonFile(rootfs, "/etc/group", func(fields []string) error {
+		if len(fields) < 4 {
+			return nil
+		}
+
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil
+		}
+
+		entry := groupEntry{name: fields[0], gid: gid}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				entry.members = append(entry.members, member)
+			}
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+
+	return entries, err
+}
+
+// resolveUser resolves the user of an image config, given as user,
+// uid, user:group, uid:gid, user:gid or uid:group, against the /etc/passwd
+// and /etc/group files of the root filesystem at rootfs. It returns the
+// process user, including the supplementary groups the user is a member
+// of, and the home directory of the user.
+func resolveUser(rootfs, user string) (specs.User, string, error) {
+	var u specs.User
+	home := "/"
+
+	if user == "" {
+		user = "0"
+	}
+
+	userPart, groupPart := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		userPart, groupPart = user[:i], user[i+1:]
+	}
+
+	if userPart == "" {
+		return u, "", errors.New("config.User: empty user")
+	}
+
+	users, err := parsePasswd(rootfs)
+	if err != nil {
+		return u, "", errors.Wrap(err, "unable to read /etc/passwd")
+	}
+
+	uid, uidErr := strconv.Atoi(userPart)
+	var pwd *passwdEntry
+	for i := range users {
+		if (uidErr == nil && users[i].uid == uid) || (uidErr != nil && users[i].name == userPart) {
+			pwd = &users[i]
+			break
+		}
+	}
+
+	switch {
+	case pwd != nil:
+		u.UID = uint32(pwd.uid)
+		u.GID = uint32(pwd.gid)
+		if pwd.home != "" {
+			home = pwd.home
+		}
+	case uidErr == nil:
+		if uid < 0 {
+			return u, "", fmt.Errorf("config.User: invalid uid %d", uid)
+		}
+		u.UID = uint32(uid)
+	default:
+		return u, "", fmt.Errorf("config.User: unable to find user %s", userPart)
+	}
+
+	groups, err := parseGroup(rootfs)
+	if err != nil {
+		return u, "", errors.Wrap(err, "unable to read /etc/group")
+	}
+
+	if groupPart != "" {
+		gid, err := strconv.Atoi(groupPart)
+		if err != nil {
+			found := false
+			for _, g := range groups {
+				if g.name == groupPart {
+					gid, found = g.gid, true
+					break
+				}
+			}
+			if !found {
+				return u, "", fmt.Errorf("config.User: unable to find group %s", groupPart)
+			}
+		} else if gid < 0 {
+			return u, "", fmt.Errorf("config.User: invalid gid %d", gid)
+		}
+		u.GID = uint32(gid)
+	}
+
+	if pwd != nil {
+		for _, g := range groups {
+			if uint32(g.gid) == u.GID {
+				continue
+			}
+
+			for _, member := range g.members {
+				if member == pwd.name {
+					u.AdditionalGids = append(u.AdditionalGids, uint32(g.gid))
+					break
+				}
+			}
+		}
+	}
+
+	return u, home, nil
+}
@@ -17,6 +17,7 @@ package image
 import (
 	"archive/tar"
 	"archive/zip"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -40,14 +41,28 @@ type findFunc func(path string, r io.Reader) error
 type walker interface {
 
 	// walk calls walkfunc for every entity in the archive
-	walk(walkFunc) error
+	walk(ctx context.Context, f walkFunc) error
 
 	// get will copy an arbitrary blob, defined by desc, in to dst. returns
 	// the number of bytes copied on success.
-	get(desc v1.Descriptor, dst io.Writer) (int64, error)
+	get(ctx context.Context, desc v1.Descriptor, dst io.Writer) (int64, error)
 
 	// find calls findFunc for handling content of path
-	find(path string, ff findFunc) error
+	find(ctx context.Context, path string, ff findFunc) error
+}
+
+// ctxReader is a reader failing with the error of ctx once it is done, so
+// that consumers of walker content stop promptly on cancellation.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
 }
 
 // tarWalker exposes access to image layouts in a tar file.
@@ -63,7 +78,7 @@ func newTarWalker(r io.ReadSeeker) walker {
 	return &tarWalker{r: r}
 }
 
-func (w *tarWalker) walk(f walkFunc) error {
+func (w *tarWalker) walk(ctx context.Context, f walkFunc) error {
 	w.mut.Lock()
 	defer w.mut.Unlock()
 
@@ -85,8 +100,12 @@ loop:
 			return errors.Wrapf(err, "error advancing tar stream")
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		info := hdr.FileInfo()
-		if err := f(hdr.Name, info, tr); err != nil {
+		if err := f(hdr.Name, info, ctxReader{ctx, tr}); err != nil {
 			return err
 		}
 	}
@@ -94,7 +113,7 @@ loop:
 	return nil
 }
 
-func (w *tarWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
+func (w *tarWalker) get(ctx context.Context, desc v1.Descriptor, dst io.Writer) (int64, error) {
 	var bytes int64
 	done := false
 
@@ -115,7 +134,7 @@ func (w *tarWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
 		return nil
 	}
 
-	if err := w.walk(f); err != nil {
+	if err := w.walk(ctx, f); err != nil {
 		return 0, errors.Wrapf(err, "get failed: unable to walk")
 	}
 	if !done {
@@ -125,7 +144,7 @@ func (w *tarWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
 	return bytes, nil
 }
 
-func (w *tarWalker) find(path string, ff findFunc) error {
+func (w *tarWalker) find(ctx context.Context, path string, ff findFunc) error {
 	done := false
 
 	f := func(relpath string, info os.FileInfo, rdr io.Reader) error {
@@ -143,7 +162,7 @@ func (w *tarWalker) find(path string, ff findFunc) error {
 		return nil
 	}
 
-	if err := w.walk(f); err != nil {
+	if err := w.walk(ctx, f); err != nil {
 		return errors.Wrapf(err, "find failed: unable to walk")
 	}
 	if !done {
@@ -169,7 +188,7 @@ func newPathWalker(root string) walker {
 	return &pathWalker{root}
 }
 
-func (w *pathWalker) walk(f walkFunc) error {
+func (w *pathWalker) walk(ctx context.Context, f walkFunc) error {
 	return filepath.Walk(w.root, func(path string, info os.FileInfo, err error) error {
 		// MUST check error value, to make sure the `os.FileInfo` is available.
 		// Otherwise panic risk will exist.
@@ -177,6 +196,10 @@ func (w *pathWalker) walk(f walkFunc) error {
 			return errors.Wrap(err, "error walking path")
 		}
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		rel, err := filepath.Rel(w.root, path)
 		if err != nil {
 			return errors.Wrap(err, "error walking path") // err from filepath.Walk includes path name
@@ -192,11 +215,11 @@ func (w *pathWalker) walk(f walkFunc) error {
 		}
 		defer file.Close()
 
-		return f(rel, info, file)
+		return f(rel, info, ctxReader{ctx, file})
 	})
 }
 
-func (w *pathWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
+func (w *pathWalker) get(ctx context.Context, desc v1.Descriptor, dst io.Writer) (int64, error) {
 	name := filepath.Join(w.root, "blobs", string(desc.Digest.Algorithm()), desc.Digest.Hex())
 
 	info, err := os.Stat(name)
@@ -214,14 +237,18 @@ func (w *pathWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
 	}
 	defer fp.Close()
 
-	nbytes, err := io.Copy(dst, fp)
+	nbytes, err := io.Copy(dst, ctxReader{ctx, fp})
 	if err != nil {
 		return 0, errors.Wrapf(err, "get failed: failed to copy blob to destination")
 	}
 	return nbytes, nil
 }
 
-func (w *pathWalker) find(path string, ff findFunc) error {
+func (w *pathWalker) find(ctx context.Context, path string, ff findFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	name := filepath.Join(w.root, path)
 
 	info, err := os.Stat(name)
@@ -239,7 +266,7 @@ func (w *pathWalker) find(path string, ff findFunc) error {
 	}
 	defer file.Close()
 
-	return ff(name, file)
+	return ff(name, ctxReader{ctx, file})
 }
 
 type zipWalker struct {
@@ -251,7 +278,7 @@ func newZipWalker(fileName string) walker {
 	return &zipWalker{fileName}
 }
 
-func (w *zipWalker) walk(f walkFunc) error {
+func (w *zipWalker) walk(ctx context.Context, f walkFunc) error {
 	r, err := zip.OpenReader(w.fileName)
 	if err != nil {
 		return err
@@ -259,13 +286,17 @@ func (w *zipWalker) walk(f walkFunc) error {
 	defer r.Close()
 
 	for _, file := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		rc, err := file.Open()
 		if err != nil {
 			return err
 		}
 		defer rc.Close()
 		info := file.FileInfo()
-		if err := f(file.Name, info, rc); err != nil {
+		if err := f(file.Name, info, ctxReader{ctx, rc}); err != nil {
 			return err
 		}
 	}
@@ -273,7 +304,7 @@ func (w *zipWalker) walk(f walkFunc) error {
 	return nil
 }
 
-func (w *zipWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
+func (w *zipWalker) get(ctx context.Context, desc v1.Descriptor, dst io.Writer) (int64, error) {
 	var bytes int64
 	done := false
 
@@ -294,7 +325,7 @@ func (w *zipWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
 		return nil
 	}
 
-	if err := w.walk(f); err != nil {
+	if err := w.walk(ctx, f); err != nil {
 		return 0, errors.Wrapf(err, "get failed: unable to walk")
 	}
 	if !done {
@@ -304,7 +335,7 @@ func (w *zipWalker) get(desc v1.Descriptor, dst io.Writer) (int64, error) {
 	return bytes, nil
 }
 
-func (w *zipWalker) find(path string, ff findFunc) error {
+func (w *zipWalker) find(ctx context.Context, path string, ff findFunc) error {
 	done := false
 
 	f := func(relpath string, info os.FileInfo, rdr io.Reader) error {
@@ -322,7 +353,7 @@ func (w *zipWalker) find(path string, ff findFunc) error {
 		return nil
 	}
 
-	if err := w.walk(f); err != nil {
+	if err := w.walk(ctx, f); err != nil {
 		return errors.Wrapf(err, "find failed: unable to walk")
 	}
 	if !done {
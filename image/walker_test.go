@@ -0,0 +1,114 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// tarDir writes the content of the directory root to the tar archive dest.
+func tarDir(t *testing.T, root, dest string) {
+	f, err := os.Create(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUnpackFile unpacks an image layout read from a tar archive, whose
+// walker wraps the errors returned while finding blobs.
+func TestUnpackFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	il := imageLayout{
+		rootDir:   layout,
+		layout:    layoutStr,
+		ref:       ref1,
+		manifest:  manifestStr,
+		index:     indexStr,
+		indexjson: indexJSON,
+		config:    configStr,
+		tarList: []tarContent{
+			{&tar.Header{Name: "test", Size: 4, Mode: 0600}, []byte("test")},
+		},
+	}
+	if err := createImageLayoutBundle(il); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(root, "image.tar")
+	tarDir(t, layout, archive)
+
+	for i, c := range []struct {
+		platform string
+		refs     []string
+	}{
+		{"", ref1},
+		{"linux:amd64", ref2},
+	} {
+		dest := filepath.Join(root, "dest", strconv.Itoa(i))
+		if err := UnpackFile(archive, dest, c.platform, c.refs); err != nil {
+			t.Fatalf("%v: %v", c.refs, err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "test")); err != nil {
+			t.Error(err)
+		}
+	}
+}
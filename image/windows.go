@@ -0,0 +1,311 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// windowsLayersDir is the directory of the bundle holding the layer
+// folders of Windows images.
+const windowsLayersDir = "layers"
+
+// windowsScratchDir is the directory of the bundle holding the writable
+// scratch layer of Windows images, in which the runtime creates the
+// sandbox of the container.
+const windowsScratchDir = "scratch"
+
+// windowsLayerPrefixes are the top-level directories of Windows layers:
+// the files, the registry hives and the utility VM of Hyper-V isolation.
+var windowsLayerPrefixes = []string{"Files", "Hives", "UtilityVM"}
+
+// windowsLayerFolders returns the absolute paths of the layer folders of
+// the image config c in bundle, from the topmost layer to the base layer,
+// followed by the scratch folder as the runtime expects.
+func windowsLayerFolders(c *v1.Image, bundle string) ([]string, error) {
+	abs, err := filepath.Abs(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []string
+	for i := len(c.RootFS.DiffIDs) - 1; i >= 0; i-- {
+		diffID := c.RootFS.DiffIDs[i]
+		if err := validateDigest(diffID); err != nil {
+			return nil, errors.Wrapf(err, "rootfs.diff_ids[%d]", i)
+		}
+		folders = append(folders, filepath.Join(abs, windowsLayersDir, diffID.Hex()))
+	}
+	if len(folders) == 0 {
+		return nil, nil
+	}
+
+	return append(folders, filepath.Join(abs, windowsScratchDir)), nil
+}
+
+// windowsRuntimeSpec returns the runtime configuration for the Windows
+// image config c, whose layers are extracted to the layer folders of
+// bundle. It starts from a copy of template if not nil.
+func windowsRuntimeSpec(c *v1.Image, bundle string, template *specs.Spec) (*specs.Spec, error) {
+	folders, err := windowsLayerFolders(c, bundle)
+	if err != nil {
+		return nil, err
+	}
+	if len(folders) == 0 {
+		return nil, errors.New("rootfs.diff_ids: a Windows image needs at least one layer")
+	}
+
+	s := &specs.Spec{Version: specs.Version}
+	if template != nil {
+		if s, err = copySpec(template); err != nil {
+			return nil, errors.Wrap(err, "unable to copy spec template")
+		}
+		if s.Version == "" {
+			s.Version = specs.Version
+		}
+	}
+
+	if s.Process == nil {
+		s.Process = &specs.Process{}
+	}
+	if s.Process.Cwd == "" {
+		s.Process.Cwd = `C:\`
+	}
+	if s.Windows == nil {
+		s.Windows = &specs.Windows{}
+	}
+	s.Windows.LayerFolders = folders
+
+	annotations := runtimeAnnotations(c)
+	if len(annotations) > 0 && s.Annotations == nil {
+		s.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		s.Annotations[key] = value
+	}
+
+	if c.Config.WorkingDir != "" {
+		s.Process.Cwd = c.Config.WorkingDir
+	}
+	s.Process.Env = mergeEnv(s.Process.Env, c.Config.Env)
+
+	if len(c.Config.Entrypoint) > 0 || len(c.Config.Cmd) > 0 {
+		s.Process.Args = nil
+		s.Process.Args = append(s.Process.Args, c.Config.Entrypoint...)
+		s.Process.Args = append(s.Process.Args, c.Config.Cmd...)
+	}
+	if len(s.Process.Args) == 0 {
+		s.Process.Args = []string{"cmd"}
+	}
+
+	if c.Config.User != "" {
+		s.Process.User = specs.User{Username: c.Config.User}
+	}
+
+	return s, nil
+}
+
+// windowsVolumeMounts returns the mounts of the volumes of the Windows image
+// config c. Only volumes mapped to host paths by hostPaths are supported,
+// the paths are given as is to the runtime.
+func windowsVolumeMounts(c *v1.Image, hostPaths map[string]string) ([]specs.Mount, error) {
+	var dests []string
+	for vol := range c.Config.Volumes {
+		dests = append(dests, vol)
+	}
+	for vol := range hostPaths {
+		if _, ok := c.Config.Volumes[vol]; !ok {
+			dests = append(dests, vol)
+		}
+	}
+	sort.Strings(dests)
+
+	var mounts []specs.Mount
+	for _, vol := range dests {
+		source, ok := hostPaths[vol]
+		if !ok {
+			return nil, fmt.Errorf("volume %s: only volumes mapped to host paths are supported for Windows images", vol)
+		}
+
+		mounts = append(mounts, specs.Mount{
+			Destination: vol,
+			Source:      source,
+		})
+	}
+
+	return mounts, nil
+}
+
+// unpackWindowsLayers extracts every layer of the manifest m of the Windows
+// image config c to its own layer folder of bundle, and creates the empty
+// scratch folder. Whiteouts are kept as is, they are applied by the Windows
+// layer import of the runtime.
+func unpackWindowsLayers(ctx context.Context, w walker, m *v1.Manifest, c *v1.Image, bundle string) error {
+	if len(m.Layers) != len(c.RootFS.DiffIDs) {
+		return fmt.Errorf("manifest has %d layers but config has %d diff_ids", len(m.Layers), len(c.RootFS.DiffIDs))
+	}
+
+	for i, d := range m.Layers {
+		diffID := c.RootFS.DiffIDs[i]
+		if err := validateDigest(diffID); err != nil {
+			return errors.Wrapf(err, "rootfs.diff_ids[%d]", i)
+		}
+
+		dest := filepath.Join(bundle, windowsLayersDir, diffID.Hex())
+		if _, err := os.Stat(dest); err == nil {
+			// the same layer appears several times
+			continue
+		}
+
+		staging, err := stageDir(dest)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(staging)
+
+		lpath := filepath.Join("blobs", string(d.Digest.Algorithm()), d.Digest.Hex())
+		switch err := w.find(ctx, lpath, func(path string, r io.Reader) error {
+			p := newLayerProgress(ctx, d, r)
+			if err := unpackWindowsLayer(ctx, d.MediaType, path, staging, p); err != nil {
+				return errors.Wrap(err, "unpack: error extracting layer")
+			}
+			p.finish()
+
+			return errEOW
+		}); errors.Cause(err) {
+		case nil:
+			return fmt.Errorf("%s: layer not found", lpath)
+		case errEOW:
+		default:
+			return err
+		}
+
+		if err := commitDir(staging, dest); err != nil {
+			return err
+		}
+	}
+
+	return os.MkdirAll(filepath.Join(bundle, windowsScratchDir), 0750)
+}
+
+// unpackWindowsLayer extracts the Windows layer read from r to dest. Only
+// the entries under windowsLayerPrefixes are extracted.
+func unpackWindowsLayer(ctx context.Context, mediaType, path, dest string, r io.Reader) error {
+	entries := make(map[string]bool)
+
+	buf := bufio.NewReader(r)
+
+	comp, err := DetectCompression(buf)
+	if err != nil {
+		return err
+	}
+
+	reader, err := getReader(ctx, path, mediaType, comp, buf)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(reader)
+	counter, _ := r.(entryCounter)
+
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			return nil
+		case nil:
+			// success, continue below
+		default:
+			return errors.Wrapf(err, "error advancing tar stream")
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		top := strings.SplitN(name, string(os.PathSeparator), 2)[0]
+		known := false
+		for _, prefix := range windowsLayerPrefixes {
+			if strings.EqualFold(top, prefix) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			debugf(ctx, "%s: skipping %q outside of the Windows layer folders", path, hdr.Name)
+			continue
+		}
+
+		if strings.HasPrefix(filepath.Base(name), whiteoutPrefix) {
+			// unpackLayerEntry applies whiteouts, keep the marker instead
+			if err := unpackWhiteoutMarker(dest, name, &entries); err != nil {
+				return err
+			}
+		} else if _, err := unpackLayerEntry(dest, hdr, tr, &entries, nil); err != nil {
+			return err
+		}
+
+		if counter != nil {
+			counter.entry()
+		}
+	}
+}
+
+// unpackWhiteoutMarker creates the whiteout name as an empty file in dest.
+// Its parent directories are resolved inside dest, like those of the other
+// entries.
+func unpackWhiteoutMarker(dest, name string, entries *map[string]bool) error {
+	rel, err := filepath.Rel(dest, filepath.Join(dest, name))
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return fmt.Errorf("%q is outside of %q", name, dest)
+	}
+
+	dir, err := rootfsPath(dest, filepath.Dir(rel))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, filepath.Base(rel))
+	if (*entries)[path] {
+		return fmt.Errorf("duplicate entry for %s", path)
+	}
+	(*entries)[path] = true
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to open file")
+	}
+
+	return f.Close()
+}
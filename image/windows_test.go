@@ -0,0 +1,164 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestCreateWindowsBundle(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{
+		OS:           "windows",
+		Architecture: "amd64",
+		Config: v1.ImageConfig{
+			User:       "ContainerUser",
+			WorkingDir: `C:\app`,
+			Env:        []string{`PATH=C:\Windows\system32;C:\Windows`},
+			Cmd:        []string{`C:\app\app.exe`},
+		},
+	}
+	createTestImage(t, layout, "latest", &config,
+		plainLayer(t, "Files/Windows/win.ini", "Hives/SOFTWARE_BASE", "UtilityVM/Files/EFI/boot.efi"),
+		plainLayer(t, "Files/app/app.exe", "Files/Windows/.wh.win.ini", "junk"),
+	)
+
+	bundle := filepath.Join(root, "bundle")
+	if err := CreateRuntimeBundleLayout(layout, bundle, "rootfs", "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	layerDir := func(d digest.Digest) string {
+		return filepath.Join(bundle, "layers", d.Hex())
+	}
+
+	for _, name := range []string{
+		filepath.Join(layerDir(config.RootFS.DiffIDs[0]), "Files", "Windows", "win.ini"),
+		filepath.Join(layerDir(config.RootFS.DiffIDs[0]), "Hives", "SOFTWARE_BASE"),
+		filepath.Join(layerDir(config.RootFS.DiffIDs[0]), "UtilityVM", "Files", "EFI", "boot.efi"),
+		filepath.Join(layerDir(config.RootFS.DiffIDs[1]), "Files", "app", "app.exe"),
+		// whiteouts are kept for the Windows layer import
+		filepath.Join(layerDir(config.RootFS.DiffIDs[1]), "Files", "Windows", ".wh.win.ini"),
+		filepath.Join(bundle, "scratch"),
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range []string{
+		filepath.Join(layerDir(config.RootFS.DiffIDs[1]), "junk"),
+		filepath.Join(bundle, "rootfs"),
+	} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: expected not to exist", name)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s specs.Spec
+	if err := json.Unmarshal(buf, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	validateRuntimeSpec(t, &s)
+
+	abs, err := filepath.Abs(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(abs, "layers", config.RootFS.DiffIDs[1].Hex()),
+		filepath.Join(abs, "layers", config.RootFS.DiffIDs[0].Hex()),
+		filepath.Join(abs, "scratch"),
+	}
+	if s.Windows == nil || !reflect.DeepEqual(s.Windows.LayerFolders, expected) {
+		t.Errorf("expected layer folders %v, got %+v", expected, s.Windows)
+	}
+	if s.Root != nil || s.Linux != nil {
+		t.Error("unexpected root or linux section")
+	}
+	if s.Process.User.Username != "ContainerUser" || s.Process.Cwd != `C:\app` {
+		t.Errorf("unexpected process %+v", s.Process)
+	}
+	if !reflect.DeepEqual(s.Process.Args, []string{`C:\app\app.exe`}) || !reflect.DeepEqual(s.Process.Env, config.Config.Env) {
+		t.Errorf("unexpected process %+v", s.Process)
+	}
+}
+
+func TestCreateWindowsBundleSymlinkWhiteout(t *testing.T) {
+	root, err := ioutil.TempDir("", "oci-tool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	host := filepath.Join(root, "host")
+	if err := os.Mkdir(host, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the parent of the whiteout is a symlink pointing outside of the
+	// layer folder
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "Files/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "Files/evil", Typeflag: tar.TypeSymlink, Linkname: host, Mode: 0777},
+		{Name: "Files/evil/.wh.x", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layout := filepath.Join(root, "layout")
+	config := v1.Image{OS: "windows", Architecture: "amd64"}
+	createTestImage(t, layout, "latest", &config, buf.Bytes())
+
+	bundle := filepath.Join(root, "bundle")
+	if err := CreateRuntimeBundleLayout(layout, bundle, "rootfs", "", []string{"name=latest"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(host, ".wh.x")); !os.IsNotExist(err) {
+		t.Error("expected the whiteout not to escape the layer folder")
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "layers", config.RootFS.DiffIDs[0].Hex(), host, ".wh.x")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,506 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// layoutWriter creates or extends an image layout in a directory.
+type layoutWriter struct {
+	root string
+
+	// algorithm addresses the new blobs.
+	algorithm digest.Algorithm
+}
+
+// newLayoutWriter returns a layoutWriter for the directory root, writing
+// new blobs with the digest algorithm of ctx. The directory, its blobs
+// directory and the oci-layout file are created if they do not exist yet.
+func newLayoutWriter(ctx context.Context, root string) (*layoutWriter, error) {
+	algorithm := digestAlgorithm(ctx)
+	if err := CheckAlgorithm(algorithm); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "blobs"), 0755); err != nil {
+		return nil, errors.Wrap(err, "unable to create blobs directory")
+	}
+
+	lw := &layoutWriter{root: root, algorithm: algorithm}
+
+	layoutPath := filepath.Join(root, v1.ImageLayoutFile)
+	if _, err := os.Stat(layoutPath); err == nil {
+		return lw, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lw.writeFile(v1.ImageLayoutFile, buf); err != nil {
+		return nil, err
+	}
+
+	return lw, nil
+}
+
+// blobPath returns the path of the blob addressed by d.
+func (lw *layoutWriter) blobPath(d digest.Digest) string {
+	return filepath.Join(lw.root, "blobs", string(d.Algorithm()), d.Hex())
+}
+
+// hasBlob reports whether the blob addressed by d is already present.
+func (lw *layoutWriter) hasBlob(d digest.Digest) bool {
+	info, err := os.Stat(lw.blobPath(d))
+	return err == nil && !info.IsDir()
+}
+
+// hasBlobOfSize is like hasBlob but also checks that the blob has the size
+// of desc, so that a truncated or otherwise corrupt blob is replaced. The
+// content is not hashed.
+func (lw *layoutWriter) hasBlobOfSize(desc v1.Descriptor) bool {
+	info, err := os.Stat(lw.blobPath(desc.Digest))
+	return err == nil && info.Mode().IsRegular() && info.Size() == desc.Size
+}
+
+// putBlob copies the content of r into the blob store and returns the
+// digest and size of the stored content.
+func (lw *layoutWriter) putBlob(r io.Reader) (digest.Digest, int64, error) {
+	return lw.storeBlob(r, nil, nil)
+}
+
+// putCheckedBlob is like putBlob but calls check with the path of the
+// content before storing it, and discards the content if check fails.
+func (lw *layoutWriter) putCheckedBlob(r io.Reader, check func(path string) error) (digest.Digest, int64, error) {
+	return lw.storeBlob(r, nil, check)
+}
+
+// putVerifiedBlob copies the content of r into the blob store under the
+// digest of desc. The content is verified against the digest and size of
+// desc while it is copied, and discarded if it does not match.
+func (lw *layoutWriter) putVerifiedBlob(desc v1.Descriptor, r io.Reader) error {
+	if err := validateDigest(desc.Digest); err != nil {
+		return err
+	}
+
+	_, _, err := lw.storeBlob(r, &desc, nil)
+	return err
+}
+
+func (lw *layoutWriter) storeBlob(r io.Reader, expected *v1.Descriptor, check func(path string) error) (digest.Digest, int64, error) {
+	f, err := ioutil.TempFile(filepath.Join(lw.root, "blobs"), ".tmp-")
+	if err != nil {
+		return "", 0, errors.Wrap(err, "unable to create blob")
+	}
+	defer os.Remove(f.Name())
+
+	algorithm := lw.algorithm
+	if expected != nil {
+		algorithm = expected.Digest.Algorithm()
+	}
+
+	digester := algorithm.Digester()
+	size, err := io.Copy(io.MultiWriter(f, digester.Hash()), r)
+	if err != nil {
+		f.Close()
+		return "", 0, errors.Wrap(err, "unable to write blob")
+	}
+
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	d := digester.Digest()
+	if expected != nil {
+		if size != expected.Size {
+			return "", 0, fmt.Errorf("%s: size mismatch", expected.Digest)
+		}
+
+		if d != expected.Digest {
+			return "", 0, fmt.Errorf("%s: digest mismatch", expected.Digest)
+		}
+	}
+
+	if check != nil {
+		if err := check(f.Name()); err != nil {
+			return "", 0, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(lw.blobPath(d)), 0755); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(f.Name(), lw.blobPath(d)); err != nil {
+		return "", 0, errors.Wrap(err, "unable to store blob")
+	}
+
+	return d, size, nil
+}
+
+// putJSON marshals v into the blob store and returns a descriptor of the
+// given media type for it.
+func (lw *layoutWriter) putJSON(mediaType string, v interface{}) (v1.Descriptor, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	d, size, err := lw.putBlob(bytes.NewReader(buf))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    d,
+		Size:      size,
+	}, nil
+}
+
+// readIndex returns the content of index.json, or an empty index if the
+// layout does not have one yet.
+func (lw *layoutWriter) readIndex() (*v1.Index, error) {
+	index := &v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(lw.root, indexPath))
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, index); err != nil {
+		return nil, errors.Wrap(err, "index.json format mismatch")
+	}
+
+	return index, nil
+}
+
+// writeIndex atomically replaces index.json with index.
+func (lw *layoutWriter) writeIndex(index *v1.Index) error {
+	if index.Manifests == nil {
+		index.Manifests = []v1.Descriptor{}
+	}
+
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return lw.writeFile(indexPath, buf)
+}
+
+// writeFile atomically replaces the file name relative to the layout root.
+func (lw *layoutWriter) writeFile(name string, buf []byte) error {
+	f, err := ioutil.TempFile(lw.root, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(lw.root, name))
+}
+
+// hasReference reports whether index lists the digest d.
+func hasReference(index *v1.Index, d digest.Digest) bool {
+	for _, m := range index.Manifests {
+		if m.Digest == d {
+			return true
+		}
+	}
+	return false
+}
+
+// addReference adds desc to index. An existing entry carrying the same
+// ref name annotation is replaced.
+func addReference(index *v1.Index, desc v1.Descriptor) {
+	if name, ok := desc.Annotations[v1.AnnotationRefName]; ok {
+		manifests := index.Manifests[:0]
+		for _, m := range index.Manifests {
+			if m.Annotations[v1.AnnotationRefName] != name {
+				manifests = append(manifests, m)
+			}
+		}
+		index.Manifests = manifests
+	}
+
+	index.Manifests = append(index.Manifests, desc)
+}
+
+// archiveEpoch is the modification time recorded for every entry of the
+// archives written by WriteLayoutTar and WriteLayoutZip. Zip cannot encode
+// times before 1980.
+var archiveEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// layoutEntries returns the paths, relative to root, of the entries making
+// up the image layout in the directory root: oci-layout, index.json, then
+// the blobs directory and its blobs sorted by digest. Directories have a
+// trailing slash. Files which are not part of the layout are left out.
+func layoutEntries(root string) ([]string, error) {
+	entries := []string{v1.ImageLayoutFile, indexPath, "blobs/"}
+
+	algorithms, err := ioutil.ReadDir(filepath.Join(root, "blobs"))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read blobs directory")
+	}
+
+	// ioutil.ReadDir sorts by name, which sorts the blobs by digest
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			debugf(context.Background(), "%s: skipping file outside of an algorithm directory", algorithm.Name())
+			continue
+		}
+
+		entries = append(entries, "blobs/"+algorithm.Name()+"/")
+
+		blobs, err := ioutil.ReadDir(filepath.Join(root, "blobs", algorithm.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read blobs directory")
+		}
+
+		for _, blob := range blobs {
+			if !blob.Mode().IsRegular() || strings.HasPrefix(blob.Name(), ".") {
+				debugf(context.Background(), "%s: skipping non-blob entry", blob.Name())
+				continue
+			}
+
+			entries = append(entries, "blobs/"+algorithm.Name()+"/"+blob.Name())
+		}
+	}
+
+	return entries, nil
+}
+
+// WriteLayoutTar writes the image layout in the directory root to w as a
+// tar archive. Entries are written in a fixed order (oci-layout, index.json,
+// then the blobs sorted by digest) with normalized metadata, so the same
+// layout always produces the same archive byte for byte.
+func WriteLayoutTar(root string, w io.Writer) error {
+	entries, err := layoutEntries(root)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  archiveEpoch,
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(entry))
+		if !strings.HasSuffix(entry, "/") {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+
+			hdr.Typeflag = tar.TypeReg
+			hdr.Mode = 0644
+			hdr.Size = info.Size()
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if err := copyFile(tw, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// WriteLayoutZip writes the image layout in the directory root to w as a
+// zip archive, with the same ordering and normalization as WriteLayoutTar.
+func WriteLayoutZip(root string, w io.Writer) error {
+	entries, err := layoutEntries(root)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{
+			Name:     entry,
+			Method:   zip.Deflate,
+			Modified: archiveEpoch,
+		}
+
+		isDir := strings.HasSuffix(entry, "/")
+		if isDir {
+			hdr.Method = zip.Store
+			hdr.SetMode(os.ModeDir | 0755)
+		} else {
+			hdr.SetMode(0644)
+		}
+
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if !isDir {
+			if err := copyFile(fw, filepath.Join(root, filepath.FromSlash(entry))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return zw.Close()
+}
+
+// WriteLayoutDir copies the image layout in the directory root to the
+// directory dest, which must not exist or be empty. Files which are not
+// part of the layout are left out.
+func WriteLayoutDir(root, dest string) error {
+	entries, err := layoutEntries(root)
+	if err != nil {
+		return err
+	}
+
+	s, err := ioutil.ReadDir(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to open dest")
+	}
+	if len(s) > 0 {
+		return fmt.Errorf("%s is not empty", dest)
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dest, filepath.FromSlash(entry))
+		if strings.HasSuffix(entry, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Wrap(err, "unable to create file")
+		}
+
+		err = copyFile(f, filepath.Join(root, filepath.FromSlash(entry)))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeArchive writes the image layout in the directory root to dest as
+// a tar (TypeImage) or zip (TypeImageZip) archive. The archive is written to
+// a temporary file next to dest which replaces dest on success.
+func writeArchive(root, dest, typ string) (retErr error) {
+	f, err := ioutil.TempFile(filepath.Dir(dest), ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "unable to create archive")
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	switch typ {
+	case TypeImage:
+		err = WriteLayoutTar(root, f)
+	case TypeImageZip:
+		err = WriteLayoutZip(root, f)
+	default:
+		err = fmt.Errorf("cannot write archive of type %q", typ)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), dest)
+}
+
+// copyFile copies the content of the file at path to w.
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path) // nolint: errcheck, gosec
+	if err != nil {
+		return errors.Wrap(err, "unable to open file")
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}